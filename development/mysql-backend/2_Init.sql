@@ -40,7 +40,7 @@ UNLOCK TABLES;
 
 LOCK TABLES `isu_condition` WRITE;
 /*!40000 ALTER TABLE `isu_condition` DISABLE KEYS */;
-INSERT INTO `isu_condition` VALUES (1,'0694e4d7-dfce-4aec-b7ca-887ac42cfb8f','2021-06-16 00:33:41',0,'is_dirty=false,is_overweight=false,is_broken=false','さみしい','2021-06-16 02:33:40.585438'),(2,'0694e4d7-dfce-4aec-b7ca-887ac42cfb8f','2021-06-16 01:33:41',1,'is_dirty=true,is_overweight=true,is_broken=false','たのしい','2021-06-16 02:33:40.587887'),(3,'f012233f-c50e-4349-9473-95681becff1e','2021-06-16 00:33:41',1,'is_dirty=true,is_overweight=true,is_broken=false','つかれた','2021-06-16 02:33:40.591421'),(4,'f012233f-c50e-4349-9473-95681becff1e','2021-06-16 01:33:41',1,'is_dirty=true,is_overweight=true,is_broken=true','つらい','2021-06-16 02:33:40.593788');
+INSERT INTO `isu_condition` VALUES (1,'0694e4d7-dfce-4aec-b7ca-887ac42cfb8f','2021-06-16 00:33:41',0,'is_dirty=false,is_overweight=false,is_broken=false',0,0,0,'info','さみしい','2021-06-16 02:33:40.585438'),(2,'0694e4d7-dfce-4aec-b7ca-887ac42cfb8f','2021-06-16 01:33:41',1,'is_dirty=true,is_overweight=true,is_broken=false',1,1,0,'warning','たのしい','2021-06-16 02:33:40.587887'),(3,'f012233f-c50e-4349-9473-95681becff1e','2021-06-16 00:33:41',1,'is_dirty=true,is_overweight=true,is_broken=false',1,1,0,'warning','つかれた','2021-06-16 02:33:40.591421'),(4,'f012233f-c50e-4349-9473-95681becff1e','2021-06-16 01:33:41',1,'is_dirty=true,is_overweight=true,is_broken=true',1,1,1,'critical','つらい','2021-06-16 02:33:40.593788');
 /*!40000 ALTER TABLE `isu_condition` ENABLE KEYS */;
 UNLOCK TABLES;
 
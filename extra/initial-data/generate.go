@@ -28,6 +28,7 @@ func main() {
 			isuNum                   int
 			conditionDurationMinutes int
 			conditionNum             int
+			organization             string // 空でなければ組織を作成し、ISU を組織に所属させる
 		}{
 			// isucon ユーザは load 中に動かすため ISU は持たない
 			// {
@@ -40,6 +41,7 @@ func main() {
 				5,  // ISU の個数
 				60, // condition を 60 分おきに送信
 				72, // condition の総数は 72 時間分
+				"",
 			},
 			// isucon2 ユーザは企業ユーザ相当
 			{
@@ -47,6 +49,7 @@ func main() {
 				20, // ISU の個数
 				30, // condition を 30 分おきに送信
 				12, // condition の総数は 6 時間分
+				"isucon2 株式会社",
 			},
 			// isucon3 ユーザには isu を作成しない
 			// {
@@ -58,24 +61,38 @@ func main() {
 				1,
 				10,
 				6,
+				"",
 			},
 			{
 				models.NewUser(),
 				1,
 				10,
 				6,
+				"",
 			},
 			{
 				models.NewUser(),
 				1,
 				10,
 				6,
+				"",
 			},
 		}
 		for _, d := range data {
 			if err := d.user.Create(); err != nil {
 				log.Fatal(err)
 			}
+			var organization *models.Organization
+			if d.organization != "" {
+				o := models.NewOrganization(d.organization, d.user.CreatedAt)
+				if err := o.Create(); err != nil {
+					log.Fatal(err)
+				}
+				if err := o.AddMember(d.user, "admin"); err != nil {
+					log.Fatal(err)
+				}
+				organization = &o
+			}
 			isuListById := map[string]models.JsonIsuInfo{}
 			for j := 0; j < d.isuNum; j++ {
 				isuCounter += 1
@@ -97,6 +114,11 @@ func main() {
 				if err := isu.Create(); err != nil {
 					log.Fatal(err)
 				}
+				if organization != nil {
+					if err := organization.AddIsu(isu); err != nil {
+						log.Fatal(err)
+					}
+				}
 
 				var jsonConditions models.JsonConditions
 				// ISU の Condition 分だけ loop
@@ -55,8 +55,8 @@ func NewConditionFromLastCondition(c Condition, durationMinute int) Condition {
 func (c Condition) Create() error {
 	// INSERT INTO isu_condition
 	condition := fmt.Sprintf("is_dirty=%v,is_overweight=%v,is_broken=%v", c.IsDirty, c.IsOverweight, c.IsBroken)
-	if _, err := db.Exec("INSERT INTO isu_condition(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `created_at`) VALUES (?,?,?,?,?,?)",
-		c.Isu.JIAIsuUUID, c.Timestamp, c.IsSitting, condition, c.Message, c.CreatedAt,
+	if _, err := db.Exec("INSERT INTO isu_condition(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `is_dirty`, `is_overweight`, `is_broken`, `condition_level`, `message`, `created_at`) VALUES (?,?,?,?,?,?,?,?,?,?)",
+		c.Isu.JIAIsuUUID, c.Timestamp, c.IsSitting, condition, c.IsDirty, c.IsOverweight, c.IsBroken, c.ConditionLevel().String(), c.Message, c.CreatedAt,
 	); err != nil {
 		return fmt.Errorf("insert isu_condition: %w", err)
 	}
@@ -64,6 +64,17 @@ func (c Condition) Create() error {
 	return nil
 }
 
+func (l ConditionLevel) String() string {
+	switch l {
+	case ConditionLevelWarning:
+		return "warning"
+	case ConditionLevelCritical:
+		return "critical"
+	default:
+		return "info"
+	}
+}
+
 func (c Condition) ConditionLevel() ConditionLevel {
 	warnCount := 0
 	if c.IsDirty {
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -18,8 +20,10 @@ type Isu struct {
 	Image       []byte
 	Character   string
 	CharacterId int
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	// コンディション送信の署名に使う鍵
+	DeviceSecret string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 func NewIsu(user User) Isu {
@@ -36,6 +40,7 @@ func NewIsu(user User) Isu {
 		image,
 		character,
 		characterID,
+		newDeviceSecret(),
 		createdAt,
 		createdAt,
 	}
@@ -53,6 +58,7 @@ func NewIsuWithCreatedAt(user User, createdAt time.Time) Isu {
 		image,
 		character,
 		characterID,
+		newDeviceSecret(),
 		createdAt,
 		createdAt,
 	}
@@ -72,10 +78,21 @@ func NewIsuWithCharacterId(user User, characterID int) Isu {
 		image,
 		character,
 		characterID,
+		newDeviceSecret(),
 		createdAt,
 		createdAt,
 	}
 }
+
+// webapp と同じく32バイトの乱数を16進数にしたもの
+func newDeviceSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("%+v", fmt.Errorf("%w", err))
+	}
+	return hex.EncodeToString(b)
+}
+
 func defaultImage() []byte {
 	bytes, err := ioutil.ReadFile(defaultImagePath)
 	if err != nil {
@@ -103,5 +120,10 @@ func (i Isu) Create() error {
 	); err != nil {
 		return fmt.Errorf("insert isu: %w", err)
 	}
+	if _, err := db.Exec("INSERT INTO isu_device_credential(`jia_isu_uuid`,`secret`,`created_at`) VALUES (?,?,?)",
+		i.JIAIsuUUID, i.DeviceSecret, i.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("insert isu_device_credential: %w", err)
+	}
 	return nil
 }
@@ -34,6 +34,7 @@ type JsonIsuInfo struct {
 	ImageFileHash [md5.Size]byte `json:"image_file_hash"`
 	Character     string         `json:"character"`
 	Conditions    JsonConditions `json:"conditions"`
+	DeviceSecret  string         `json:"device_secret"`
 	CreatedAt     time.Time      `json:"created_at"`
 }
 
@@ -44,6 +45,7 @@ func ToJsonIsuInfo(id int, isu Isu, conditions JsonConditions) JsonIsuInfo {
 		md5.Sum(isu.Image),
 		isu.Character,
 		conditions,
+		isu.DeviceSecret,
 		isu.CreatedAt,
 	}
 }
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+type Organization struct {
+	ID        int64
+	Name      string
+	CreatedAt time.Time
+}
+
+func NewOrganization(name string, createdAt time.Time) Organization {
+	return Organization{Name: name, CreatedAt: createdAt}
+}
+
+func (o *Organization) Create() error {
+	res, err := db.Exec("INSERT INTO organization(`name`,`created_at`) VALUES (?,?)", o.Name, o.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert organization: %w", err)
+	}
+	if o.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("insert organization: %w", err)
+	}
+	return nil
+}
+
+func (o Organization) AddMember(user User, role string) error {
+	if _, err := db.Exec("INSERT INTO organization_member(`organization_id`,`jia_user_id`,`role`,`created_at`) VALUES (?,?,?,?)",
+		o.ID, user.JIAUserID, role, o.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("insert organization_member: %w", err)
+	}
+	return nil
+}
+
+func (o Organization) AddIsu(isu Isu) error {
+	if _, err := db.Exec("INSERT INTO isu_organization(`jia_isu_uuid`,`organization_id`,`registered_by`,`created_at`) VALUES (?,?,?,?)",
+		isu.JIAIsuUUID, o.ID, isu.User.JIAUserID, isu.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("insert isu_organization: %w", err)
+	}
+	return nil
+}
@@ -49,6 +49,11 @@ type ActivateResponse struct {
 type ActivationRequest struct {
 	TargetBaseURL string `json:"target_base_url" validate:"required"`
 	IsuUUID       string `json:"isu_uuid" validate:"required"`
+	DeviceSecret  string `json:"device_secret" validate:"required"`
+}
+
+type DeactivationRequest struct {
+	IsuUUID string `json:"isu_uuid" validate:"required"`
 }
 
 /// Controller ///
@@ -75,13 +80,18 @@ func (c *ActivationController) PostActivate(ctx echo.Context) error {
 		return ctx.String(http.StatusBadRequest, "Bad URL")
 	}
 
+	if req.DeviceSecret == "" {
+		ctx.Logger().Errorf("missing device_secret")
+		return ctx.String(http.StatusBadRequest, "Bad device_secret")
+	}
+
 	isuState, ok := validIsu[req.IsuUUID]
 	if !ok {
 		ctx.Logger().Errorf("bad isu_uuid: %v", req.IsuUUID)
 		return ctx.String(http.StatusNotFound, "Bad isu_uuid")
 	}
 
-	err = c.isuConditionPosterManager.StartPosting(parsedURL, req.IsuUUID)
+	err = c.isuConditionPosterManager.StartPosting(parsedURL, req.IsuUUID, req.DeviceSecret)
 	if err != nil {
 		ctx.Logger().Errorf("failed to startPosting: %v", err)
 		return ctx.NoContent(http.StatusInternalServerError)
@@ -89,3 +99,19 @@ func (c *ActivationController) PostActivate(ctx echo.Context) error {
 
 	return ctx.JSON(http.StatusAccepted, isuState)
 }
+
+func (c *ActivationController) PostDeactivate(ctx echo.Context) error {
+	req := &DeactivationRequest{}
+	err := ctx.Bind(req)
+	if err != nil {
+		ctx.Logger().Errorf("failed to bind: %v", err)
+		return ctx.String(http.StatusBadRequest, "Bad Request")
+	}
+
+	if !c.isuConditionPosterManager.StopPosting(req.IsuUUID) {
+		ctx.Logger().Errorf("not activated isu_uuid: %v", req.IsuUUID)
+		return ctx.String(http.StatusNotFound, "Bad isu_uuid")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
@@ -2,6 +2,9 @@ package controller
 
 import (
 	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -14,6 +17,10 @@ import (
 const (
 	// lifetime は jwt の発行から失効までの期間を表す。
 	lifetime = 30 * time.Minute
+	// issuer は jwt の発行者 (iss) を表す。
+	issuer = "isucon-jia"
+	// audience は jwt の利用者 (aud) を表す。
+	audience = "isucondition"
 )
 
 var (
@@ -30,6 +37,18 @@ var (
 
 type AuthController struct {
 	jwtSecretKey *ecdsa.PrivateKey
+	jwk          JWK
+}
+
+// JWK は JWKS で公開する ES256 の公開鍵を表す。
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
 }
 
 func NewAuthController(key []byte) (*AuthController, error) {
@@ -37,7 +56,27 @@ func NewAuthController(key []byte) (*AuthController, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AuthController{jwtSecretKey}, nil
+	return &AuthController{jwtSecretKey, newJWK(&jwtSecretKey.PublicKey)}, nil
+}
+
+// kid には RFC 7638 の JWK Thumbprint を使う。
+func newJWK(key *ecdsa.PublicKey) JWK {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	jwk := JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+		Alg: "ES256",
+		Use: "sig",
+	}
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)))
+	jwk.Kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return jwk
 }
 
 func (c *AuthController) PostAuth(ctx echo.Context) error {
@@ -61,9 +100,13 @@ func (c *AuthController) PostAuth(ctx echo.Context) error {
 	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
 		"jia_user_id": input.User,
+		"iss":         issuer,
+		"aud":         audience,
 		"iat":         now.Unix(),
+		"nbf":         now.Unix(),
 		"exp":         now.Add(lifetime).Unix(),
 	})
+	token.Header["kid"] = c.jwk.Kid
 	jwt, err := token.SignedString(c.jwtSecretKey)
 	if err != nil {
 		return ctx.NoContent(http.StatusInternalServerError)
@@ -71,3 +114,8 @@ func (c *AuthController) PostAuth(ctx echo.Context) error {
 
 	return ctx.String(http.StatusOK, jwt)
 }
+
+// JWT の検証に使う公開鍵を JWKS として公開する。
+func (c *AuthController) GetJWKS(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, map[string][]JWK{"keys": {c.jwk}})
+}
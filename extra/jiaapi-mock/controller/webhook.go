@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/// Const Values ///
+const webhookHistorySize = 1000
+
+/// Struct for Req/Resp ///
+
+type ReceivedWebhook struct {
+	ReceivedAt int64           `json:"received_at"`
+	DeliveryID string          `json:"delivery_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+/// Controller ///
+
+// isucondition から送られる Webhook を受け取って記録する
+// status クエリパラメータを付けると、そのステータスコードを返して配信の失敗を再現できる
+type WebhookController struct {
+	mu       sync.Mutex
+	received []ReceivedWebhook
+}
+
+func NewWebhookController() *WebhookController {
+	return &WebhookController{received: []ReceivedWebhook{}}
+}
+
+func (c *WebhookController) PostWebhook(ctx echo.Context) error {
+	body, err := ioutil.ReadAll(ctx.Request().Body)
+	if err != nil {
+		ctx.Logger().Errorf("failed to read body: %v", err)
+		return ctx.String(http.StatusBadRequest, "Bad Request")
+	}
+	if !json.Valid(body) {
+		ctx.Logger().Errorf("bad payload: %s", body)
+		return ctx.String(http.StatusBadRequest, "Bad Payload")
+	}
+
+	status := http.StatusNoContent
+	if statusStr := ctx.QueryParam("status"); statusStr != "" {
+		status, err = strconv.Atoi(statusStr)
+		if err != nil || status < 100 || 600 <= status {
+			return ctx.String(http.StatusBadRequest, "Bad status")
+		}
+	}
+
+	c.mu.Lock()
+	c.received = append(c.received, ReceivedWebhook{
+		ReceivedAt: time.Now().Unix(),
+		DeliveryID: ctx.Request().Header.Get("X-Isucondition-Delivery"),
+		Event:      ctx.Request().Header.Get("X-Isucondition-Event"),
+		Payload:    body,
+	})
+	if len(c.received) > webhookHistorySize {
+		c.received = c.received[len(c.received)-webhookHistorySize:]
+	}
+	c.mu.Unlock()
+
+	ctx.Logger().Infof("webhook received: %s", body)
+	return ctx.NoContent(status)
+}
+
+func (c *WebhookController) GetWebhook(ctx echo.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ctx.JSON(http.StatusOK, c.received)
+}
@@ -24,6 +24,7 @@ func main() {
 		panic(err)
 	}
 	activationController := controller.NewActivationController()
+	webhookController := controller.NewWebhookController()
 
 	// Echo instance
 	e := echo.New()
@@ -38,7 +39,12 @@ func main() {
 	e.GET("/", func(ctx echo.Context) error { return ctx.Blob(200, "text/html; charset=utf-8", htmlTopPage) })
 	// APIs
 	e.POST("/api/auth", authController.PostAuth)
+	e.GET("/.well-known/jwks.json", authController.GetJWKS)
 	e.POST("/api/activate", activationController.PostActivate)
+	e.POST("/api/deactivate", activationController.PostDeactivate)
+	// アラートの Webhook を受け取る動作確認用の受け口
+	e.POST("/webhook", webhookController.PostWebhook)
+	e.GET("/webhook", webhookController.GetWebhook)
 
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("JIAAPI_SERVER_PORT", "5000"))
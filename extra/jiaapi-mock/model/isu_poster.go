@@ -3,12 +3,16 @@ package model
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/labstack/gommon/log"
@@ -17,8 +21,9 @@ import (
 const postingIntervalSec = 3
 
 type IsuConditionPoster struct {
-	TargetURL url.URL
-	IsuUUID   string
+	TargetURL    url.URL
+	IsuUUID      string
+	DeviceSecret string
 
 	ctx        context.Context
 	cancelFunc context.CancelFunc
@@ -31,9 +36,18 @@ type IsuConditionRequest struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
-func NewIsuConditionPoster(targetURL *url.URL, isuUUID string) IsuConditionPoster {
+func NewIsuConditionPoster(targetURL *url.URL, isuUUID string, deviceSecret string) IsuConditionPoster {
 	ctx, cancel := context.WithCancel(context.Background())
-	return IsuConditionPoster{*targetURL, isuUUID, ctx, cancel}
+	return IsuConditionPoster{*targetURL, isuUUID, deviceSecret, ctx, cancel}
+}
+
+// "<timestamp>.<body>" に対する HMAC-SHA256 を16進数で返す
+func (m *IsuConditionPoster) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(m.DeviceSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func (m *IsuConditionPoster) KeepPosting() {
@@ -85,8 +99,11 @@ func (m *IsuConditionPoster) KeepPosting() {
 				log.Error(err)
 				return // goto next loop
 			}
+			signedAt := strconv.FormatInt(time.Now().Unix(), 10)
 			httpReq.Header.Set("Content-Type", "application/json")
 			httpReq.Header.Set("User-Agent", "JIA-Members-Client-MOCK/1.0")
+			httpReq.Header.Set("X-Isu-Timestamp", signedAt)
+			httpReq.Header.Set("X-Isu-Signature", m.sign(signedAt, conditionsJSON))
 			resp, err := http.DefaultClient.Do(httpReq)
 			if err != nil {
 				log.Error(err)
@@ -15,14 +15,14 @@ func NewIsuConditionPosterManager() *IsuConditionPosterManager {
 	return &IsuConditionPosterManager{activatedIsu, sync.Mutex{}}
 }
 
-func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID string) error {
+func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID string, deviceSecret string) error {
 	conflict := func() bool {
 		m.activatedIsuMtx.Lock()
 		defer m.activatedIsuMtx.Unlock()
 		if _, ok := m.activatedIsu[isuUUID]; ok {
 			return true
 		}
-		m.activatedIsu[isuUUID] = NewIsuConditionPoster(targetURL, isuUUID)
+		m.activatedIsu[isuUUID] = NewIsuConditionPoster(targetURL, isuUUID, deviceSecret)
 		return false
 	}()
 	if !conflict {
@@ -31,3 +31,16 @@ func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID str
 	}
 	return nil
 }
+
+// 投稿を止めて管理対象から外す (activate されていなければ false を返す)
+func (m *IsuConditionPosterManager) StopPosting(isuUUID string) bool {
+	m.activatedIsuMtx.Lock()
+	defer m.activatedIsuMtx.Unlock()
+	isu, ok := m.activatedIsu[isuUUID]
+	if !ok {
+		return false
+	}
+	isu.StopPosting()
+	delete(m.activatedIsu, isuUUID)
+	return true
+}
@@ -9,6 +9,7 @@ MYSQL_USER=isucon
 MYSQL_DBNAME=isucondition
 MYSQL_PASS=isucon
 POST_ISUCONDITION_TARGET_BASE_URL="https://isucondition-${index}.t.isucon.dev"
+JIA_JWT_LEGACY_KEY_UNTIL="2027-04-01T00:00:00+09:00"
 _EOF_
 chown isucon: /home/isucon/env.sh
 
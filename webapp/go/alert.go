@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 指定したコンディションレベルが threshold 回続いたら発火
+	alertKindConsecutiveLevel = "consecutive_level"
+	// 指定した項目に問題がある状態が threshold 秒続いたら発火
+	alertKindConditionDuration = "condition_duration"
+	// コンディションが threshold 秒届かなかったら発火
+	alertKindNoCondition = "no_condition"
+
+	alertEventFiring   = "firing"
+	alertEventResolved = "resolved"
+)
+
+// ユーザが定義したアラートルール
+// jia_isu_uuid と character のどちらか一方で対象のISUを指定する
+type AlertRule struct {
+	ID             int       `db:"id" json:"id"`
+	JIAUserID      string    `db:"jia_user_id" json:"-"`
+	JIAIsuUUID     *string   `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Character      *string   `db:"character" json:"character"`
+	Kind           string    `db:"kind" json:"kind"`
+	ConditionLevel string    `db:"condition_level" json:"condition_level,omitempty"`
+	ConditionName  string    `db:"condition_name" json:"condition_name,omitempty"`
+	Threshold      int       `db:"threshold" json:"threshold"`
+	WebhookURL     string    `db:"webhook_url" json:"webhook_url"`
+	CreatedAt      time.Time `db:"created_at" json:"-"`
+}
+
+type PostAlertRuleRequest struct {
+	JIAIsuUUID     *string `json:"jia_isu_uuid"`
+	Character      *string `json:"character"`
+	Kind           string  `json:"kind"`
+	ConditionLevel string  `json:"condition_level"`
+	ConditionName  string  `json:"condition_name"`
+	Threshold      int     `json:"threshold"`
+	WebhookURL     string  `json:"webhook_url"`
+}
+
+// ルールとISUの組ごとの評価状態
+type AlertState struct {
+	AlertRuleID    int        `db:"alert_rule_id"`
+	JIAIsuUUID     string     `db:"jia_isu_uuid"`
+	Firing         bool       `db:"firing"`
+	Streak         int        `db:"streak"`
+	ActiveSince    *time.Time `db:"active_since"`
+	LastTimestamp  *time.Time `db:"last_timestamp"`
+	LastReceivedAt *time.Time `db:"last_received_at"`
+	UpdatedAt      time.Time  `db:"updated_at"`
+}
+
+func (req PostAlertRuleRequest) validate() error {
+	if (req.JIAIsuUUID == nil) == (req.Character == nil) {
+		return fmt.Errorf("either jia_isu_uuid or character is required")
+	}
+	if req.Character != nil && *req.Character == "" {
+		return fmt.Errorf("bad format: character")
+	}
+	if req.Threshold <= 0 {
+		return fmt.Errorf("bad format: threshold")
+	}
+
+	switch req.Kind {
+	case alertKindConsecutiveLevel:
+		switch req.ConditionLevel {
+		case conditionLevelInfo, conditionLevelWarning, conditionLevelCritical:
+		default:
+			return fmt.Errorf("bad format: condition_level")
+		}
+	case alertKindConditionDuration:
+		if _, ok := conditionRegistry.Lookup(req.ConditionName); !ok {
+			return fmt.Errorf("bad format: condition_name")
+		}
+	case alertKindNoCondition:
+	default:
+		return fmt.Errorf("bad format: kind")
+	}
+
+	u, err := url.Parse(req.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad format: webhook_url")
+	}
+	// 名前で指定された場合は配信時に接続先のアドレスを確認する
+	ip := net.ParseIP(u.Hostname())
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil && !isWebhookAddressAllowed(ip) {
+		return fmt.Errorf("bad format: webhook_url")
+	}
+	return nil
+}
+
+// サインインしているユーザのアラートルールを取得
+func getAlertRuleByID(c echo.Context, jiaUserID string) (AlertRule, int, error) {
+	alertRuleID, err := strconv.Atoi(c.Param("alert_rule_id"))
+	if err != nil {
+		return AlertRule{}, http.StatusBadRequest, fmt.Errorf("bad format: alert_rule_id")
+	}
+
+	var rule AlertRule
+	err = db.Get(&rule, "SELECT * FROM `alert_rule` WHERE `id` = ? AND `jia_user_id` = ?", alertRuleID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AlertRule{}, http.StatusNotFound, fmt.Errorf("not found: alert_rule")
+		}
+		return AlertRule{}, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+	return rule, 0, nil
+}
+
+// GET /api/alert_rule
+// サインインしているユーザのアラートルール一覧を取得
+func getAlertRules(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rules := []AlertRule{}
+	err = db.Select(&rules, "SELECT * FROM `alert_rule` WHERE `jia_user_id` = ? ORDER BY `id` DESC", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, rules)
+}
+
+// POST /api/alert_rule
+// アラートルールを登録
+func postAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req PostAlertRuleRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	err = req.validate()
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if req.JIAIsuUUID != nil {
+		_, errStatusCode, err = authorizeIsu(db, jiaUserID, *req.JIAIsuUUID, isuRoleViewer)
+		if err != nil {
+			if errStatusCode == http.StatusInternalServerError {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.String(errStatusCode, err.Error())
+		}
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO `alert_rule`"+
+			"	(`jia_user_id`, `jia_isu_uuid`, `character`, `kind`, `condition_level`, `condition_name`, `threshold`, `webhook_url`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		jiaUserID, req.JIAIsuUUID, req.Character, req.Kind, req.ConditionLevel, req.ConditionName, req.Threshold, req.WebhookURL)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	alertRuleID, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var rule AlertRule
+	err = db.Get(&rule, "SELECT * FROM `alert_rule` WHERE `id` = ?", alertRuleID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, rule)
+}
+
+// GET /api/alert_rule/:alert_rule_id
+// アラートルールを取得
+func getAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rule, errStatusCode, err := getAlertRuleByID(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, rule)
+}
+
+// DELETE /api/alert_rule/:alert_rule_id
+// アラートルールと、その評価状態・配信記録を削除
+func deleteAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rule, errStatusCode, err := getAlertRuleByID(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM `alert_state` WHERE `alert_rule_id` = ?",
+		"DELETE FROM `webhook_delivery` WHERE `alert_rule_id` = ?",
+		"DELETE FROM `alert_rule` WHERE `id` = ?",
+	} {
+		_, err = tx.Exec(query, rule.ID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/alert_rule/:alert_rule_id/delivery
+// アラートルールの Webhook 配信記録を新しい順に取得
+func getAlertRuleDeliveries(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rule, errStatusCode, err := getAlertRuleByID(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	deliveries := []WebhookDelivery{}
+	err = db.Select(&deliveries,
+		"SELECT * FROM `webhook_delivery` WHERE `alert_rule_id` = ? ORDER BY `id` DESC LIMIT ?",
+		rule.ID, webhookDeliveryLogLimit)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := make([]GetWebhookDeliveryResponse, 0, len(deliveries))
+	for _, d := range deliveries {
+		res = append(res, d.response())
+	}
+	return c.JSON(http.StatusOK, res)
+}
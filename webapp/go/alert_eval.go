@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const alertScheduleInterval = 30 * time.Second
+
+// ルールと対象ISUの組を取得する
+var alertTargetSelect = "SELECT `alert_rule`.*, `isu`.`jia_isu_uuid` AS `target_jia_isu_uuid`, `isu`.`name` AS `target_isu_name`" +
+	"	FROM `alert_rule` JOIN `isu`" +
+	"	ON (`isu`.`jia_isu_uuid` = `alert_rule`.`jia_isu_uuid` OR `isu`.`character` = `alert_rule`.`character`)" +
+	isuGrantJoinFor("`alert_rule`.`jia_user_id`")
+
+// ルールの所有者が閲覧できるISUに限る
+// 共有や組織から外れたISUは評価しない
+const alertTargetAccessible = "(`isu`.`jia_user_id` = `alert_rule`.`jia_user_id`" +
+	" OR `isu_acl`.`role` IS NOT NULL OR `organization_member`.`role` IS NOT NULL)"
+
+// ルールと、そのルールの対象になるISUの組
+type alertTarget struct {
+	AlertRule
+	TargetIsuUUID string `db:"target_jia_isu_uuid"`
+	TargetIsuName string `db:"target_isu_name"`
+}
+
+// 発火・解消の通知内容
+type alertEvent struct {
+	Event     string
+	Timestamp time.Time
+	Condition *IsuCondition
+}
+
+// Webhook に POST する内容
+type AlertWebhookPayload struct {
+	Event       string                   `json:"event"`
+	AlertRuleID int                      `json:"alert_rule_id"`
+	Kind        string                   `json:"kind"`
+	JIAIsuUUID  string                   `json:"jia_isu_uuid"`
+	IsuName     string                   `json:"isu_name"`
+	Timestamp   int64                    `json:"timestamp"`
+	Condition   *GetIsuConditionResponse `json:"condition,omitempty"`
+}
+
+// 書き込みが終わったコンディションでアラートルールを評価する
+func evaluateAlertRules(conditions []IsuCondition, now time.Time) error {
+	byIsu := map[string][]IsuCondition{}
+	for _, cond := range conditions {
+		byIsu[cond.JIAIsuUUID] = append(byIsu[cond.JIAIsuUUID], cond)
+	}
+	jiaIsuUUIDs := make([]string, 0, len(byIsu))
+	for jiaIsuUUID, conds := range byIsu {
+		sort.Slice(conds, func(i, j int) bool { return conds[i].Timestamp.Before(conds[j].Timestamp) })
+		jiaIsuUUIDs = append(jiaIsuUUIDs, jiaIsuUUID)
+	}
+	if len(jiaIsuUUIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(
+		alertTargetSelect+
+			"	WHERE "+alertTargetAccessible+" AND `isu`.`jia_isu_uuid` IN (?)",
+		jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+	targets := []alertTarget{}
+	err = db.Select(&targets, query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, target := range targets {
+		err = updateAlertState(target, now, func(state *AlertState) []alertEvent {
+			return target.apply(state, byIsu[target.TargetIsuUUID], now)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// コンディションを順に評価状態に反映し、発火・解消したものを返す
+// 評価済みのものより古いコンディションは無視する
+func (r AlertRule) apply(state *AlertState, conditions []IsuCondition, now time.Time) []alertEvent {
+	events := []alertEvent{}
+	transition := func(firing bool, cond IsuCondition) {
+		if state.Firing == firing {
+			return
+		}
+		state.Firing = firing
+		event := alertEventResolved
+		if firing {
+			event = alertEventFiring
+		}
+		events = append(events, alertEvent{Event: event, Timestamp: cond.Timestamp, Condition: &cond})
+	}
+
+	for _, cond := range conditions {
+		if state.LastTimestamp != nil && !cond.Timestamp.After(*state.LastTimestamp) {
+			continue
+		}
+		timestamp := cond.Timestamp
+		state.LastTimestamp = &timestamp
+
+		switch r.Kind {
+		case alertKindConsecutiveLevel:
+			if cond.ConditionLevel == r.ConditionLevel {
+				state.Streak++
+			} else {
+				state.Streak = 0
+			}
+			if state.Streak >= r.Threshold {
+				transition(true, cond)
+			} else if state.Streak == 0 {
+				transition(false, cond)
+			}
+		case alertKindConditionDuration:
+			values, err := parseStoredCondition(cond.Condition)
+			if err != nil {
+				continue
+			}
+			if !values[r.ConditionName] {
+				state.ActiveSince = nil
+				transition(false, cond)
+				continue
+			}
+			if state.ActiveSince == nil {
+				state.ActiveSince = &timestamp
+			}
+			if cond.Timestamp.Sub(*state.ActiveSince) >= time.Duration(r.Threshold)*time.Second {
+				transition(true, cond)
+			}
+		case alertKindNoCondition:
+			transition(false, cond)
+		}
+	}
+
+	if len(conditions) > 0 {
+		state.LastReceivedAt = &now
+	}
+	return events
+}
+
+// 評価状態を排他的に読み出して更新し、発火・解消があれば Webhook の配信を積む
+func updateAlertState(target alertTarget, now time.Time, update func(state *AlertState) []alertEvent) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT IGNORE INTO `alert_state` (`alert_rule_id`, `jia_isu_uuid`) VALUES (?, ?)",
+		target.ID, target.TargetIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	var state AlertState
+	err = tx.Get(&state, "SELECT * FROM `alert_state` WHERE `alert_rule_id` = ? AND `jia_isu_uuid` = ? FOR UPDATE",
+		target.ID, target.TargetIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	events := update(&state)
+
+	_, err = tx.Exec(
+		"UPDATE `alert_state` SET `firing` = ?, `streak` = ?, `active_since` = ?, `last_timestamp` = ?, `last_received_at` = ?"+
+			"	WHERE `alert_rule_id` = ? AND `jia_isu_uuid` = ?",
+		state.Firing, state.Streak, state.ActiveSince, state.LastTimestamp, state.LastReceivedAt,
+		target.ID, target.TargetIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, event := range events {
+		payload := AlertWebhookPayload{
+			Event:       event.Event,
+			AlertRuleID: target.ID,
+			Kind:        target.Kind,
+			JIAIsuUUID:  target.TargetIsuUUID,
+			IsuName:     target.TargetIsuName,
+			Timestamp:   event.Timestamp.Unix(),
+		}
+		if event.Condition != nil {
+			payload.Condition, err = newGetIsuConditionResponse(*event.Condition, target.TargetIsuName, false, nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = enqueueWebhookDelivery(tx, target.AlertRule, target.TargetIsuUUID, payload, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// コンディションが届かなくなったISUのアラートを発火させる
+// 一度もコンディションが届いていない場合はルールの登録時刻から数える
+func checkNoConditionAlerts(now time.Time) error {
+	targets := []alertTarget{}
+	err := db.Select(&targets,
+		alertTargetSelect+
+			"	LEFT JOIN `alert_state` ON `alert_state`.`alert_rule_id` = `alert_rule`.`id`"+
+			"	AND `alert_state`.`jia_isu_uuid` = `isu`.`jia_isu_uuid`"+
+			"	WHERE "+alertTargetAccessible+
+			"	AND `alert_rule`.`kind` = ? AND NOT COALESCE(`alert_state`.`firing`, FALSE)"+
+			"	AND COALESCE(`alert_state`.`last_received_at`, `alert_rule`.`created_at`)"+
+			"	< DATE_SUB(?, INTERVAL `alert_rule`.`threshold` SECOND)",
+		alertKindNoCondition, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, target := range targets {
+		err = updateAlertState(target, now, func(state *AlertState) []alertEvent {
+			// 検索してからロックするまでの間にコンディションが届いていれば何もしない
+			since := target.CreatedAt
+			if state.LastReceivedAt != nil {
+				since = *state.LastReceivedAt
+			}
+			if state.Firing || now.Sub(since) < time.Duration(target.Threshold)*time.Second {
+				return nil
+			}
+			state.Firing = true
+			return []alertEvent{{Event: alertEventFiring, Timestamp: now}}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// コンディションが届かないことを検知するアラートを定期的に評価する
+func runAlertWorker(ctx context.Context) {
+	ticker := time.NewTicker(alertScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := checkNoConditionAlerts(time.Now())
+			if err != nil {
+				log.Errorf("failed to check no_condition alerts: %v", err)
+			}
+		}
+	}
+}
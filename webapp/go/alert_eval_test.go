@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 初期データと同じコンディションの項目を登録し、テスト後に戻す
+func useTestConditionKeys(t *testing.T) {
+	keys := []ConditionKey{
+		{Name: "is_dirty", DisplayName: "汚れ", SeverityWeight: 1, SortOrder: 1},
+		{Name: "is_overweight", DisplayName: "重量オーバー", SeverityWeight: 1, SortOrder: 2},
+		{Name: "is_broken", DisplayName: "故障", SeverityWeight: 1, SortOrder: 3},
+	}
+	byName := map[string]ConditionKey{}
+	for _, key := range keys {
+		byName[key.Name] = key
+	}
+
+	conditionRegistry.mu.Lock()
+	prevKeys, prevByName := conditionRegistry.keys, conditionRegistry.byName
+	conditionRegistry.keys, conditionRegistry.byName = keys, byName
+	conditionRegistry.mu.Unlock()
+	t.Cleanup(func() {
+		conditionRegistry.mu.Lock()
+		conditionRegistry.keys, conditionRegistry.byName = prevKeys, prevByName
+		conditionRegistry.mu.Unlock()
+	})
+}
+
+func TestAlertRuleApply(t *testing.T) {
+	useTestConditionKeys(t)
+	base := time.Unix(1700000000, 0)
+	now := base.Add(time.Hour)
+
+	// offset 秒後のコンディション
+	cond := func(offset int, condition string, level string) IsuCondition {
+		return IsuCondition{Timestamp: base.Add(time.Duration(offset) * time.Second), Condition: condition, ConditionLevel: level}
+	}
+	clean := "is_dirty=false,is_overweight=false,is_broken=false"
+	dirty := "is_dirty=true,is_overweight=false,is_broken=false"
+
+	consecutiveCritical := AlertRule{Kind: alertKindConsecutiveLevel, ConditionLevel: conditionLevelCritical, Threshold: 3}
+	dirtyFor60s := AlertRule{Kind: alertKindConditionDuration, ConditionName: "is_dirty", Threshold: 60}
+	noCondition := AlertRule{Kind: alertKindNoCondition, Threshold: 60}
+
+	tests := []struct {
+		name       string
+		rule       AlertRule
+		state      AlertState
+		conditions []IsuCondition
+		wantEvents []string
+		wantState  AlertState
+	}{
+		{
+			name: "consecutive below threshold",
+			rule: consecutiveCritical,
+			conditions: []IsuCondition{
+				cond(0, clean, conditionLevelCritical), cond(60, clean, conditionLevelCritical),
+			},
+			wantEvents: []string{},
+			wantState:  AlertState{Streak: 2},
+		},
+		{
+			name: "consecutive fires once",
+			rule: consecutiveCritical,
+			conditions: []IsuCondition{
+				cond(0, clean, conditionLevelCritical), cond(60, clean, conditionLevelCritical),
+				cond(120, clean, conditionLevelCritical), cond(180, clean, conditionLevelCritical),
+			},
+			wantEvents: []string{alertEventFiring + "@120"},
+			wantState:  AlertState{Firing: true, Streak: 4},
+		},
+		{
+			name:  "consecutive continues streak from state",
+			rule:  consecutiveCritical,
+			state: AlertState{Streak: 2},
+			conditions: []IsuCondition{
+				cond(0, clean, conditionLevelCritical),
+			},
+			wantEvents: []string{alertEventFiring + "@0"},
+			wantState:  AlertState{Firing: true, Streak: 3},
+		},
+		{
+			name:  "consecutive resolves on other level",
+			rule:  consecutiveCritical,
+			state: AlertState{Firing: true, Streak: 5},
+			conditions: []IsuCondition{
+				cond(0, clean, conditionLevelWarning), cond(60, clean, conditionLevelCritical),
+			},
+			wantEvents: []string{alertEventResolved + "@0"},
+			wantState:  AlertState{Streak: 1},
+		},
+		{
+			name:  "ignores conditions already evaluated",
+			rule:  consecutiveCritical,
+			state: AlertState{Streak: 2, LastTimestamp: timePtr(base.Add(60 * time.Second))},
+			conditions: []IsuCondition{
+				cond(0, clean, conditionLevelCritical), cond(60, clean, conditionLevelCritical),
+			},
+			wantEvents: []string{},
+			wantState:  AlertState{Streak: 2},
+		},
+		{
+			name: "duration fires after threshold",
+			rule: dirtyFor60s,
+			conditions: []IsuCondition{
+				cond(0, dirty, conditionLevelWarning), cond(30, dirty, conditionLevelWarning), cond(60, dirty, conditionLevelWarning),
+			},
+			wantEvents: []string{alertEventFiring + "@60"},
+			wantState:  AlertState{Firing: true, ActiveSince: timePtr(base)},
+		},
+		{
+			name: "duration restarts when cleared",
+			rule: dirtyFor60s,
+			conditions: []IsuCondition{
+				cond(0, dirty, conditionLevelWarning), cond(30, clean, conditionLevelInfo), cond(60, dirty, conditionLevelWarning),
+				cond(90, dirty, conditionLevelWarning),
+			},
+			wantEvents: []string{},
+			wantState:  AlertState{ActiveSince: timePtr(base.Add(60 * time.Second))},
+		},
+		{
+			name:  "duration resolves when cleared",
+			rule:  dirtyFor60s,
+			state: AlertState{Firing: true, ActiveSince: timePtr(base)},
+			conditions: []IsuCondition{
+				cond(120, clean, conditionLevelInfo),
+			},
+			wantEvents: []string{alertEventResolved + "@120"},
+			wantState:  AlertState{},
+		},
+		{
+			name:  "duration skips unparsable conditions",
+			rule:  dirtyFor60s,
+			state: AlertState{ActiveSince: timePtr(base)},
+			conditions: []IsuCondition{
+				cond(120, "broken", conditionLevelInfo),
+			},
+			wantEvents: []string{},
+			wantState:  AlertState{ActiveSince: timePtr(base)},
+		},
+		{
+			name:  "no_condition resolves on any condition",
+			rule:  noCondition,
+			state: AlertState{Firing: true},
+			conditions: []IsuCondition{
+				cond(0, clean, conditionLevelInfo), cond(60, clean, conditionLevelInfo),
+			},
+			wantEvents: []string{alertEventResolved + "@0"},
+			wantState:  AlertState{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := tt.state
+			events := tt.rule.apply(&state, tt.conditions, now)
+
+			got := []string{}
+			for _, e := range events {
+				got = append(got, e.Event+"@"+formatOffset(e.Timestamp.Sub(base)))
+				if e.Condition == nil || !e.Condition.Timestamp.Equal(e.Timestamp) {
+					t.Errorf("event %v has condition %v", e.Event, e.Condition)
+				}
+			}
+			if !equalStrings(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+
+			if state.Firing != tt.wantState.Firing || state.Streak != tt.wantState.Streak {
+				t.Errorf("firing, streak = %v, %v, want %v, %v", state.Firing, state.Streak, tt.wantState.Firing, tt.wantState.Streak)
+			}
+			if !equalTimePtr(state.ActiveSince, tt.wantState.ActiveSince) {
+				t.Errorf("active_since = %v, want %v", state.ActiveSince, tt.wantState.ActiveSince)
+			}
+			last := tt.conditions[len(tt.conditions)-1].Timestamp
+			if tt.state.LastTimestamp != nil && tt.state.LastTimestamp.After(last) {
+				last = *tt.state.LastTimestamp
+			}
+			if state.LastTimestamp == nil || !state.LastTimestamp.Equal(last) {
+				t.Errorf("last_timestamp = %v, want %v", state.LastTimestamp, last)
+			}
+			if state.LastReceivedAt == nil || !state.LastReceivedAt.Equal(now) {
+				t.Errorf("last_received_at = %v, want %v", state.LastReceivedAt, now)
+			}
+		})
+	}
+}
+
+func TestAlertRuleApplyWithoutConditions(t *testing.T) {
+	state := AlertState{Streak: 1}
+	events := AlertRule{Kind: alertKindConsecutiveLevel, ConditionLevel: conditionLevelCritical, Threshold: 3}.
+		apply(&state, nil, time.Now())
+	if len(events) != 0 || state.Streak != 1 || state.LastReceivedAt != nil {
+		t.Errorf("state changed without conditions: %+v, %v", state, events)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func equalTimePtr(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatOffset(d time.Duration) string {
+	return strconv.Itoa(int(d / time.Second))
+}
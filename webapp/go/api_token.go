@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	apiTokenPrefix = "isutk_"
+	apiTokenBytes  = 32
+	// 一覧で見分けるために保存しておくトークンの先頭部分の長さ
+	apiTokenDisplayLength = len(apiTokenPrefix) + 6
+	// last_used_at を書き込む最短の間隔
+	apiTokenTouchInterval = time.Minute
+
+	// GET のみ
+	apiTokenScopeRead = "read"
+	// すべての操作
+	apiTokenScopeWrite = "write"
+)
+
+// ISUを限定したトークンでは、そのISUだけを対象にして応答するエンドポイント
+var apiTokenIsuFilteredPaths = map[string]bool{
+	"/api/isu/conditions/export": true,
+}
+
+// apiTokenIsuFilteredPaths へのリクエストで、トークンが限定しているISUを入れておくキー
+const apiTokenIsuContextKey = "api_token_jia_isu_uuid"
+
+// トークンが限定しているISUを取得 (apiTokenIsuFilteredPaths へのリクエストのみ)
+func getAPITokenIsu(c echo.Context) (string, bool) {
+	jiaIsuUUID, ok := c.Get(apiTokenIsuContextKey).(string)
+	return jiaIsuUUID, ok
+}
+
+type APIToken struct {
+	ID          int64      `db:"id"`
+	JIAUserID   string     `db:"jia_user_id"`
+	Name        string     `db:"name"`
+	TokenHash   string     `db:"token_hash"`
+	TokenPrefix string     `db:"token_prefix"`
+	Scope       string     `db:"scope"`
+	JIAIsuUUID  *string    `db:"jia_isu_uuid"`
+	CreatedAt   time.Time  `db:"created_at"`
+	LastUsedAt  *time.Time `db:"last_used_at"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+}
+
+type PostAPITokenRequest struct {
+	Name       string  `json:"name"`
+	Scope      string  `json:"scope"`
+	JIAIsuUUID *string `json:"jia_isu_uuid"`
+	// 有効期間 (秒)。指定がなければ無期限
+	ExpiresIn *int64 `json:"expires_in"`
+}
+
+type GetAPITokenResponse struct {
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	TokenPrefix string  `json:"token_prefix"`
+	Scope       string  `json:"scope"`
+	JIAIsuUUID  *string `json:"jia_isu_uuid"`
+	CreatedAt   int64   `json:"created_at"`
+	LastUsedAt  *int64  `json:"last_used_at"`
+	ExpiresAt   *int64  `json:"expires_at"`
+}
+
+// 作成時のみトークンそのものを返す
+type PostAPITokenResponse struct {
+	GetAPITokenResponse
+	Token string `json:"token"`
+}
+
+func newGetAPITokenResponse(t APIToken) GetAPITokenResponse {
+	res := GetAPITokenResponse{
+		ID:          t.ID,
+		Name:        t.Name,
+		TokenPrefix: t.TokenPrefix,
+		Scope:       t.Scope,
+		JIAIsuUUID:  t.JIAIsuUUID,
+		CreatedAt:   t.CreatedAt.Unix(),
+	}
+	if t.LastUsedAt != nil {
+		unix := t.LastUsedAt.Unix()
+		res.LastUsedAt = &unix
+	}
+	if t.ExpiresAt != nil {
+		unix := t.ExpiresAt.Unix()
+		res.ExpiresAt = &unix
+	}
+	return res
+}
+
+// Authorization: Bearer <token> の API トークンを取り出す
+// JIA の JWT と区別するためにプレフィックスを見る
+func getBearerAPIToken(c echo.Context) (string, bool) {
+	auth := c.Request().Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return "", false
+	}
+	return token, true
+}
+
+// API トークンを検証し、リクエストがトークンの範囲内であることを確認する
+func authenticateAPIToken(c echo.Context, token string, now time.Time) (string, int, error) {
+	var t APIToken
+	err := db.Get(&t, "SELECT * FROM `api_token` WHERE `token_hash` = ?", hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", http.StatusUnauthorized, fmt.Errorf("invalid token")
+		}
+		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return "", http.StatusUnauthorized, fmt.Errorf("token expired")
+	}
+
+	err = t.checkScope(c.Request().Method, c.Path(), c.Param("jia_isu_uuid"))
+	if err != nil {
+		return "", http.StatusForbidden, err
+	}
+	if t.JIAIsuUUID != nil && apiTokenIsuFilteredPaths[c.Path()] {
+		c.Set(apiTokenIsuContextKey, *t.JIAIsuUUID)
+	}
+
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= apiTokenTouchInterval {
+		_, err = db.Exec("UPDATE `api_token` SET `last_used_at` = ? WHERE `id` = ?", now, t.ID)
+		if err != nil {
+			return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	return t.JIAUserID, 0, nil
+}
+
+// リクエストがトークンの範囲内であることを確認する
+// path はルーティングのパス、jiaIsuUUID はパスに含まれるISU
+func (t *APIToken) checkScope(method string, path string, jiaIsuUUID string) error {
+	if t.Scope == apiTokenScopeRead && method != http.MethodGet && method != http.MethodHead {
+		return fmt.Errorf("forbidden: token scope is read")
+	}
+	// ISUを限定したトークンは、そのISUのエンドポイントと、対象をそのISUに絞れるエンドポイントにしか使えない
+	if t.JIAIsuUUID != nil && !apiTokenIsuFilteredPaths[path] && jiaIsuUUID != *t.JIAIsuUUID {
+		return fmt.Errorf("forbidden: token is restricted to isu %v", *t.JIAIsuUUID)
+	}
+	return nil
+}
+
+// POST /api/user/me/token
+// API トークンを発行
+// トークンでトークンを発行できないよう、セッションでのみ受け付ける
+func postAPIToken(c echo.Context) error {
+	session, errStatusCode, err := getCurrentSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	jiaUserID := session.JIAUserID
+
+	var req PostAPITokenRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.Name == "" {
+		return c.String(http.StatusBadRequest, "missing: name")
+	}
+	if req.Scope != apiTokenScopeRead && req.Scope != apiTokenScopeWrite {
+		return c.String(http.StatusBadRequest, "bad format: scope")
+	}
+	if req.ExpiresIn != nil && *req.ExpiresIn <= 0 {
+		return c.String(http.StatusBadRequest, "bad format: expires_in")
+	}
+
+	if req.JIAIsuUUID != nil {
+		_, errStatusCode, err = authorizeIsu(db, jiaUserID, *req.JIAIsuUUID, isuRoleViewer)
+		if err != nil {
+			if errStatusCode == http.StatusInternalServerError {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.String(errStatusCode, err.Error())
+		}
+	}
+
+	b := make([]byte, apiTokenBytes)
+	_, err = rand.Read(b)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	t := APIToken{
+		JIAUserID:   jiaUserID,
+		Name:        req.Name,
+		TokenHash:   hashToken(token),
+		TokenPrefix: token[:apiTokenDisplayLength],
+		Scope:       req.Scope,
+		JIAIsuUUID:  req.JIAIsuUUID,
+		CreatedAt:   now,
+	}
+	if req.ExpiresIn != nil {
+		expiresAt := now.Add(time.Duration(*req.ExpiresIn) * time.Second)
+		t.ExpiresAt = &expiresAt
+	}
+	result, err := db.Exec(
+		"INSERT INTO `api_token`"+
+			"	(`jia_user_id`, `name`, `token_hash`, `token_prefix`, `scope`, `jia_isu_uuid`, `created_at`, `expires_at`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		t.JIAUserID, t.Name, t.TokenHash, t.TokenPrefix, t.Scope, t.JIAIsuUUID, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	t.ID, err = result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, PostAPITokenResponse{GetAPITokenResponse: newGetAPITokenResponse(t), Token: token})
+}
+
+// GET /api/user/me/token
+// 発行した API トークンの一覧を取得
+func getAPITokens(c echo.Context) error {
+	session, errStatusCode, err := getCurrentSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tokens := []APIToken{}
+	err = db.Select(&tokens, "SELECT * FROM `api_token` WHERE `jia_user_id` = ? ORDER BY `id` DESC", session.JIAUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []GetAPITokenResponse{}
+	for _, t := range tokens {
+		res = append(res, newGetAPITokenResponse(t))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// DELETE /api/user/me/token/:token_id
+// API トークンを失効させる
+func deleteAPIToken(c echo.Context) error {
+	session, errStatusCode, err := getCurrentSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tokenID, err := strconv.ParseInt(c.Param("token_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: token_id")
+	}
+
+	result, err := db.Exec("DELETE FROM `api_token` WHERE `id` = ? AND `jia_user_id` = ?", tokenID, session.JIAUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: token")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
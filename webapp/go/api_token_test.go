@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAPITokenCheckScope(t *testing.T) {
+	isuUUID := "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+
+	tests := []struct {
+		name       string
+		scope      string
+		jiaIsuUUID *string
+		method     string
+		path       string
+		pathIsu    string
+		wantErr    bool
+	}{
+		{name: "read GET", scope: apiTokenScopeRead, method: http.MethodGet, path: "/api/isu"},
+		{name: "read HEAD", scope: apiTokenScopeRead, method: http.MethodHead, path: "/api/isu"},
+		{name: "read POST", scope: apiTokenScopeRead, method: http.MethodPost, path: "/api/isu", wantErr: true},
+		{name: "read DELETE", scope: apiTokenScopeRead, method: http.MethodDelete, path: "/api/isu/:jia_isu_uuid", pathIsu: isuUUID, wantErr: true},
+		{name: "write POST", scope: apiTokenScopeWrite, method: http.MethodPost, path: "/api/isu"},
+		{name: "write PATCH", scope: apiTokenScopeWrite, method: http.MethodPatch, path: "/api/isu/:jia_isu_uuid", pathIsu: isuUUID},
+		{name: "isu token on its isu", scope: apiTokenScopeRead, jiaIsuUUID: &isuUUID, method: http.MethodGet, path: "/api/isu/:jia_isu_uuid", pathIsu: isuUUID},
+		{name: "isu token on other isu", scope: apiTokenScopeRead, jiaIsuUUID: &isuUUID, method: http.MethodGet, path: "/api/isu/:jia_isu_uuid", pathIsu: "other", wantErr: true},
+		{name: "isu token on isu list", scope: apiTokenScopeRead, jiaIsuUUID: &isuUUID, method: http.MethodGet, path: "/api/isu", wantErr: true},
+		{name: "isu token on fleet export", scope: apiTokenScopeRead, jiaIsuUUID: &isuUUID, method: http.MethodGet, path: "/api/isu/conditions/export"},
+		{name: "read isu token writing its isu", scope: apiTokenScopeRead, jiaIsuUUID: &isuUUID, method: http.MethodPatch, path: "/api/isu/:jia_isu_uuid", pathIsu: isuUUID, wantErr: true},
+	}
+	for _, tt := range tests {
+		token := APIToken{Scope: tt.scope, JIAIsuUUID: tt.jiaIsuUUID}
+		err := token.checkScope(tt.method, tt.path, tt.pathIsu)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: checkScope error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// アイコンなどのバイナリを保存する先
+type blobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// ローカルのファイルシステムに保存する blobStore
+// キーの先頭2文字でディレクトリを分ける
+type localBlobStore struct {
+	dir string
+}
+
+var blobKeyPattern = regexp.MustCompile(`^[0-9a-f]{4,128}$`)
+
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid blob key: %v", key)
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+// 一時ファイルに書いてから rename するので、読み込み中に中途半端な内容が見えることはない
+func (s *localBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
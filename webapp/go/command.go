@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// 運用向けのサブコマンド
+// 例: ./isucondition rebuild-graph [jia_isu_uuid], ./isucondition migrate-icons, ./isucondition backfill-thumbnails
+// isu_condition_key を変更した場合は ./isucondition recompute-condition-level でレベルとグラフを計算し直す
+func runCommand(args []string) int {
+	var err error
+	db, err = NewMySQLConnectionEnv().ConnectDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect db: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	err = conditionRegistry.Load(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load condition keys: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "rebuild-graph":
+		jiaIsuUUID := ""
+		if len(args) > 1 {
+			jiaIsuUUID = args[1]
+		}
+		err = rebuildGraphHourly(db, jiaIsuUUID)
+	case "recompute-condition-level":
+		err = recomputeConditionLevels(db)
+		if err == nil {
+			err = rebuildGraphHourly(db, "")
+		}
+	case "migrate-icons":
+		err = initIconStore()
+		if err == nil {
+			err = migrateIcons()
+		}
+	case "backfill-thumbnails":
+		err = initIconStore()
+		if err == nil {
+			err = backfillIconThumbnails()
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %v\n", args[0])
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	conditionExportFormatCSV    = "csv"
+	conditionExportFormatNDJSON = "ndjson"
+
+	// DBから一度に読み込む行数
+	// 接続を持ち続けないよう、この単位で読み込んでは書き出す
+	conditionExportBatchSize = 1000
+	// 1回のエクスポートで書き出すISUの数
+	// これを超える場合は Link ヘッダの next で続きを取得する
+	conditionExportMaxIsus = 100
+)
+
+var conditionExportCSVHeader = []string{
+	"jia_isu_uuid", "isu_name", "timestamp", "local_time", "is_sitting", "condition", "condition_level", "message",
+}
+
+// エクスポートの条件
+type conditionExportQuery struct {
+	StartTime         time.Time
+	EndTime           time.Time
+	ConditionLevels   []string
+	Format            string
+	ConditionAsObject bool
+	Location          *time.Location
+}
+
+// エクスポート先の形式ごとの書き出し
+type conditionExportWriter interface {
+	WriteHeader() error
+	Write(c IsuCondition, isuName string) error
+	Flush() error
+}
+
+type conditionCSVWriter struct {
+	w   *csv.Writer
+	loc *time.Location
+}
+
+func (w *conditionCSVWriter) WriteHeader() error {
+	return w.w.Write(conditionExportCSVHeader)
+}
+
+func (w *conditionCSVWriter) Write(c IsuCondition, isuName string) error {
+	return w.w.Write([]string{
+		c.JIAIsuUUID,
+		isuName,
+		strconv.FormatInt(c.Timestamp.Unix(), 10),
+		c.Timestamp.In(w.loc).Format(time.RFC3339),
+		strconv.FormatBool(c.IsSitting),
+		c.Condition,
+		c.ConditionLevel,
+		c.Message,
+	})
+}
+
+func (w *conditionCSVWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type conditionNDJSONWriter struct {
+	enc               *json.Encoder
+	conditionAsObject bool
+	loc               *time.Location
+}
+
+func (w *conditionNDJSONWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *conditionNDJSONWriter) Write(c IsuCondition, isuName string) error {
+	data, err := newGetIsuConditionResponse(c, isuName, w.conditionAsObject, w.loc)
+	if err != nil {
+		return err
+	}
+	return w.enc.Encode(data)
+}
+
+func (w *conditionNDJSONWriter) Flush() error {
+	return nil
+}
+
+// GET /api/isu/:jia_isu_uuid/conditions/export
+// ISUのコンディション履歴を CSV または NDJSON で書き出す
+func getIsuConditionsExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	q, errStatusCode, err := parseConditionExportQuery(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusBadRequest {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+	errStatusCode, err = checkOrganizationScope(c, access)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	return writeConditionExport(c, q, fmt.Sprintf("isu-%v-conditions", jiaIsuUUID), []Isu{{JIAIsuUUID: jiaIsuUUID, Name: access.Name}})
+}
+
+// GET /api/isu/conditions/export
+// 閲覧できるすべてのISUのコンディション履歴を CSV または NDJSON で書き出す
+// organization_id を指定した場合はその組織のISUのみ、ISUを限定した API トークンではそのISUのみ
+// ISUは jia_isu_uuid の順に conditionExportMaxIsus 件ずつ書き出し、続きがあれば Link ヘッダで after を指定した URL を返す
+func getConditionsExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	q, errStatusCode, err := parseConditionExportQuery(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusBadRequest {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	organizationID, err := parseOrganizationID(c.QueryParam("organization_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	query := "SELECT `isu`.`jia_isu_uuid`, `isu`.`name` FROM `isu`" + isuGrantJoin +
+		"	WHERE (`isu`.`jia_user_id` = ? OR `isu_acl`.`role` IS NOT NULL OR `organization_member`.`role` IS NOT NULL)"
+	args := []interface{}{jiaUserID, jiaUserID, jiaUserID}
+	if organizationID != nil {
+		_, errStatusCode, err = authorizeOrganization(db, jiaUserID, *organizationID, organizationRoleViewer)
+		if err != nil {
+			if errStatusCode == http.StatusInternalServerError {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.String(errStatusCode, err.Error())
+		}
+		query += " AND `isu_organization`.`organization_id` = ?"
+		args = append(args, *organizationID)
+	}
+	if jiaIsuUUID, ok := getAPITokenIsu(c); ok {
+		query += " AND `isu`.`jia_isu_uuid` = ?"
+		args = append(args, jiaIsuUUID)
+	}
+	if after := c.QueryParam("after"); after != "" {
+		query += " AND `isu`.`jia_isu_uuid` > ?"
+		args = append(args, after)
+	}
+	isuList := []Isu{}
+	err = db.Select(&isuList, query+" ORDER BY `isu`.`jia_isu_uuid` LIMIT ?", append(args, conditionExportMaxIsus+1)...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if len(isuList) > conditionExportMaxIsus {
+		isuList = isuList[:conditionExportMaxIsus]
+		requestURL := c.Request().URL
+		values := requestURL.Query()
+		values.Set("after", isuList[len(isuList)-1].JIAIsuUUID)
+		c.Response().Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", requestURL.Path, values.Encode()))
+	}
+
+	return writeConditionExport(c, q, "isu-conditions", isuList)
+}
+
+func parseConditionExportQuery(c echo.Context, jiaUserID string) (conditionExportQuery, int, error) {
+	var q conditionExportQuery
+
+	q.Format = c.QueryParam("format")
+	switch q.Format {
+	case "":
+		q.Format = conditionExportFormatCSV
+	case conditionExportFormatCSV, conditionExportFormatNDJSON:
+	default:
+		return q, http.StatusBadRequest, fmt.Errorf("bad format: format")
+	}
+
+	switch c.QueryParam("condition_format") {
+	case "", "string":
+	case "object":
+		q.ConditionAsObject = true
+	default:
+		return q, http.StatusBadRequest, fmt.Errorf("bad format: condition_format")
+	}
+
+	if startTimeStr := c.QueryParam("start_time"); startTimeStr != "" {
+		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
+		if err != nil {
+			return q, http.StatusBadRequest, fmt.Errorf("bad format: start_time")
+		}
+		q.StartTime = time.Unix(startTimeInt64, 0)
+	}
+	if endTimeStr := c.QueryParam("end_time"); endTimeStr != "" {
+		endTimeInt64, err := strconv.ParseInt(endTimeStr, 10, 64)
+		if err != nil {
+			return q, http.StatusBadRequest, fmt.Errorf("bad format: end_time")
+		}
+		q.EndTime = time.Unix(endTimeInt64, 0)
+	}
+	if !q.StartTime.IsZero() && !q.EndTime.IsZero() && !q.StartTime.Before(q.EndTime) {
+		return q, http.StatusBadRequest, fmt.Errorf("bad format: end_time")
+	}
+
+	// 指定がなければすべてのレベル
+	q.ConditionLevels = []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical}
+	if conditionLevelCSV := c.QueryParam("condition_level"); conditionLevelCSV != "" {
+		q.ConditionLevels = strings.Split(conditionLevelCSV, ",")
+		for _, level := range q.ConditionLevels {
+			switch level {
+			case conditionLevelInfo, conditionLevelWarning, conditionLevelCritical:
+			default:
+				return q, http.StatusBadRequest, fmt.Errorf("bad format: condition_level")
+			}
+		}
+	}
+
+	loc, _, errStatusCode, err := resolveLocation(c, jiaUserID)
+	if err != nil {
+		return q, errStatusCode, err
+	}
+	q.Location = loc
+
+	return q, 0, nil
+}
+
+// ISUごとに古い順でコンディションを書き出す
+// 書き出しを始めた後はステータスコードを変えられないので、エラーはログに残して打ち切る
+func writeConditionExport(c echo.Context, q conditionExportQuery, filename string, isuList []Isu) error {
+	res := c.Response()
+	var w conditionExportWriter
+	switch q.Format {
+	case conditionExportFormatCSV:
+		res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		w = &conditionCSVWriter{w: csv.NewWriter(res), loc: q.Location}
+	case conditionExportFormatNDJSON:
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		w = &conditionNDJSONWriter{enc: json.NewEncoder(res), conditionAsObject: q.ConditionAsObject, loc: q.Location}
+	}
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%v.%v\"", filename, q.Format))
+	res.WriteHeader(http.StatusOK)
+
+	err := w.WriteHeader()
+	if err != nil {
+		c.Logger().Errorf("failed to write export: %v", err)
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	for _, isu := range isuList {
+		var after *time.Time
+		for {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			conditions, err := selectConditionExportBatch(isu.JIAIsuUUID, q, after)
+			if err != nil {
+				c.Logger().Errorf("db error: %v", err)
+				return nil
+			}
+			for _, condition := range conditions {
+				err = w.Write(condition, isu.Name)
+				if err != nil {
+					c.Logger().Errorf("failed to write export: %v", err)
+					return nil
+				}
+			}
+			err = w.Flush()
+			if err != nil {
+				c.Logger().Errorf("failed to write export: %v", err)
+				return nil
+			}
+			res.Flush()
+
+			if len(conditions) < conditionExportBatchSize {
+				break
+			}
+			after = &conditions[len(conditions)-1].Timestamp
+		}
+	}
+	return nil
+}
+
+// after より新しいコンディションを古い順に conditionExportBatchSize 件取得する
+// ISUごとに timestamp は一意なので、timestamp だけを位置として使う
+// 一覧と同じく、コンディションレベルごとにインデックスを順に読んでマージする
+func selectConditionExportBatch(jiaIsuUUID string, q conditionExportQuery, after *time.Time) ([]IsuCondition, error) {
+	conditions := []IsuCondition{}
+	seenLevels := map[string]bool{}
+	for _, level := range q.ConditionLevels {
+		if seenLevels[level] {
+			continue
+		}
+		seenLevels[level] = true
+
+		where := []string{"`jia_isu_uuid` = ?", "`condition_level` = ?"}
+		args := []interface{}{jiaIsuUUID, level}
+		if !q.StartTime.IsZero() {
+			where = append(where, "? <= `timestamp`")
+			args = append(args, q.StartTime)
+		}
+		if !q.EndTime.IsZero() {
+			where = append(where, "`timestamp` < ?")
+			args = append(args, q.EndTime)
+		}
+		if after != nil {
+			where = append(where, "`timestamp` > ?")
+			args = append(args, *after)
+		}
+
+		rows := []IsuCondition{}
+		err := db.Select(&rows,
+			"SELECT * FROM `isu_condition` WHERE "+strings.Join(where, " AND ")+
+				"	ORDER BY `timestamp` ASC LIMIT ?",
+			append(args, conditionExportBatchSize)...)
+		if err != nil {
+			return nil, err
+		}
+		conditions = mergeConditions(conditions, rows, true, conditionExportBatchSize)
+	}
+	return conditions, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const conditionMaxLimit = 100
+
+// コンディション一覧のページ位置
+// クライアントからは中身を意識しない文字列として扱われる
+type conditionCursor struct {
+	Timestamp int64 `json:"t"`
+	ID        int   `json:"i"`
+	// true の場合はカーソルより新しいコンディションを取得する
+	Backward bool `json:"b,omitempty"`
+}
+
+func (cur conditionCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeConditionCursor(s string) (*conditionCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur conditionCursor
+	err = json.Unmarshal(b, &cur)
+	if err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
+
+// コンディション一覧の取得条件
+type conditionQuery struct {
+	JIAIsuUUID      string
+	EndTime         time.Time
+	StartTime       time.Time
+	ConditionLevels []string
+	Limit           int
+	Cursor          *conditionCursor
+}
+
+// コンディション一覧の1ページ分
+type conditionPage struct {
+	Conditions []*GetIsuConditionResponse
+	Next       *conditionCursor
+	Prev       *conditionCursor
+}
+
+// 前後のページへのリンクを Link ヘッダの形式で返す
+func (p *conditionPage) linkHeader(requestURL *url.URL) string {
+	links := []string{}
+	for _, link := range []struct {
+		rel    string
+		cursor *conditionCursor
+	}{{"next", p.Next}, {"prev", p.Prev}} {
+		if link.cursor == nil {
+			continue
+		}
+		query := requestURL.Query()
+		query.Set("cursor", link.cursor.encode())
+		links = append(links, fmt.Sprintf("<%s?%s>; rel=\"%s\"", requestURL.Path, query.Encode(), link.rel))
+	}
+	return strings.Join(links, ", ")
+}
+
+// ISUのコンディションをDBから1ページ分取得
+// コンディションレベルごとに (jia_isu_uuid, condition_level, timestamp, id) のインデックスを順に読んでマージするので、
+// 複数のレベルを指定してもソートは発生しない
+func getIsuConditionsFromDB(db *sqlx.DB, q conditionQuery, isuName string, conditionAsObject bool, loc *time.Location) (*conditionPage, error) {
+	backward := q.Cursor != nil && q.Cursor.Backward
+
+	conditions := []IsuCondition{}
+	seenLevels := map[string]bool{}
+	for _, level := range q.ConditionLevels {
+		if seenLevels[level] {
+			continue
+		}
+		seenLevels[level] = true
+
+		rows, err := selectIsuConditionsByLevel(db, q, level)
+		if err != nil {
+			return nil, err
+		}
+		conditions = mergeConditions(conditions, rows, backward, q.Limit+1)
+	}
+
+	hasMore := len(conditions) > q.Limit
+	if hasMore {
+		conditions = conditions[:q.Limit]
+	}
+	if backward {
+		for i, j := 0, len(conditions)-1; i < j; i, j = i+1, j-1 {
+			conditions[i], conditions[j] = conditions[j], conditions[i]
+		}
+	}
+
+	page := &conditionPage{Conditions: []*GetIsuConditionResponse{}}
+	for _, c := range conditions {
+		data, err := newGetIsuConditionResponse(c, isuName, conditionAsObject, loc)
+		if err != nil {
+			return nil, err
+		}
+		page.Conditions = append(page.Conditions, data)
+	}
+
+	if len(conditions) == 0 {
+		return page, nil
+	}
+	first := conditions[0]
+	last := conditions[len(conditions)-1]
+	if (!backward && hasMore) || backward {
+		page.Next = &conditionCursor{Timestamp: last.Timestamp.Unix(), ID: last.ID}
+	}
+	if (backward && hasMore) || (!backward && q.Cursor != nil) {
+		page.Prev = &conditionCursor{Timestamp: first.Timestamp.Unix(), ID: first.ID, Backward: true}
+	}
+	return page, nil
+}
+
+// 1つのコンディションレベルについて、カーソルから順に q.Limit+1 件取得する
+func selectIsuConditionsByLevel(db *sqlx.DB, q conditionQuery, level string) ([]IsuCondition, error) {
+	where := []string{"`jia_isu_uuid` = ?", "`condition_level` = ?"}
+	args := []interface{}{q.JIAIsuUUID, level}
+	if !q.EndTime.IsZero() {
+		where = append(where, "`timestamp` < ?")
+		args = append(args, q.EndTime)
+	}
+	if !q.StartTime.IsZero() {
+		where = append(where, "? <= `timestamp`")
+		args = append(args, q.StartTime)
+	}
+
+	order := "DESC"
+	if q.Cursor != nil {
+		cursorTime := time.Unix(q.Cursor.Timestamp, 0)
+		if q.Cursor.Backward {
+			where = append(where, "(`timestamp` > ? OR (`timestamp` = ? AND `id` > ?))")
+			order = "ASC"
+		} else {
+			where = append(where, "(`timestamp` < ? OR (`timestamp` = ? AND `id` < ?))")
+		}
+		args = append(args, cursorTime, cursorTime, q.Cursor.ID)
+	}
+
+	conditions := []IsuCondition{}
+	err := db.Select(&conditions,
+		"SELECT * FROM `isu_condition` WHERE "+strings.Join(where, " AND ")+
+			"	ORDER BY `timestamp` "+order+", `id` "+order+
+			"	LIMIT ?",
+		append(args, q.Limit+1)...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return conditions, nil
+}
+
+// (timestamp, id) で並んだ2つの列をマージし、先頭から limit 件を返す
+// backward の場合は古い順、そうでなければ新しい順
+func mergeConditions(a []IsuCondition, b []IsuCondition, backward bool, limit int) []IsuCondition {
+	before := func(x, y IsuCondition) bool {
+		if !x.Timestamp.Equal(y.Timestamp) {
+			return x.Timestamp.Before(y.Timestamp) == backward
+		}
+		return (x.ID < y.ID) == backward
+	}
+
+	merged := make([]IsuCondition, 0, len(a)+len(b))
+	i, j := 0, 0
+	for len(merged) < limit && (i < len(a) || j < len(b)) {
+		if j >= len(b) || (i < len(a) && before(a[i], b[j])) {
+			merged = append(merged, a[i])
+			i++
+		} else {
+			merged = append(merged, b[j])
+			j++
+		}
+	}
+	return merged
+}
+
+// isu_condition の行をAPIのレスポンス形式にする
+// loc が nil の場合は local_time を含めない
+func newGetIsuConditionResponse(c IsuCondition, isuName string, conditionAsObject bool, loc *time.Location) (*GetIsuConditionResponse, error) {
+	var condition interface{} = c.Condition
+	if conditionAsObject {
+		values, err := parseStoredCondition(c.Condition)
+		if err != nil {
+			return nil, err
+		}
+		condition = values
+	}
+	data := &GetIsuConditionResponse{
+		JIAIsuUUID:     c.JIAIsuUUID,
+		IsuName:        isuName,
+		Timestamp:      c.Timestamp.Unix(),
+		IsSitting:      c.IsSitting,
+		Condition:      condition,
+		ConditionLevel: c.ConditionLevel,
+		Message:        c.Message,
+	}
+	if loc != nil {
+		data.LocalTime = c.Timestamp.In(loc).Format(time.RFC3339)
+	}
+	return data, nil
+}
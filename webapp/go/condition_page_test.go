@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionCursorRoundTrip(t *testing.T) {
+	tests := []conditionCursor{
+		{Timestamp: 1700000000, ID: 42},
+		{Timestamp: 1700000000, ID: 42, Backward: true},
+		{Timestamp: 0, ID: 0},
+		{Timestamp: -1, ID: 1},
+	}
+	for _, cur := range tests {
+		s := cur.encode()
+		if strings.ContainsAny(s, "+/=") {
+			t.Errorf("cursor %q is not URL safe", s)
+		}
+		got, err := decodeConditionCursor(s)
+		if err != nil {
+			t.Fatalf("decode(%q): %v", s, err)
+		}
+		if *got != cur {
+			t.Errorf("decode(encode(%+v)) = %+v", cur, *got)
+		}
+	}
+}
+
+func TestDecodeConditionCursorInvalid(t *testing.T) {
+	for _, s := range []string{
+		"!!!",
+		"eyJ0Ij",       // base64 として途中で切れている
+		"bm90IGpzb24",  // "not json"
+		"eyJ0IjoiYSJ9", // {"t":"a"}
+	} {
+		if _, err := decodeConditionCursor(s); err == nil {
+			t.Errorf("decode(%q) succeeded", s)
+		}
+	}
+}
+
+func TestConditionPageLinkHeader(t *testing.T) {
+	u, _ := url.Parse("/api/condition/isu?condition_level=info&cursor=old")
+	next := &conditionCursor{Timestamp: 100, ID: 1}
+	prev := &conditionCursor{Timestamp: 200, ID: 2, Backward: true}
+
+	tests := []struct {
+		name string
+		page conditionPage
+		want []string
+	}{
+		{name: "no links", page: conditionPage{}, want: nil},
+		{name: "next only", page: conditionPage{Next: next}, want: []string{`rel="next"`}},
+		{name: "both", page: conditionPage{Next: next, Prev: prev}, want: []string{`rel="next"`, `rel="prev"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.page.linkHeader(u)
+			if len(tt.want) == 0 {
+				if header != "" {
+					t.Errorf("header = %q, want empty", header)
+				}
+				return
+			}
+			links := strings.Split(header, ", ")
+			if len(links) != len(tt.want) {
+				t.Fatalf("header = %q", header)
+			}
+			for i, link := range links {
+				if !strings.HasSuffix(link, tt.want[i]) {
+					t.Errorf("link %q does not end with %v", link, tt.want[i])
+				}
+				target, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(link, "<"), ">; "+tt.want[i]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if target.Path != u.Path || target.Query().Get("condition_level") != "info" {
+					t.Errorf("link %q lost the request path or query", link)
+				}
+				cur, err := decodeConditionCursor(target.Query().Get("cursor"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := next
+				if tt.want[i] == `rel="prev"` {
+					want = prev
+				}
+				if *cur != *want {
+					t.Errorf("cursor = %+v, want %+v", *cur, *want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeConditions(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	cond := func(offset int, id int) IsuCondition {
+		return IsuCondition{ID: id, Timestamp: base.Add(time.Duration(offset) * time.Second)}
+	}
+	ids := func(conditions []IsuCondition) []int {
+		res := []int{}
+		for _, c := range conditions {
+			res = append(res, c.ID)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name     string
+		a, b     []IsuCondition
+		backward bool
+		limit    int
+		want     []int
+	}{
+		{name: "empty", limit: 10, want: []int{}},
+		{name: "one side", a: []IsuCondition{cond(2, 2), cond(1, 1)}, limit: 10, want: []int{2, 1}},
+		{
+			name:  "newest first",
+			a:     []IsuCondition{cond(5, 5), cond(3, 3), cond(1, 1)},
+			b:     []IsuCondition{cond(4, 4), cond(2, 2)},
+			limit: 10,
+			want:  []int{5, 4, 3, 2, 1},
+		},
+		{
+			name:     "oldest first",
+			a:        []IsuCondition{cond(1, 1), cond(3, 3), cond(5, 5)},
+			b:        []IsuCondition{cond(2, 2), cond(4, 4)},
+			backward: true,
+			limit:    10,
+			want:     []int{1, 2, 3, 4, 5},
+		},
+		{
+			name:  "same timestamp ordered by id",
+			a:     []IsuCondition{cond(1, 7), cond(1, 3)},
+			b:     []IsuCondition{cond(1, 5)},
+			limit: 10,
+			want:  []int{7, 5, 3},
+		},
+		{
+			name:  "truncated to limit",
+			a:     []IsuCondition{cond(5, 5), cond(3, 3), cond(1, 1)},
+			b:     []IsuCondition{cond(4, 4), cond(2, 2)},
+			limit: 3,
+			want:  []int{5, 4, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ids(mergeConditions(tt.a, tt.b, tt.backward, tt.limit))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 重みの合計がこの値以上になるとコンディションレベルが critical になる
+const conditionCriticalWeight = 3
+
+// recomputeConditionLevels で一度に読み込む行数
+const conditionRecomputeBatchSize = 1000
+
+// isu_condition_key に登録されたコンディションの項目
+type ConditionKey struct {
+	Name           string `db:"name" json:"name"`
+	DisplayName    string `db:"display_name" json:"display_name"`
+	SeverityWeight int    `db:"severity_weight" json:"severity_weight"`
+	SortOrder      int    `db:"sort_order" json:"-"`
+}
+
+// コンディションの項目一覧をメモリ上に保持する
+type conditionKeyRegistry struct {
+	mu     sync.RWMutex
+	keys   []ConditionKey
+	byName map[string]ConditionKey
+}
+
+var conditionRegistry = &conditionKeyRegistry{byName: map[string]ConditionKey{}}
+
+// DBから項目一覧を読み込み直す
+func (r *conditionKeyRegistry) Load(db *sqlx.DB) error {
+	keys := []ConditionKey{}
+	err := db.Select(&keys, "SELECT * FROM `isu_condition_key` ORDER BY `sort_order` ASC, `name` ASC")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no condition keys registered")
+	}
+
+	byName := make(map[string]ConditionKey, len(keys))
+	for _, key := range keys {
+		byName[key.Name] = key
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	r.byName = byName
+	return nil
+}
+
+func (r *conditionKeyRegistry) Keys() []ConditionKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys
+}
+
+func (r *conditionKeyRegistry) Lookup(name string) (ConditionKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.byName[name]
+	return key, ok
+}
+
+// "key=bool,key=bool,..." 形式のコンディションを項目ごとの値に分解する
+// 登録されていない項目や重複した項目があればエラーを返す
+// 項目が追加される前の ISU もそのまま送れるよう、含まれていない項目は問題なしとみなす
+func parseCondition(condition string) (ConditionValues, error) {
+	if condition == "" {
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	values := ConditionValues{}
+	for _, condStr := range strings.Split(condition, ",") {
+		name, value, err := splitConditionValue(condStr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := conditionRegistry.Lookup(name); !ok {
+			return nil, fmt.Errorf("unknown condition: %v", name)
+		}
+		if _, ok := values[name]; ok {
+			return nil, fmt.Errorf("duplicated condition: %v", name)
+		}
+		values[name] = value
+	}
+	for _, key := range conditionRegistry.Keys() {
+		if _, ok := values[key.Name]; !ok {
+			values[key.Name] = false
+		}
+	}
+	return values, nil
+}
+
+// isu_condition に保存済みのコンディションを項目ごとの値に分解する
+// 保存した後に項目が追加・削除されていても読めるよう、足りない項目は問題なしとみなし、登録されていない項目は無視する
+func parseStoredCondition(condition string) (ConditionValues, error) {
+	values := ConditionValues{}
+	if condition != "" {
+		for _, condStr := range strings.Split(condition, ",") {
+			name, value, err := splitConditionValue(condStr)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := conditionRegistry.Lookup(name); !ok {
+				continue
+			}
+			values[name] = value
+		}
+	}
+	for _, key := range conditionRegistry.Keys() {
+		if _, ok := values[key.Name]; !ok {
+			values[key.Name] = false
+		}
+	}
+	return values, nil
+}
+
+func splitConditionValue(condStr string) (string, bool, error) {
+	keyValue := strings.Split(condStr, "=")
+	if len(keyValue) != 2 {
+		return "", false, fmt.Errorf("bad format: %v", condStr)
+	}
+	switch keyValue[1] {
+	case "true":
+		return keyValue[0], true, nil
+	case "false":
+		return keyValue[0], false, nil
+	default:
+		return "", false, fmt.Errorf("bad value: %v", condStr)
+	}
+}
+
+// 問題が発生している項目の重みの合計からコンディションレベルを決める
+func conditionLevelFromValues(values ConditionValues) string {
+	weight := 0
+	for name, value := range values {
+		if !value {
+			continue
+		}
+		key, _ := conditionRegistry.Lookup(name)
+		weight += key.SeverityWeight
+	}
+
+	switch {
+	case weight <= 0:
+		return conditionLevelInfo
+	case weight < conditionCriticalWeight:
+		return conditionLevelWarning
+	default:
+		return conditionLevelCritical
+	}
+}
+
+// 項目ごとのコンディションの値
+// JSON では "key=bool,..." 形式の文字列と {"key": bool, ...} 形式のオブジェクトのどちらも受け付ける
+type ConditionValues map[string]bool
+
+func (v *ConditionValues) UnmarshalJSON(b []byte) error {
+	var conditionStr string
+	if err := json.Unmarshal(b, &conditionStr); err == nil {
+		values, err := parseCondition(conditionStr)
+		if err != nil {
+			return err
+		}
+		*v = values
+		return nil
+	}
+
+	values := map[string]bool{}
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("condition must be a string or an object: %v", err)
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("empty condition")
+	}
+	for name := range values {
+		if _, ok := conditionRegistry.Lookup(name); !ok {
+			return fmt.Errorf("unknown condition: %v", name)
+		}
+	}
+	// オブジェクト形式で省略された項目は問題なしとみなす
+	for _, key := range conditionRegistry.Keys() {
+		if _, ok := values[key.Name]; !ok {
+			values[key.Name] = false
+		}
+	}
+	*v = values
+	return nil
+}
+
+// isu_condition_key の並び順で "key=bool,..." 形式の文字列にする
+func (v ConditionValues) String() string {
+	conditions := make([]string, 0, len(v))
+	for _, key := range conditionRegistry.Keys() {
+		value, ok := v[key.Name]
+		if !ok {
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("%v=%v", key.Name, value))
+	}
+	return strings.Join(conditions, ",")
+}
+
+func (v ConditionValues) Level() string {
+	return conditionLevelFromValues(v)
+}
+
+// 現在の isu_condition_key で、保存済みのコンディションの文字列・項目ごとの列・コンディションレベルを計算し直す
+// isu_condition_key を変更した後に実行し、一覧・トレンド・グラフ・アラートで同じレベルを使えるようにする
+func recomputeConditionLevels(db *sqlx.DB) error {
+	lastID := 0
+	for {
+		conditions := []IsuCondition{}
+		err := db.Select(&conditions,
+			"SELECT * FROM `isu_condition` WHERE `id` > ? ORDER BY `id` ASC LIMIT ?", lastID, conditionRecomputeBatchSize)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if len(conditions) == 0 {
+			return nil
+		}
+
+		for _, cond := range conditions {
+			values, err := parseStoredCondition(cond.Condition)
+			if err != nil {
+				return fmt.Errorf("isu_condition %d: %v", cond.ID, err)
+			}
+			condition, level := values.String(), values.Level()
+			isDirty, isOverweight, isBroken := values["is_dirty"], values["is_overweight"], values["is_broken"]
+			if condition == cond.Condition && level == cond.ConditionLevel &&
+				isDirty == cond.IsDirty && isOverweight == cond.IsOverweight && isBroken == cond.IsBroken {
+				continue
+			}
+			_, err = db.Exec(
+				"UPDATE `isu_condition` SET `condition` = ?, `is_dirty` = ?, `is_overweight` = ?, `is_broken` = ?, `condition_level` = ?"+
+					"	WHERE `id` = ?",
+				condition, isDirty, isOverweight, isBroken, level, cond.ID)
+			if err != nil {
+				return fmt.Errorf("db error: %v", err)
+			}
+		}
+		lastID = conditions[len(conditions)-1].ID
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	useTestConditionKeys(t)
+
+	tests := []struct {
+		condition string
+		want      ConditionValues
+		wantErr   bool
+	}{
+		{condition: "is_dirty=false,is_overweight=false,is_broken=false", want: ConditionValues{"is_dirty": false, "is_overweight": false, "is_broken": false}},
+		{condition: "is_broken=true,is_dirty=true,is_overweight=false", want: ConditionValues{"is_dirty": true, "is_overweight": false, "is_broken": true}},
+		{condition: "", wantErr: true},
+		// 項目が追加される前の ISU から送られたものは、含まれていない項目を問題なしとみなす
+		{condition: "is_dirty=true", want: ConditionValues{"is_dirty": true, "is_overweight": false, "is_broken": false}},
+		{condition: "is_dirty=true,is_overweight=true", want: ConditionValues{"is_dirty": true, "is_overweight": true, "is_broken": false}},
+		{condition: "is_dirty=true,is_overweight=false,is_broken=false,is_dirty=true", wantErr: true},
+		{condition: "is_dirty=true,is_overweight=false,is_overweight=false", wantErr: true},
+		{condition: "is_dirty=true,is_overweight=false,is_broken=false,is_wet=true", wantErr: true},
+		{condition: "is_dirty=TRUE,is_overweight=false,is_broken=false", wantErr: true},
+		{condition: "is_dirty,is_overweight=false,is_broken=false", wantErr: true},
+		{condition: "is_dirty=true=false,is_overweight=false,is_broken=false", wantErr: true},
+		{condition: "is_dirty=true,is_overweight=false,is_broken=false,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCondition(tt.condition)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCondition(%q) error = %v, wantErr %v", tt.condition, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !equalConditionValues(got, tt.want) {
+			t.Errorf("parseCondition(%q) = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestParseStoredCondition(t *testing.T) {
+	useTestConditionKeys(t)
+
+	tests := []struct {
+		condition string
+		want      ConditionValues
+		wantErr   bool
+	}{
+		{condition: "is_dirty=true,is_overweight=false,is_broken=true", want: ConditionValues{"is_dirty": true, "is_overweight": false, "is_broken": true}},
+		// 保存後に追加された項目は問題なしとみなす
+		{condition: "is_dirty=true,is_overweight=true", want: ConditionValues{"is_dirty": true, "is_overweight": true, "is_broken": false}},
+		// 保存後に削除された項目は無視する
+		{condition: "is_dirty=true,is_overweight=false,is_broken=false,is_wet=true", want: ConditionValues{"is_dirty": true, "is_overweight": false, "is_broken": false}},
+		{condition: "", want: ConditionValues{"is_dirty": false, "is_overweight": false, "is_broken": false}},
+		{condition: "is_dirty=yes", wantErr: true},
+		{condition: "is_dirty", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStoredCondition(tt.condition)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStoredCondition(%q) error = %v, wantErr %v", tt.condition, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !equalConditionValues(got, tt.want) {
+			t.Errorf("parseStoredCondition(%q) = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestConditionValuesUnmarshalJSON(t *testing.T) {
+	useTestConditionKeys(t)
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: `"is_dirty=true,is_overweight=false,is_broken=false"`, want: "is_dirty=true,is_overweight=false,is_broken=false"},
+		{in: `"is_dirty=true"`, want: "is_dirty=true,is_overweight=false,is_broken=false"},
+		{in: `"is_dirty=true,is_wet=true"`, wantErr: true},
+		{in: `{"is_dirty":true,"is_overweight":false,"is_broken":true}`, want: "is_dirty=true,is_overweight=false,is_broken=true"},
+		// オブジェクト形式で省略された項目は問題なしとみなす
+		{in: `{"is_broken":true}`, want: "is_dirty=false,is_overweight=false,is_broken=true"},
+		{in: `{}`, wantErr: true},
+		{in: `{"is_wet":true}`, wantErr: true},
+		{in: `{"is_dirty":"true"}`, wantErr: true},
+		{in: `1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var v ConditionValues
+		err := json.Unmarshal([]byte(tt.in), &v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && v.String() != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, want %q", tt.in, v.String(), tt.want)
+		}
+	}
+}
+
+func TestConditionLevel(t *testing.T) {
+	useTestConditionKeys(t)
+
+	tests := []struct {
+		condition string
+		want      string
+	}{
+		{condition: "is_dirty=false,is_overweight=false,is_broken=false", want: conditionLevelInfo},
+		{condition: "is_dirty=true,is_overweight=false,is_broken=false", want: conditionLevelWarning},
+		{condition: "is_dirty=true,is_overweight=true,is_broken=false", want: conditionLevelWarning},
+		{condition: "is_dirty=true,is_overweight=true,is_broken=true", want: conditionLevelCritical},
+	}
+	for _, tt := range tests {
+		values, err := parseCondition(tt.condition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := values.Level(); got != tt.want {
+			t.Errorf("level of %q = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func equalConditionValues(a, b ConditionValues) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	deviceSecretBytes           = 32
+	conditionTimestampHeader    = "X-Isu-Timestamp"
+	conditionSignatureHeader    = "X-Isu-Signature"
+	conditionSignatureMaxSkew   = 5 * time.Minute
+	conditionSignatureCacheSize = 100000
+)
+
+// ISUがコンディション送信時の署名に使う鍵を生成
+func generateDeviceSecret() (string, error) {
+	b := make([]byte, deviceSecretBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// "<timestamp>.<body>" に対する HMAC-SHA256 を16進数で返す
+func signConditionRequest(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// コンディション送信リクエストの署名を検証し、署名時刻を返す
+// 再送かどうかは受け付けた時点で conditionSignatures に記録して判定する
+func verifyConditionSignature(secret string, timestampStr string, signature string, body []byte, now time.Time) (time.Time, error) {
+	if timestampStr == "" || signature == "" {
+		return time.Time{}, fmt.Errorf("missing signature")
+	}
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad format: %v", conditionTimestampHeader)
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-conditionSignatureMaxSkew)) || signedAt.After(now.Add(conditionSignatureMaxSkew)) {
+		return time.Time{}, fmt.Errorf("expired signature")
+	}
+
+	expected := signConditionRequest(secret, timestampStr, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return time.Time{}, fmt.Errorf("invalid signature")
+	}
+	return signedAt, nil
+}
+
+// 許容時間内に受け付けた署名を覚えておき、同じリクエストの再送を弾く
+// 古い順に並べておき、上限に達したら最も古いものから忘れる
+type signatureCache struct {
+	mu    sync.Mutex
+	size  int
+	seen  map[string]*list.Element
+	order *list.List
+}
+
+type signatureCacheEntry struct {
+	key      string
+	signedAt time.Time
+}
+
+var conditionSignatures = newSignatureCache(conditionSignatureCacheSize)
+
+func newSignatureCache(size int) *signatureCache {
+	return &signatureCache{
+		size:  size,
+		seen:  map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// 初めて見る署名であれば処理中として記録して true を返す
+// 受け付けられなかった場合は release で記録を取り消す
+func (sc *signatureCache) reserve(key string, signedAt time.Time, now time.Time) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	// 許容時間を過ぎた署名は時刻の検証で弾かれるので覚えておく必要はない
+	for e := sc.order.Front(); e != nil; e = sc.order.Front() {
+		entry := e.Value.(*signatureCacheEntry)
+		if !entry.signedAt.Before(now.Add(-conditionSignatureMaxSkew)) {
+			break
+		}
+		sc.remove(e)
+	}
+
+	if _, ok := sc.seen[key]; ok {
+		return false
+	}
+	for sc.order.Len() >= sc.size {
+		sc.remove(sc.order.Front())
+	}
+	sc.seen[key] = sc.order.PushBack(&signatureCacheEntry{key: key, signedAt: signedAt})
+	return true
+}
+
+// reserve した署名を忘れ、同じリクエストを再送できるようにする
+func (sc *signatureCache) release(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if e, ok := sc.seen[key]; ok {
+		sc.remove(e)
+	}
+}
+
+func (sc *signatureCache) remove(e *list.Element) {
+	delete(sc.seen, e.Value.(*signatureCacheEntry).key)
+	sc.order.Remove(e)
+}
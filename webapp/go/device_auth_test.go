@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyConditionSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	secret := "secret"
+	body := []byte(`[{"is_sitting":true,"condition":"is_dirty=false,is_overweight=false,is_broken=false","message":"ok","timestamp":1700000000}]`)
+	ts := func(d time.Duration) string {
+		return strconv.FormatInt(now.Add(d).Unix(), 10)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   bool
+	}{
+		{name: "valid", secret: secret, timestamp: ts(0), body: body},
+		{name: "valid within past skew", secret: secret, timestamp: ts(-conditionSignatureMaxSkew), body: body},
+		{name: "valid within future skew", secret: secret, timestamp: ts(conditionSignatureMaxSkew), body: body},
+		{name: "too old", secret: secret, timestamp: ts(-conditionSignatureMaxSkew - time.Second), body: body, wantErr: true},
+		{name: "too new", secret: secret, timestamp: ts(conditionSignatureMaxSkew + time.Second), body: body, wantErr: true},
+		{name: "missing timestamp", secret: secret, timestamp: "", signature: "x", body: body, wantErr: true},
+		{name: "bad timestamp", secret: secret, timestamp: "now", body: body, wantErr: true},
+		{name: "missing signature", secret: secret, timestamp: ts(0), signature: "-", body: body, wantErr: true},
+		{name: "other secret", secret: "other", timestamp: ts(0), body: body, wantErr: true},
+		{name: "tampered body", secret: secret, timestamp: ts(0), signature: signConditionRequest(secret, ts(0), []byte("[]")), body: body, wantErr: true},
+		{name: "tampered timestamp", secret: secret, timestamp: ts(time.Second), signature: signConditionRequest(secret, ts(0), body), body: body, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := tt.signature
+			switch signature {
+			case "":
+				signature = signConditionRequest(tt.secret, tt.timestamp, tt.body)
+			case "-":
+				signature = ""
+			}
+
+			signedAt, err := verifyConditionSignature(secret, tt.timestamp, signature, tt.body, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && strconv.FormatInt(signedAt.Unix(), 10) != tt.timestamp {
+				t.Errorf("signedAt = %v, want %v", signedAt.Unix(), tt.timestamp)
+			}
+		})
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	t.Run("replay", func(t *testing.T) {
+		sc := newSignatureCache(10)
+		if !sc.reserve("a", now, now) {
+			t.Fatal("first request was rejected")
+		}
+		if sc.reserve("a", now, now) {
+			t.Error("replayed request was accepted")
+		}
+		if !sc.reserve("b", now, now) {
+			t.Error("other signature was rejected")
+		}
+	})
+
+	t.Run("released request can be retried", func(t *testing.T) {
+		sc := newSignatureCache(10)
+		sc.reserve("a", now, now)
+		sc.release("a")
+		if !sc.reserve("a", now, now) {
+			t.Error("retry after release was rejected")
+		}
+		// 知らない署名を release しても何も起きない
+		sc.release("unknown")
+		if sc.reserve("a", now, now) {
+			t.Error("replayed request was accepted")
+		}
+	})
+
+	t.Run("forgets expired signatures", func(t *testing.T) {
+		sc := newSignatureCache(10)
+		sc.reserve("old", now.Add(-conditionSignatureMaxSkew), now)
+		sc.reserve("new", now, now)
+		later := now.Add(time.Second)
+		sc.reserve("c", later, later)
+		if _, ok := sc.seen["old"]; ok {
+			t.Error("expired signature is still cached")
+		}
+		if sc.reserve("new", now, later) {
+			t.Error("unexpired signature was forgotten")
+		}
+	})
+
+	t.Run("evicts oldest when full", func(t *testing.T) {
+		sc := newSignatureCache(3)
+		for i, key := range []string{"a", "b", "c", "d"} {
+			if !sc.reserve(key, now.Add(time.Duration(i)*time.Second), now) {
+				t.Fatalf("%v was rejected", key)
+			}
+		}
+		if got := sc.order.Len(); got != 3 {
+			t.Errorf("len = %v, want 3", got)
+		}
+		if _, ok := sc.seen["a"]; ok {
+			t.Error("oldest signature was not evicted")
+		}
+		for _, key := range []string{"b", "c", "d"} {
+			if sc.reserve(key, now, now) {
+				t.Errorf("%v was evicted", key)
+			}
+		}
+	})
+}
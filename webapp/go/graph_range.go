@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const graphMaxDataPoints = 1000
+
+// グラフの期間と各データ点の区間
+type graphRange struct {
+	StartAt time.Time
+	EndAt   time.Time
+	// 区間の開始時刻から次の区間の開始時刻を求める
+	next func(time.Time) time.Time
+}
+
+// datetime, range, interval, end_datetime の各クエリパラメータからグラフの期間を決める
+// range を省略した場合は datetime から24時間分を1時間ごとに区切る
+// 時刻の区切りはすべて loc のタイムゾーンで計算する
+func parseGraphRange(datetimeStr, rangeStr, intervalStr, endDatetimeStr string, loc *time.Location) (graphRange, error) {
+	if datetimeStr == "" {
+		return graphRange{}, fmt.Errorf("missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return graphRange{}, fmt.Errorf("bad format: datetime")
+	}
+	datetime := time.Unix(datetimeInt64, 0).In(loc)
+
+	if intervalStr == "" {
+		switch rangeStr {
+		case "week", "month":
+			intervalStr = "day"
+		default:
+			intervalStr = "hour"
+		}
+	}
+	next, byDay, err := parseGraphInterval(intervalStr)
+	if err != nil {
+		return graphRange{}, err
+	}
+
+	var startAt time.Time
+	if byDay || rangeStr == "week" || rangeStr == "month" {
+		startAt = truncateToDay(datetime)
+	} else {
+		startAt = truncateToHour(datetime)
+	}
+
+	var endAt time.Time
+	switch rangeStr {
+	case "", "day":
+		// 夏時間の切り替わる日は23時間または25時間になる
+		endAt = startAt.AddDate(0, 0, 1)
+	case "week":
+		endAt = startAt.AddDate(0, 0, 7)
+	case "month":
+		startAt = startAt.AddDate(0, 0, 1-startAt.Day())
+		endAt = startAt.AddDate(0, 1, 0)
+	case "custom":
+		if endDatetimeStr == "" {
+			return graphRange{}, fmt.Errorf("missing: end_datetime")
+		}
+		endInt64, err := strconv.ParseInt(endDatetimeStr, 10, 64)
+		if err != nil {
+			return graphRange{}, fmt.Errorf("bad format: end_datetime")
+		}
+		endAt = time.Unix(endInt64, 0).In(loc)
+		if !endAt.After(startAt) {
+			return graphRange{}, fmt.Errorf("bad format: end_datetime")
+		}
+	default:
+		return graphRange{}, fmt.Errorf("bad format: range")
+	}
+
+	dataPoints := 0
+	for t := startAt; t.Before(endAt); t = next(t) {
+		dataPoints++
+		if dataPoints > graphMaxDataPoints {
+			return graphRange{}, fmt.Errorf("too many data points: up to %d", graphMaxDataPoints)
+		}
+	}
+
+	return graphRange{StartAt: startAt, EndAt: endAt, next: next}, nil
+}
+
+// "hour", "day", "<N>h" 形式の区間を解釈する
+func parseGraphInterval(intervalStr string) (func(time.Time) time.Time, bool, error) {
+	switch intervalStr {
+	case "hour":
+		return func(t time.Time) time.Time { return t.Add(time.Hour) }, false, nil
+	case "day":
+		return func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }, true, nil
+	}
+
+	if !strings.HasSuffix(intervalStr, "h") {
+		return nil, false, fmt.Errorf("bad format: interval")
+	}
+	hours, err := strconv.Atoi(strings.TrimSuffix(intervalStr, "h"))
+	if err != nil || hours <= 0 {
+		return nil, false, fmt.Errorf("bad format: interval")
+	}
+	step := time.Duration(hours) * time.Hour
+	return func(t time.Time) time.Time { return t.Add(step) }, false, nil
+}
+
+// t のタイムゾーンでの正時に切り捨てる
+// UTC からのずれが1時間単位でないタイムゾーンでは Truncate(time.Hour) と結果が異なる
+func truncateToHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// t のタイムゾーンでのその日の0時に切り捨てる
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// すべての区切りが isu_graph_hourly の区切りと一致するかどうか
+func (r graphRange) alignedToHour() bool {
+	for t := r.StartAt; t.Before(r.EndAt); t = r.next(t) {
+		if t.Unix()%3600 != 0 {
+			return false
+		}
+	}
+	return r.EndAt.Unix()%3600 == 0
+}
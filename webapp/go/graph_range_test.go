@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %v is not available: %v", name, err)
+	}
+	return loc
+}
+
+func unixString(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func TestParseGraphRange(t *testing.T) {
+	newYork := loadTestLocation(t, "America/New_York")
+	tokyo := loadTestLocation(t, "Asia/Tokyo")
+	kolkata := loadTestLocation(t, "Asia/Kolkata")
+
+	tests := []struct {
+		name        string
+		datetime    time.Time
+		rangeStr    string
+		intervalStr string
+		endDatetime time.Time
+		loc         *time.Location
+		wantStart   time.Time
+		wantEnd     time.Time
+		wantPoints  int
+		wantAligned bool
+	}{
+		{
+			name:        "default day",
+			datetime:    time.Date(2023, 6, 1, 10, 30, 0, 0, tokyo),
+			loc:         tokyo,
+			wantStart:   time.Date(2023, 6, 1, 10, 0, 0, 0, tokyo),
+			wantEnd:     time.Date(2023, 6, 2, 10, 0, 0, 0, tokyo),
+			wantPoints:  24,
+			wantAligned: true,
+		},
+		{
+			name:        "day with DST starting",
+			datetime:    time.Date(2023, 3, 12, 0, 0, 0, 0, newYork),
+			rangeStr:    "day",
+			loc:         newYork,
+			wantStart:   time.Date(2023, 3, 12, 0, 0, 0, 0, newYork),
+			wantEnd:     time.Date(2023, 3, 13, 0, 0, 0, 0, newYork),
+			wantPoints:  23,
+			wantAligned: true,
+		},
+		{
+			name:        "day with DST ending",
+			datetime:    time.Date(2023, 11, 5, 0, 0, 0, 0, newYork),
+			rangeStr:    "day",
+			loc:         newYork,
+			wantStart:   time.Date(2023, 11, 5, 0, 0, 0, 0, newYork),
+			wantEnd:     time.Date(2023, 11, 6, 0, 0, 0, 0, newYork),
+			wantPoints:  25,
+			wantAligned: true,
+		},
+		{
+			name:        "daily week across DST",
+			datetime:    time.Date(2023, 3, 10, 15, 0, 0, 0, newYork),
+			rangeStr:    "week",
+			loc:         newYork,
+			wantStart:   time.Date(2023, 3, 10, 0, 0, 0, 0, newYork),
+			wantEnd:     time.Date(2023, 3, 17, 0, 0, 0, 0, newYork),
+			wantPoints:  7,
+			wantAligned: true,
+		},
+		{
+			name:        "month",
+			datetime:    time.Date(2024, 2, 15, 12, 0, 0, 0, tokyo),
+			rangeStr:    "month",
+			loc:         tokyo,
+			wantStart:   time.Date(2024, 2, 1, 0, 0, 0, 0, tokyo),
+			wantEnd:     time.Date(2024, 3, 1, 0, 0, 0, 0, tokyo),
+			wantPoints:  29,
+			wantAligned: true,
+		},
+		{
+			name:        "half hour offset",
+			datetime:    time.Date(2023, 6, 1, 10, 45, 0, 0, kolkata),
+			loc:         kolkata,
+			wantStart:   time.Date(2023, 6, 1, 10, 0, 0, 0, kolkata),
+			wantEnd:     time.Date(2023, 6, 2, 10, 0, 0, 0, kolkata),
+			wantPoints:  24,
+			wantAligned: false,
+		},
+		{
+			name:        "custom with hours interval",
+			datetime:    time.Date(2023, 6, 1, 10, 45, 0, 0, tokyo),
+			rangeStr:    "custom",
+			intervalStr: "6h",
+			endDatetime: time.Date(2023, 6, 3, 10, 0, 0, 0, tokyo),
+			loc:         tokyo,
+			wantStart:   time.Date(2023, 6, 1, 10, 0, 0, 0, tokyo),
+			wantEnd:     time.Date(2023, 6, 3, 10, 0, 0, 0, tokyo),
+			wantPoints:  8,
+			wantAligned: true,
+		},
+		{
+			name:        "custom ending between intervals",
+			datetime:    time.Date(2023, 6, 1, 10, 0, 0, 0, tokyo),
+			rangeStr:    "custom",
+			endDatetime: time.Date(2023, 6, 1, 12, 30, 0, 0, tokyo),
+			loc:         tokyo,
+			wantStart:   time.Date(2023, 6, 1, 10, 0, 0, 0, tokyo),
+			wantEnd:     time.Date(2023, 6, 1, 12, 30, 0, 0, tokyo),
+			wantPoints:  3,
+			wantAligned: false,
+		},
+	}
+	for _, tt := range tests {
+		endDatetimeStr := ""
+		if !tt.endDatetime.IsZero() {
+			endDatetimeStr = unixString(tt.endDatetime)
+		}
+		r, err := parseGraphRange(unixString(tt.datetime), tt.rangeStr, tt.intervalStr, endDatetimeStr, tt.loc)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !r.StartAt.Equal(tt.wantStart) || !r.EndAt.Equal(tt.wantEnd) {
+			t.Errorf("%v: range = [%v, %v), want [%v, %v)", tt.name, r.StartAt, r.EndAt, tt.wantStart, tt.wantEnd)
+		}
+		points := 0
+		for at := r.StartAt; at.Before(r.EndAt); at = r.next(at) {
+			points++
+		}
+		if points != tt.wantPoints {
+			t.Errorf("%v: data points = %v, want %v", tt.name, points, tt.wantPoints)
+		}
+		if got := r.alignedToHour(); got != tt.wantAligned {
+			t.Errorf("%v: alignedToHour = %v, want %v", tt.name, got, tt.wantAligned)
+		}
+	}
+}
+
+func TestParseGraphRangeError(t *testing.T) {
+	datetime := time.Unix(1700000000, 0).UTC()
+
+	tests := []struct {
+		name           string
+		datetimeStr    string
+		rangeStr       string
+		intervalStr    string
+		endDatetimeStr string
+		want           string
+	}{
+		{name: "missing datetime", want: "missing: datetime"},
+		{name: "bad datetime", datetimeStr: "yesterday", want: "bad format: datetime"},
+		{name: "bad range", datetimeStr: unixString(datetime), rangeStr: "year", want: "bad format: range"},
+		{name: "bad interval", datetimeStr: unixString(datetime), intervalStr: "minute", want: "bad format: interval"},
+		{name: "zero hours interval", datetimeStr: unixString(datetime), intervalStr: "0h", want: "bad format: interval"},
+		{name: "missing end_datetime", datetimeStr: unixString(datetime), rangeStr: "custom", want: "missing: end_datetime"},
+		{name: "end_datetime before datetime", datetimeStr: unixString(datetime), rangeStr: "custom", endDatetimeStr: unixString(datetime.Add(-time.Hour)), want: "bad format: end_datetime"},
+		{
+			name:           "too many data points",
+			datetimeStr:    unixString(datetime),
+			rangeStr:       "custom",
+			endDatetimeStr: unixString(datetime.Add((graphMaxDataPoints + 1) * time.Hour)),
+			want:           "too many data points: up to 1000",
+		},
+	}
+	for _, tt := range tests {
+		_, err := parseGraphRange(tt.datetimeStr, tt.rangeStr, tt.intervalStr, tt.endDatetimeStr, time.UTC)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%v: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const graphRollupInsertBatchSize = 500
+
+// グラフのデータ点を計算するための集計値
+// 1時間ごとの集計値を足し合わせることで任意の期間のデータ点を計算できる
+type graphAggregate struct {
+	ConditionCount      int
+	RawScore            int
+	SittingCount        int
+	ConditionsCount     map[string]int
+	ConditionTimestamps []int64
+}
+
+func newGraphAggregate() *graphAggregate {
+	return &graphAggregate{ConditionsCount: map[string]int{}, ConditionTimestamps: []int64{}}
+}
+
+func (a *graphAggregate) add(condition IsuCondition) error {
+	values, err := parseStoredCondition(condition.Condition)
+	if err != nil {
+		return fmt.Errorf("invalid condition format: %v", err)
+	}
+
+	for name, value := range values {
+		if value {
+			a.ConditionsCount[name]++
+		}
+	}
+
+	switch condition.ConditionLevel {
+	case conditionLevelCritical:
+		a.RawScore += scoreConditionLevelCritical
+	case conditionLevelWarning:
+		a.RawScore += scoreConditionLevelWarning
+	default:
+		a.RawScore += scoreConditionLevelInfo
+	}
+
+	if condition.IsSitting {
+		a.SittingCount++
+	}
+	a.ConditionCount++
+	a.ConditionTimestamps = append(a.ConditionTimestamps, condition.Timestamp.Unix())
+	return nil
+}
+
+func (a *graphAggregate) merge(other *graphAggregate) {
+	a.ConditionCount += other.ConditionCount
+	a.RawScore += other.RawScore
+	a.SittingCount += other.SittingCount
+	for name, count := range other.ConditionsCount {
+		a.ConditionsCount[name] += count
+	}
+	a.ConditionTimestamps = append(a.ConditionTimestamps, other.ConditionTimestamps...)
+}
+
+// 集計値からグラフの一つのデータ点を計算
+func (a *graphAggregate) dataPoint() GraphDataPoint {
+	percentage := ConditionsPercentage{
+		"sitting": a.SittingCount * 100 / a.ConditionCount,
+	}
+	for _, key := range conditionRegistry.Keys() {
+		percentage[key.Name] = a.ConditionsCount[key.Name] * 100 / a.ConditionCount
+	}
+
+	return GraphDataPoint{
+		Score:      a.RawScore * 100 / 3 / a.ConditionCount,
+		Percentage: percentage,
+	}
+}
+
+// isu_graph_hourly の行
+type IsuGraphHourly struct {
+	JIAIsuUUID           string    `db:"jia_isu_uuid"`
+	StartAt              time.Time `db:"start_at"`
+	ConditionCount       int       `db:"condition_count"`
+	ScoreSum             int       `db:"score_sum"`
+	SittingCount         int       `db:"sitting_count"`
+	IsBrokenCount        int       `db:"is_broken_count"`
+	IsDirtyCount         int       `db:"is_dirty_count"`
+	IsOverweightCount    int       `db:"is_overweight_count"`
+	ExtraConditionCounts string    `db:"extra_condition_counts"`
+	ConditionTimestamps  string    `db:"condition_timestamps"`
+	UpdatedAt            time.Time `db:"updated_at"`
+}
+
+// 型付きのカラムで持つ項目 (これ以外の項目は extra_condition_counts に入れる)
+var graphHourlyTypedConditions = map[string]struct{}{"is_broken": {}, "is_dirty": {}, "is_overweight": {}}
+
+func newIsuGraphHourly(jiaIsuUUID string, startAt time.Time, agg *graphAggregate) (IsuGraphHourly, error) {
+	extra := map[string]int{}
+	for name, count := range agg.ConditionsCount {
+		if _, ok := graphHourlyTypedConditions[name]; !ok {
+			extra[name] = count
+		}
+	}
+	extraJSON, err := json.Marshal(extra)
+	if err != nil {
+		return IsuGraphHourly{}, err
+	}
+	timestampsJSON, err := json.Marshal(agg.ConditionTimestamps)
+	if err != nil {
+		return IsuGraphHourly{}, err
+	}
+
+	return IsuGraphHourly{
+		JIAIsuUUID:           jiaIsuUUID,
+		StartAt:              startAt,
+		ConditionCount:       agg.ConditionCount,
+		ScoreSum:             agg.RawScore,
+		SittingCount:         agg.SittingCount,
+		IsBrokenCount:        agg.ConditionsCount["is_broken"],
+		IsDirtyCount:         agg.ConditionsCount["is_dirty"],
+		IsOverweightCount:    agg.ConditionsCount["is_overweight"],
+		ExtraConditionCounts: string(extraJSON),
+		ConditionTimestamps:  string(timestampsJSON),
+	}, nil
+}
+
+func (h IsuGraphHourly) aggregate() (*graphAggregate, error) {
+	agg := newGraphAggregate()
+	agg.ConditionCount = h.ConditionCount
+	agg.RawScore = h.ScoreSum
+	agg.SittingCount = h.SittingCount
+	agg.ConditionsCount["is_broken"] = h.IsBrokenCount
+	agg.ConditionsCount["is_dirty"] = h.IsDirtyCount
+	agg.ConditionsCount["is_overweight"] = h.IsOverweightCount
+
+	extra := map[string]int{}
+	err := json.Unmarshal([]byte(h.ExtraConditionCounts), &extra)
+	if err != nil {
+		return nil, err
+	}
+	for name, count := range extra {
+		agg.ConditionsCount[name] = count
+	}
+
+	err = json.Unmarshal([]byte(h.ConditionTimestamps), &agg.ConditionTimestamps)
+	if err != nil {
+		return nil, err
+	}
+	return agg, nil
+}
+
+// 指定した期間の1時間ごとの集計値を取得
+func getGraphHourly(tx *sqlx.Tx, jiaIsuUUID string, startAt time.Time, endAt time.Time) ([]IsuGraphHourly, error) {
+	rows := []IsuGraphHourly{}
+	err := tx.Select(&rows,
+		"SELECT * FROM `isu_graph_hourly` WHERE `jia_isu_uuid` = ?"+
+			"	AND ? <= `start_at` AND `start_at` < ?"+
+			"	ORDER BY `start_at` ASC",
+		jiaIsuUUID, startAt, endAt)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return rows, nil
+}
+
+// コンディションが追加された時間帯の集計値を生データから計算し直す
+func refreshGraphHourly(tx *sqlx.Tx, conditions []IsuCondition) error {
+	type hourKey struct {
+		JIAIsuUUID string
+		StartAt    int64
+	}
+	touched := map[hourKey]struct{}{}
+	for _, cond := range conditions {
+		touched[hourKey{cond.JIAIsuUUID, cond.Timestamp.Truncate(time.Hour).Unix()}] = struct{}{}
+	}
+
+	rollups := make([]IsuGraphHourly, 0, len(touched))
+	for key := range touched {
+		startAt := time.Unix(key.StartAt, 0)
+		conditionsInThisHour := []IsuCondition{}
+		err := tx.Select(&conditionsInThisHour,
+			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
+				"	AND ? <= `timestamp` AND `timestamp` < ?"+
+				"	ORDER BY `timestamp` ASC",
+			key.JIAIsuUUID, startAt, startAt.Add(time.Hour))
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if len(conditionsInThisHour) == 0 {
+			continue
+		}
+
+		agg := newGraphAggregate()
+		for _, cond := range conditionsInThisHour {
+			err = agg.add(cond)
+			if err != nil {
+				return err
+			}
+		}
+		rollup, err := newIsuGraphHourly(key.JIAIsuUUID, startAt, agg)
+		if err != nil {
+			return err
+		}
+		rollups = append(rollups, rollup)
+	}
+
+	return upsertGraphHourly(tx, rollups)
+}
+
+func upsertGraphHourly(tx *sqlx.Tx, rollups []IsuGraphHourly) error {
+	for len(rollups) > 0 {
+		n := len(rollups)
+		if n > graphRollupInsertBatchSize {
+			n = graphRollupInsertBatchSize
+		}
+
+		placeholders := make([]string, 0, n)
+		args := make([]interface{}, 0, n*10)
+		for _, r := range rollups[:n] {
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, r.JIAIsuUUID, r.StartAt, r.ConditionCount, r.ScoreSum, r.SittingCount,
+				r.IsBrokenCount, r.IsDirtyCount, r.IsOverweightCount, r.ExtraConditionCounts, r.ConditionTimestamps)
+		}
+		_, err := tx.Exec(
+			"REPLACE INTO `isu_graph_hourly`"+
+				"	(`jia_isu_uuid`, `start_at`, `condition_count`, `score_sum`, `sitting_count`,"+
+				"	`is_broken_count`, `is_dirty_count`, `is_overweight_count`, `extra_condition_counts`, `condition_timestamps`)"+
+				"	VALUES "+strings.Join(placeholders, ","),
+			args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+
+		rollups = rollups[n:]
+	}
+	return nil
+}
+
+// isu_condition から isu_graph_hourly を作り直す
+// jiaIsuUUID が空の場合はすべての ISU を対象にする
+func rebuildGraphHourly(db *sqlx.DB, jiaIsuUUID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	var rows *sqlx.Rows
+	if jiaIsuUUID == "" {
+		_, err = tx.Exec("DELETE FROM `isu_graph_hourly`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		rows, err = tx.Queryx("SELECT * FROM `isu_condition` ORDER BY `jia_isu_uuid` ASC, `timestamp` ASC")
+	} else {
+		_, err = tx.Exec("DELETE FROM `isu_graph_hourly` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		rows, err = tx.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` ASC", jiaIsuUUID)
+	}
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	rollups := []IsuGraphHourly{}
+	var agg *graphAggregate
+	var currentUUID string
+	var currentHour time.Time
+	flushHour := func() error {
+		if agg == nil {
+			return nil
+		}
+		rollup, err := newIsuGraphHourly(currentUUID, currentHour, agg)
+		if err != nil {
+			return err
+		}
+		rollups = append(rollups, rollup)
+		agg = nil
+		return nil
+	}
+
+	var condition IsuCondition
+	for rows.Next() {
+		err = rows.StructScan(&condition)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		hour := condition.Timestamp.Truncate(time.Hour)
+		if condition.JIAIsuUUID != currentUUID || !hour.Equal(currentHour) {
+			err = flushHour()
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			currentUUID = condition.JIAIsuUUID
+			currentHour = hour
+			agg = newGraphAggregate()
+		}
+		err = agg.add(condition)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	err = flushHour()
+	if err != nil {
+		return err
+	}
+
+	err = upsertGraphHourly(tx, rollups)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
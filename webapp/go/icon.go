@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultIconStoreDir  = "../icons"
+	iconMaxBytes         = 2 << 20
+	iconMigrateBatchSize = 100
+	// 展開後のメモリを抑えるため、縦横がこれを超えるアイコンは受け付けない
+	iconMaxDimension = 4096
+)
+
+// アップロードを受け付けるアイコンの形式
+var iconContentTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/webp": {},
+}
+
+var iconStore blobStore
+
+// isu_icon の行
+// アイコンの実体は iconStore に内容のハッシュをキーとして保存する
+type IsuIcon struct {
+	JIAIsuUUID  string    `db:"jia_isu_uuid"`
+	BlobKey     string    `db:"blob_key"`
+	ContentType string    `db:"content_type"`
+	Size        int       `db:"size"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+func initIconStore() error {
+	store, err := newLocalBlobStore(getEnv("ICON_STORE_DIR", defaultIconStoreDir))
+	if err != nil {
+		return fmt.Errorf("failed to open icon store: %v", err)
+	}
+	iconStore = store
+	return nil
+}
+
+// 中身から画像の形式を判定し、受け付けない形式であればエラーを返す
+func sniffIconContentType(image []byte) (string, error) {
+	contentType := http.DetectContentType(image)
+	if _, ok := iconContentTypes[contentType]; !ok {
+		return "", fmt.Errorf("unsupported image type: %v", contentType)
+	}
+	return contentType, nil
+}
+
+func iconBlobKey(image []byte) string {
+	sum := sha256.Sum256(image)
+	return hex.EncodeToString(sum[:])
+}
+
+// アイコンを iconStore に保存して isu_icon に記録し、保存したキーを返す
+// 同じ内容の画像は同じキーになり他のISUと共有している場合があるので、実体は removeUnreferencedIconBlobs でのみ消す
+func saveIsuIcon(tx *sqlx.Tx, jiaIsuUUID string, image []byte, contentType string) (string, error) {
+	key := iconBlobKey(image)
+	err := iconStore.Put(key, image)
+	if err != nil {
+		return "", fmt.Errorf("failed to store icon: %v", err)
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO `isu_icon` (`jia_isu_uuid`, `blob_key`, `content_type`, `size`) VALUES (?, ?, ?, ?)"+
+			"	ON DUPLICATE KEY UPDATE `blob_key` = VALUES(`blob_key`), `content_type` = VALUES(`content_type`), `size` = VALUES(`size`)",
+		jiaIsuUUID, key, contentType, len(image))
+	if err != nil {
+		return key, fmt.Errorf("db error: %v", err)
+	}
+	return key, nil
+}
+
+// ISUのアイコンとサムネイルの実体のキーを取得
+func getIsuIconBlobKeys(q sqlx.Queryer, jiaIsuUUID string) ([]string, error) {
+	keys := []string{}
+	err := sqlx.Select(q, &keys,
+		"SELECT `blob_key` FROM `isu_icon` WHERE `jia_isu_uuid` = ?"+
+			"	UNION SELECT `blob_key` FROM `isu_icon_variant` WHERE `jia_isu_uuid` = ?",
+		jiaIsuUUID, jiaIsuUUID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return keys, nil
+}
+
+// 保存したアイコンの実体のうち、どこからも参照されていないものを消す
+// トランザクションが確定しなかった場合や、ISUを削除した後に呼ぶ
+func removeUnreferencedIconBlobs(keys []string) error {
+	for _, key := range keys {
+		var count int
+		err := db.Get(&count,
+			"SELECT (SELECT COUNT(*) FROM `isu_icon` WHERE `blob_key` = ?)"+
+				"	+ (SELECT COUNT(*) FROM `isu_icon_variant` WHERE `blob_key` = ?)"+
+				"	+ (SELECT COUNT(*) FROM `isu_import_row` WHERE `icon_blob_key` = ?)",
+			key, key, key)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if count > 0 {
+			continue
+		}
+		err = iconStore.Delete(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete icon: %v", err)
+		}
+	}
+	return nil
+}
+
+// If-None-Match に etag が含まれているか
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isu.image に残っているアイコンを iconStore に移す
+func migrateIcons() error {
+	lastID := 0
+	for {
+		isuList := []Isu{}
+		err := db.Select(&isuList,
+			"SELECT * FROM `isu` WHERE `id` > ? AND `image` IS NOT NULL ORDER BY `id` ASC LIMIT ?",
+			lastID, iconMigrateBatchSize)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if len(isuList) == 0 {
+			return nil
+		}
+
+		for _, isu := range isuList {
+			err = migrateIcon(isu)
+			if err != nil {
+				return fmt.Errorf("%v: %v", isu.JIAIsuUUID, err)
+			}
+			lastID = isu.ID
+		}
+	}
+}
+
+func migrateIcon(isu Isu) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu_icon` WHERE `jia_isu_uuid` = ?", isu.JIAIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	// 既に移行済みのアイコンがあればそちらを正とする
+	if count == 0 {
+		// 以前は形式を確認せずに保存していたので、受け付けない形式でもそのまま移す
+		_, err = saveIsuIcon(tx, isu.JIAIsuUUID, isu.Image, http.DetectContentType(isu.Image))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE `isu` SET `image` = NULL, `updated_at` = `updated_at` WHERE `id` = ?", isu.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
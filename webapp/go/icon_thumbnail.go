@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const iconThumbnailJPEGQuality = 85
+
+// 生成するサムネイルの一辺の最大ピクセル数
+var iconThumbnailSizes = []int{64, 256}
+
+// isu_icon_variant の行
+type IsuIconVariant struct {
+	JIAIsuUUID  string `db:"jia_isu_uuid"`
+	Size        int    `db:"size"`
+	BlobKey     string `db:"blob_key"`
+	ContentType string `db:"content_type"`
+	ByteSize    int    `db:"byte_size"`
+}
+
+func isIconThumbnailSize(size int) bool {
+	for _, s := range iconThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// 作ったサムネイル
+type iconThumbnail struct {
+	Size        int
+	Image       []byte
+	ContentType string
+}
+
+// 画像を展開する
+// 縦横が iconMaxDimension を超える画像は展開しない
+// エラーはそのままクライアントに返せる
+func decodeIconImage(src []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", fmt.Errorf("bad format: icon")
+	}
+	if config.Width > iconMaxDimension || config.Height > iconMaxDimension {
+		return nil, "", fmt.Errorf("too large: icon dimensions")
+	}
+	// 途中で切れている画像はここで弾く
+	img, format, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", fmt.Errorf("bad format: icon")
+	}
+	return img, format, nil
+}
+
+// 画像として最後まで読めて、大きすぎないことを確認する
+func validateIconImage(src []byte) error {
+	_, _, err := decodeIconImage(src)
+	return err
+}
+
+// 画像を展開して iconThumbnailSizes の各サイズのサムネイルを作る
+// 時間がかかるので、トランザクションを始める前に呼ぶ
+func makeIconThumbnails(src []byte) ([]iconThumbnail, error) {
+	img, format, err := decodeIconImage(src)
+	if err != nil {
+		return nil, err
+	}
+	return makeIconThumbnailsFromImage(src, img, format)
+}
+
+// 展開済みの画像から iconThumbnailSizes の各サイズのサムネイルを作る
+func makeIconThumbnailsFromImage(src []byte, img image.Image, format string) ([]iconThumbnail, error) {
+	thumbnails := make([]iconThumbnail, 0, len(iconThumbnailSizes))
+	for _, size := range iconThumbnailSizes {
+		thumbnail, contentType, err := scaleIconImage(src, img, format, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make %dpx thumbnail: %v", size, err)
+		}
+		thumbnails = append(thumbnails, iconThumbnail{Size: size, Image: thumbnail, ContentType: contentType})
+	}
+	return thumbnails, nil
+}
+
+// 縦横比を保ったまま size x size に収まるよう縮小する
+// 元の画像が十分小さい場合はそのまま返す
+// 透過のある PNG, WebP は PNG に、それ以外は JPEG にする
+func scaleIconImage(src []byte, img image.Image, format string, size int) ([]byte, string, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() <= size && bounds.Dy() <= size {
+		return src, http.DetectContentType(src), nil
+	}
+
+	width, height := size, size
+	if bounds.Dx() > bounds.Dy() {
+		height = bounds.Dy() * size / bounds.Dx()
+	} else {
+		width = bounds.Dx() * size / bounds.Dy()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: iconThumbnailJPEGQuality})
+		if err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	err := png.Encode(&buf, dst)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// サムネイルを iconStore に保存し、isu_icon_variant に記録する
+// 保存したキーを返す
+func saveIsuIconVariants(tx *sqlx.Tx, jiaIsuUUID string, thumbnails []iconThumbnail) ([]string, error) {
+	keys := make([]string, 0, len(thumbnails))
+	for _, thumbnail := range thumbnails {
+		key := iconBlobKey(thumbnail.Image)
+		err := iconStore.Put(key, thumbnail.Image)
+		if err != nil {
+			return keys, fmt.Errorf("failed to store icon: %v", err)
+		}
+		keys = append(keys, key)
+
+		_, err = tx.Exec(
+			"INSERT INTO `isu_icon_variant` (`jia_isu_uuid`, `size`, `blob_key`, `content_type`, `byte_size`) VALUES (?, ?, ?, ?, ?)"+
+				"	ON DUPLICATE KEY UPDATE `blob_key` = VALUES(`blob_key`), `content_type` = VALUES(`content_type`), `byte_size` = VALUES(`byte_size`)",
+			jiaIsuUUID, thumbnail.Size, key, thumbnail.ContentType, len(thumbnail.Image))
+		if err != nil {
+			return keys, fmt.Errorf("db error: %v", err)
+		}
+	}
+	return keys, nil
+}
+
+// サムネイルがないISUのサムネイルを作る
+// isu_icon に移行済みのアイコンと isu.image に残っているアイコンのどちらも対象にする
+func backfillIconThumbnails() error {
+	lastID := 0
+	for {
+		isuList := []Isu{}
+		err := db.Select(&isuList,
+			"SELECT * FROM `isu` WHERE `id` > ?"+
+				"	AND (SELECT COUNT(*) FROM `isu_icon_variant` WHERE `isu_icon_variant`.`jia_isu_uuid` = `isu`.`jia_isu_uuid`) < ?"+
+				"	ORDER BY `id` ASC LIMIT ?",
+			lastID, len(iconThumbnailSizes), iconMigrateBatchSize)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if len(isuList) == 0 {
+			return nil
+		}
+
+		for _, isu := range isuList {
+			lastID = isu.ID
+			err = backfillIconThumbnail(isu)
+			if err != nil {
+				// 読めない形式のアイコンは元の画像を返せばよいので飛ばす
+				log.Warnf("skip thumbnails of %v: %v", isu.JIAIsuUUID, err)
+			}
+		}
+	}
+}
+
+func backfillIconThumbnail(isu Isu) error {
+	src := isu.Image
+	var icon IsuIcon
+	err := db.Get(&icon, "SELECT * FROM `isu_icon` WHERE `jia_isu_uuid` = ?", isu.JIAIsuUUID)
+	if err == nil {
+		src, err = iconStore.Get(icon.BlobKey)
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if src == nil {
+		return fmt.Errorf("no icon")
+	}
+
+	thumbnails, err := makeIconThumbnails(src)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = saveIsuIconVariants(tx, isu.JIAIsuUUID, thumbnails)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
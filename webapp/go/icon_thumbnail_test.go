@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeTestJPEG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeIconImage(t *testing.T) {
+	valid := encodeTestJPEG(t, 300, 200)
+
+	tests := []struct {
+		name    string
+		src     []byte
+		wantErr string
+	}{
+		{name: "valid", src: valid},
+		{name: "max dimension", src: encodeTestPNG(t, iconMaxDimension, 1)},
+		{name: "too wide", src: encodeTestPNG(t, iconMaxDimension+1, 1), wantErr: "too large: icon dimensions"},
+		{name: "too tall", src: encodeTestPNG(t, 1, iconMaxDimension+1), wantErr: "too large: icon dimensions"},
+		{name: "truncated", src: valid[:len(valid)/2], wantErr: "bad format: icon"},
+		{name: "not an image", src: []byte("GIF89a"), wantErr: "bad format: icon"},
+	}
+	for _, tt := range tests {
+		_, _, err := decodeIconImage(tt.src)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%v: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMakeIconThumbnails(t *testing.T) {
+	tests := []struct {
+		name            string
+		src             []byte
+		wantBounds      []image.Point
+		wantContentType []string
+	}{
+		{
+			name:            "landscape jpeg",
+			src:             encodeTestJPEG(t, 1000, 500),
+			wantBounds:      []image.Point{{64, 32}, {256, 128}},
+			wantContentType: []string{"image/jpeg", "image/jpeg"},
+		},
+		{
+			name:            "portrait png",
+			src:             encodeTestPNG(t, 100, 400),
+			wantBounds:      []image.Point{{16, 64}, {64, 256}},
+			wantContentType: []string{"image/png", "image/png"},
+		},
+		{
+			// 十分小さい画像はそのまま使う
+			name:            "small png",
+			src:             encodeTestPNG(t, 100, 50),
+			wantBounds:      []image.Point{{64, 32}, {100, 50}},
+			wantContentType: []string{"image/png", "image/png"},
+		},
+	}
+	for _, tt := range tests {
+		thumbnails, err := makeIconThumbnails(tt.src)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if len(thumbnails) != len(iconThumbnailSizes) {
+			t.Errorf("%v: %v thumbnails, want %v", tt.name, len(thumbnails), len(iconThumbnailSizes))
+			continue
+		}
+		for i, thumbnail := range thumbnails {
+			if thumbnail.Size != iconThumbnailSizes[i] {
+				t.Errorf("%v: size = %v, want %v", tt.name, thumbnail.Size, iconThumbnailSizes[i])
+			}
+			if thumbnail.ContentType != tt.wantContentType[i] {
+				t.Errorf("%v: %vpx content type = %v, want %v", tt.name, thumbnail.Size, thumbnail.ContentType, tt.wantContentType[i])
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(thumbnail.Image))
+			if err != nil {
+				t.Errorf("%v: %vpx thumbnail is not an image: %v", tt.name, thumbnail.Size, err)
+				continue
+			}
+			if got := (image.Point{config.Width, config.Height}); got != tt.wantBounds[i] {
+				t.Errorf("%v: %vpx thumbnail bounds = %v, want %v", tt.name, thumbnail.Size, got, tt.wantBounds[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	conditionQueueCapacity       = 50000
+	conditionFlushBatchSize      = 1000
+	conditionFlushInterval       = 100 * time.Millisecond
+	conditionFlushRetryInterval  = 500 * time.Millisecond
+	conditionQueueRetryAfterSecs = 1
+	// 評価待ちにできる書き込み済みバッチの数
+	// 溢れる場合は評価が追いつくまで書き込みを待つ
+	conditionEvaluationQueueCapacity = 100
+)
+
+var (
+	errConditionQueueFull   = errors.New("condition queue is full")
+	errConditionQueueClosed = errors.New("condition queue is closed")
+)
+
+// ISUから受け取ったコンディションをメモリ上のキューに溜めてまとめてINSERTする
+type conditionIngester struct {
+	mu       sync.Mutex
+	pending  []IsuCondition
+	keys     map[conditionKey]struct{}
+	capacity int
+	closed   bool
+
+	// flushMu は書き込み中のバッチと Discard が競合しないようにする
+	flushMu sync.Mutex
+
+	notify chan struct{}
+	done   chan struct{}
+
+	// 通常は insertIsuConditions と evaluateAlertRules
+	insert   func(conditions []IsuCondition) ([]IsuCondition, error)
+	evaluate func(conditions []IsuCondition, now time.Time) error
+
+	// 書き込んだバッチを、書き込みとは別の goroutine でアラートの評価に回す
+	evaluations   chan []IsuCondition
+	evaluatorDone chan struct{}
+
+	stats conditionIngestStats
+}
+
+// ISUごとにコンディションを一意に識別するキー
+type conditionKey struct {
+	JIAIsuUUID string
+	Timestamp  int64
+}
+
+func conditionKeyOf(cond IsuCondition) conditionKey {
+	return conditionKey{JIAIsuUUID: cond.JIAIsuUUID, Timestamp: cond.Timestamp.Unix()}
+}
+
+type conditionIngestStats struct {
+	mu                 sync.Mutex
+	EnqueuedTotal      int64
+	RejectedTotal      int64
+	FlushedTotal       int64
+	DuplicatedTotal    int64
+	FlushCount         int64
+	FlushErrorCount    int64
+	LastFlushLatencyMs float64
+	MaxFlushLatencyMs  float64
+	SumFlushLatencyMs  float64
+}
+
+type conditionIngestMetrics struct {
+	QueueDepth         int     `json:"queue_depth"`
+	QueueCapacity      int     `json:"queue_capacity"`
+	EvaluationDepth    int     `json:"evaluation_depth"`
+	EnqueuedTotal      int64   `json:"enqueued_total"`
+	RejectedTotal      int64   `json:"rejected_total"`
+	FlushedTotal       int64   `json:"flushed_total"`
+	DuplicatedTotal    int64   `json:"duplicated_total"`
+	FlushCount         int64   `json:"flush_count"`
+	FlushErrorCount    int64   `json:"flush_error_count"`
+	LastFlushLatencyMs float64 `json:"last_flush_latency_ms"`
+	MaxFlushLatencyMs  float64 `json:"max_flush_latency_ms"`
+	AvgFlushLatencyMs  float64 `json:"avg_flush_latency_ms"`
+}
+
+func newConditionIngester(capacity int,
+	insert func(conditions []IsuCondition) ([]IsuCondition, error),
+	evaluate func(conditions []IsuCondition, now time.Time) error,
+) *conditionIngester {
+	return &conditionIngester{
+		keys:     map[conditionKey]struct{}{},
+		capacity: capacity,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		insert:   insert,
+		evaluate: evaluate,
+
+		evaluations:   make(chan []IsuCondition, conditionEvaluationQueueCapacity),
+		evaluatorDone: make(chan struct{}),
+	}
+}
+
+// キューに積まれていないコンディションだけを積み、積んだ件数を返す
+// キューが溢れる場合は一件も積まずに errConditionQueueFull を返す
+func (ci *conditionIngester) Enqueue(conditions []IsuCondition) (int, error) {
+	ci.mu.Lock()
+	if ci.closed {
+		ci.mu.Unlock()
+		return 0, errConditionQueueClosed
+	}
+
+	fresh := make([]IsuCondition, 0, len(conditions))
+	freshKeys := map[conditionKey]struct{}{}
+	for _, cond := range conditions {
+		key := conditionKeyOf(cond)
+		if _, ok := ci.keys[key]; ok {
+			continue
+		}
+		if _, ok := freshKeys[key]; ok {
+			continue
+		}
+		freshKeys[key] = struct{}{}
+		fresh = append(fresh, cond)
+	}
+
+	if len(ci.pending)+len(fresh) > ci.capacity {
+		ci.mu.Unlock()
+		ci.stats.mu.Lock()
+		ci.stats.RejectedTotal += int64(len(fresh))
+		ci.stats.mu.Unlock()
+		return 0, errConditionQueueFull
+	}
+	ci.pending = append(ci.pending, fresh...)
+	for key := range freshKeys {
+		ci.keys[key] = struct{}{}
+	}
+	ci.mu.Unlock()
+
+	ci.stats.mu.Lock()
+	ci.stats.EnqueuedTotal += int64(len(fresh))
+	ci.stats.mu.Unlock()
+
+	if len(fresh) > 0 {
+		select {
+		case ci.notify <- struct{}{}:
+		default:
+		}
+	}
+	return len(fresh), nil
+}
+
+func (ci *conditionIngester) Run() {
+	defer close(ci.done)
+
+	go ci.runEvaluator()
+	// 書き込みを終えたら、評価待ちのバッチを評価し終えるまで待つ
+	defer func() {
+		close(ci.evaluations)
+		<-ci.evaluatorDone
+	}()
+
+	ticker := time.NewTicker(conditionFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ci.notify:
+		case <-ticker.C:
+		}
+
+		for {
+			ci.mu.Lock()
+			closed := ci.closed
+			ci.mu.Unlock()
+
+			flushed, err := ci.flushNext()
+			if err != nil {
+				log.Errorf("failed to flush isu_condition: %v", err)
+				if closed {
+					return
+				}
+				time.Sleep(conditionFlushRetryInterval)
+				continue
+			}
+			if flushed == 0 {
+				if closed {
+					return
+				}
+				break
+			}
+		}
+	}
+}
+
+// キューの先頭から最大 conditionFlushBatchSize 件を書き込む
+// 失敗した場合はキューに残したままにして次の機会に再試行する
+func (ci *conditionIngester) flushNext() (int, error) {
+	ci.flushMu.Lock()
+	defer ci.flushMu.Unlock()
+
+	ci.mu.Lock()
+	n := len(ci.pending)
+	if n > conditionFlushBatchSize {
+		n = conditionFlushBatchSize
+	}
+	batch := make([]IsuCondition, n)
+	copy(batch, ci.pending[:n])
+	ci.mu.Unlock()
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	inserted, err := ci.insert(batch)
+	latencyMs := float64(time.Since(start)) / float64(time.Millisecond)
+
+	ci.stats.mu.Lock()
+	if err != nil {
+		ci.stats.FlushErrorCount++
+	} else {
+		ci.stats.FlushedTotal += int64(len(inserted))
+		ci.stats.DuplicatedTotal += int64(n - len(inserted))
+		ci.stats.FlushCount++
+		ci.stats.LastFlushLatencyMs = latencyMs
+		ci.stats.SumFlushLatencyMs += latencyMs
+		if latencyMs > ci.stats.MaxFlushLatencyMs {
+			ci.stats.MaxFlushLatencyMs = latencyMs
+		}
+	}
+	ci.stats.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	ci.mu.Lock()
+	for _, cond := range batch {
+		delete(ci.keys, conditionKeyOf(cond))
+	}
+	ci.pending = ci.pending[n:]
+	if len(ci.pending) == 0 {
+		ci.pending = nil
+	}
+	ci.mu.Unlock()
+
+	// 既に書き込まれていたものは配信・評価済みなので、今回書き込んだものだけを回す
+	if len(inserted) > 0 {
+		conditionStreams.Publish(inserted)
+		ci.evaluations <- inserted
+	}
+	return n, nil
+}
+
+func (ci *conditionIngester) runEvaluator() {
+	defer close(ci.evaluatorDone)
+
+	for batch := range ci.evaluations {
+		err := ci.evaluate(batch, time.Now())
+		if err != nil {
+			log.Errorf("failed to evaluate alert rules: %v", err)
+		}
+	}
+}
+
+// 新規の受付を止め、キューに残っているコンディションを書き切るまで待つ
+func (ci *conditionIngester) Close(ctx context.Context) error {
+	ci.mu.Lock()
+	ci.closed = true
+	ci.mu.Unlock()
+
+	select {
+	case ci.notify <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-ci.done:
+	case <-ctx.Done():
+		return fmt.Errorf("%d conditions were not flushed: %w", ci.Depth(), ctx.Err())
+	}
+
+	if depth := ci.Depth(); depth > 0 {
+		return fmt.Errorf("%d conditions were not flushed", depth)
+	}
+	return nil
+}
+
+// キューに残っているコンディションを破棄する (POST /initialize 用)
+func (ci *conditionIngester) Discard() {
+	ci.flushMu.Lock()
+	defer ci.flushMu.Unlock()
+
+	ci.mu.Lock()
+	ci.pending = nil
+	ci.keys = map[conditionKey]struct{}{}
+	ci.mu.Unlock()
+}
+
+// fn の実行中は書き込みを止め、その後キューに残っている指定したISUのコンディションを破棄する (ISUの削除用)
+func (ci *conditionIngester) DropWhile(jiaIsuUUID string, fn func() error) error {
+	ci.flushMu.Lock()
+	defer ci.flushMu.Unlock()
+
+	err := fn()
+	if err != nil {
+		return err
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	pending := make([]IsuCondition, 0, len(ci.pending))
+	for _, cond := range ci.pending {
+		if cond.JIAIsuUUID == jiaIsuUUID {
+			delete(ci.keys, conditionKeyOf(cond))
+			continue
+		}
+		pending = append(pending, cond)
+	}
+	ci.pending = pending
+	return nil
+}
+
+func (ci *conditionIngester) Depth() int {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return len(ci.pending)
+}
+
+func (ci *conditionIngester) Metrics() conditionIngestMetrics {
+	ci.stats.mu.Lock()
+	defer ci.stats.mu.Unlock()
+
+	var avg float64
+	if ci.stats.FlushCount > 0 {
+		avg = ci.stats.SumFlushLatencyMs / float64(ci.stats.FlushCount)
+	}
+	return conditionIngestMetrics{
+		QueueDepth:         ci.Depth(),
+		QueueCapacity:      ci.capacity,
+		EvaluationDepth:    len(ci.evaluations),
+		EnqueuedTotal:      ci.stats.EnqueuedTotal,
+		RejectedTotal:      ci.stats.RejectedTotal,
+		FlushedTotal:       ci.stats.FlushedTotal,
+		DuplicatedTotal:    ci.stats.DuplicatedTotal,
+		FlushCount:         ci.stats.FlushCount,
+		FlushErrorCount:    ci.stats.FlushErrorCount,
+		LastFlushLatencyMs: ci.stats.LastFlushLatencyMs,
+		MaxFlushLatencyMs:  ci.stats.MaxFlushLatencyMs,
+		AvgFlushLatencyMs:  avg,
+	}
+}
+
+// コンディションをまとめて isu_condition に書き込み、実際に書き込んだものを id 付きで返す
+// 既に同じ時刻のコンディションがある場合は書き込まないので、再送されても重複しない
+func insertIsuConditions(conditions []IsuCondition) ([]IsuCondition, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	// キューに積んだ後に削除されたISUのコンディションは書き込まない
+	// 書き込み終わるまで削除されないよう、ISUの行に共有ロックを取る
+	conditions, err = filterExistingIsuConditions(tx, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if len(conditions) == 0 {
+		return []IsuCondition{}, nil
+	}
+
+	// 同じ時刻のコンディションを並行して書き込まれないよう、ロックを取りながら既存のものを調べる
+	where, args := conditionKeysWhere(conditions)
+	existingKeys := []IsuCondition{}
+	err = tx.Select(&existingKeys,
+		"SELECT `jia_isu_uuid`, `timestamp` FROM `isu_condition` WHERE "+where+" FOR UPDATE", args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	existing := make(map[conditionKey]struct{}, len(existingKeys))
+	for _, cond := range existingKeys {
+		existing[conditionKeyOf(cond)] = struct{}{}
+	}
+	fresh := make([]IsuCondition, 0, len(conditions))
+	for _, cond := range conditions {
+		if _, ok := existing[conditionKeyOf(cond)]; ok {
+			continue
+		}
+		fresh = append(fresh, cond)
+	}
+	if len(fresh) == 0 {
+		return []IsuCondition{}, nil
+	}
+
+	placeholders := make([]string, 0, len(fresh))
+	args = make([]interface{}, 0, len(fresh)*9)
+	for _, cond := range fresh {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, cond.JIAIsuUUID, cond.Timestamp, cond.IsSitting, cond.Condition,
+			cond.IsDirty, cond.IsOverweight, cond.IsBroken, cond.ConditionLevel, cond.Message)
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `isu_condition`"+
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `is_dirty`, `is_overweight`, `is_broken`, `condition_level`, `message`)"+
+			"	VALUES "+strings.Join(placeholders, ","),
+		args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	inserted := []IsuCondition{}
+	where, args = conditionKeysWhere(fresh)
+	err = tx.Select(&inserted, "SELECT * FROM `isu_condition` WHERE "+where+" ORDER BY `id` ASC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	err = refreshGraphHourly(tx, inserted)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return inserted, nil
+}
+
+// 登録されているISUのコンディションだけを返す
+func filterExistingIsuConditions(tx *sqlx.Tx, conditions []IsuCondition) ([]IsuCondition, error) {
+	jiaIsuUUIDs := []string{}
+	seen := map[string]bool{}
+	for _, cond := range conditions {
+		if !seen[cond.JIAIsuUUID] {
+			seen[cond.JIAIsuUUID] = true
+			jiaIsuUUIDs = append(jiaIsuUUIDs, cond.JIAIsuUUID)
+		}
+	}
+
+	query, args, err := sqlx.In(
+		"SELECT `jia_isu_uuid` FROM `isu` WHERE `jia_isu_uuid` IN (?) LOCK IN SHARE MODE", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	existing := []string{}
+	err = tx.Select(&existing, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if len(existing) == len(jiaIsuUUIDs) {
+		return conditions, nil
+	}
+
+	exists := make(map[string]bool, len(existing))
+	for _, jiaIsuUUID := range existing {
+		exists[jiaIsuUUID] = true
+	}
+	filtered := make([]IsuCondition, 0, len(conditions))
+	for _, cond := range conditions {
+		if exists[cond.JIAIsuUUID] {
+			filtered = append(filtered, cond)
+		}
+	}
+	return filtered, nil
+}
+
+// (jia_isu_uuid, timestamp) の組で isu_condition を絞り込む条件
+func conditionKeysWhere(conditions []IsuCondition) (string, []interface{}) {
+	placeholders := make([]string, 0, len(conditions))
+	args := make([]interface{}, 0, len(conditions)*2)
+	for _, cond := range conditions {
+		placeholders = append(placeholders, "(?, ?)")
+		args = append(args, cond.JIAIsuUUID, cond.Timestamp)
+	}
+	return "(`jia_isu_uuid`, `timestamp`) IN (" + strings.Join(placeholders, ",") + ")", args
+}
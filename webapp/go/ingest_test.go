@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 書き込みと評価を記録するだけの conditionIngester の依存先
+type fakeConditionStore struct {
+	mu        sync.Mutex
+	err       error
+	nextID    int
+	batches   []int
+	evaluated int
+}
+
+func (s *fakeConditionStore) insert(conditions []IsuCondition) ([]IsuCondition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	inserted := make([]IsuCondition, 0, len(conditions))
+	for _, cond := range conditions {
+		s.nextID++
+		cond.ID = s.nextID
+		inserted = append(inserted, cond)
+	}
+	s.batches = append(s.batches, len(conditions))
+	return inserted, nil
+}
+
+func (s *fakeConditionStore) evaluate(conditions []IsuCondition, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evaluated += len(conditions)
+	return nil
+}
+
+func (s *fakeConditionStore) flushed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, b := range s.batches {
+		n += b
+	}
+	return n
+}
+
+func testConditions(jiaIsuUUID string, n int) []IsuCondition {
+	conditions := make([]IsuCondition, 0, n)
+	for i := 0; i < n; i++ {
+		conditions = append(conditions, IsuCondition{JIAIsuUUID: jiaIsuUUID, Timestamp: time.Unix(1700000000+int64(i), 0)})
+	}
+	return conditions
+}
+
+func TestConditionIngesterEnqueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		queued   []IsuCondition
+		closed   bool
+		enqueue  []IsuCondition
+		want     int
+		wantErr  error
+		wantSize int
+	}{
+		{name: "fresh", capacity: 10, enqueue: testConditions("a", 3), want: 3, wantSize: 3},
+		{name: "duplicated in request", capacity: 10, enqueue: append(testConditions("a", 2), testConditions("a", 2)...), want: 2, wantSize: 2},
+		{name: "duplicated in queue", capacity: 10, queued: testConditions("a", 2), enqueue: testConditions("a", 3), want: 1, wantSize: 3},
+		{name: "other isu", capacity: 10, queued: testConditions("a", 2), enqueue: testConditions("b", 2), want: 2, wantSize: 4},
+		{name: "just fits", capacity: 5, queued: testConditions("a", 2), enqueue: testConditions("b", 3), want: 3, wantSize: 5},
+		// 一部だけ積むことはしない
+		{name: "full", capacity: 5, queued: testConditions("a", 3), enqueue: testConditions("b", 3), wantErr: errConditionQueueFull, wantSize: 3},
+		{name: "closed", capacity: 10, closed: true, enqueue: testConditions("a", 3), wantErr: errConditionQueueClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeConditionStore{}
+			ci := newConditionIngester(tt.capacity, store.insert, store.evaluate)
+			if _, err := ci.Enqueue(tt.queued); err != nil {
+				t.Fatal(err)
+			}
+			if tt.closed {
+				ci.closed = true
+			}
+
+			got, err := ci.Enqueue(tt.enqueue)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("accepted = %v, want %v", got, tt.want)
+			}
+			if size := ci.Depth(); size != tt.wantSize {
+				t.Errorf("depth = %v, want %v", size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestConditionIngesterFlush(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		// 積んだ通知を消して、定期的な書き込みだけで書き込まれることを確かめる
+		withoutNotify bool
+		wantBatches   []int
+	}{
+		{name: "single batch", n: 10, wantBatches: []int{10}},
+		{name: "split by batch size", n: 2*conditionFlushBatchSize + 500, wantBatches: []int{conditionFlushBatchSize, conditionFlushBatchSize, 500}},
+		{name: "on interval", n: 10, withoutNotify: true, wantBatches: []int{10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeConditionStore{}
+			ci := newConditionIngester(tt.n, store.insert, store.evaluate)
+			if _, err := ci.Enqueue(testConditions("a", tt.n)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.withoutNotify {
+				<-ci.notify
+			}
+
+			go ci.Run()
+			deadline := time.Now().Add(10 * conditionFlushInterval)
+			for store.flushed() < tt.n && time.Now().Before(deadline) {
+				time.Sleep(conditionFlushInterval / 10)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := ci.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			if len(store.batches) != len(tt.wantBatches) {
+				t.Fatalf("batches = %v, want %v", store.batches, tt.wantBatches)
+			}
+			for i := range tt.wantBatches {
+				if store.batches[i] != tt.wantBatches[i] {
+					t.Fatalf("batches = %v, want %v", store.batches, tt.wantBatches)
+				}
+			}
+			if store.evaluated != tt.n {
+				t.Errorf("evaluated = %v, want %v", store.evaluated, tt.n)
+			}
+		})
+	}
+}
+
+func TestConditionIngesterClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		n           int
+		insertErr   error
+		wantErr     string
+		wantFlushed int
+	}{
+		{name: "drain", n: 2*conditionFlushBatchSize + 500, wantFlushed: 2*conditionFlushBatchSize + 500},
+		{name: "empty", n: 0},
+		// 停止中は再試行せずに、書き込めなかった件数を返す
+		{name: "insert fails", n: 10, insertErr: errors.New("db error"), wantErr: "10 conditions were not flushed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeConditionStore{err: tt.insertErr}
+			ci := newConditionIngester(conditionQueueCapacity, store.insert, store.evaluate)
+			if _, err := ci.Enqueue(testConditions("a", tt.n)); err != nil {
+				t.Fatal(err)
+			}
+			// 通知を消しておき、Close の時点でキューに残っている状態にする
+			if tt.n > 0 {
+				<-ci.notify
+			}
+			go ci.Run()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := ci.Close(ctx)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got := store.flushed(); got != tt.wantFlushed {
+				t.Errorf("flushed = %v, want %v", got, tt.wantFlushed)
+			}
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			if store.evaluated != tt.wantFlushed {
+				t.Errorf("evaluated = %v, want %v", store.evaluated, tt.wantFlushed)
+			}
+			if _, err := ci.Enqueue(testConditions("b", 1)); !errors.Is(err, errConditionQueueClosed) {
+				t.Errorf("Enqueue after Close: error = %v, want %v", err, errConditionQueueClosed)
+			}
+		})
+	}
+}
+
+func TestConditionEnqueueError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "full", err: errConditionQueueFull, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "1"},
+		{name: "closed", err: errConditionQueueClosed, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "1"},
+		{name: "other", err: errors.New("unexpected"), wantStatus: http.StatusInternalServerError},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/condition/a", nil), rec)
+			if err := conditionEnqueueError(c, tt.err); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ISUを登録したユーザ (isu.jia_user_id)
+	isuRoleOwner = "owner"
+	// 名前やアイコンを変更できる
+	isuRoleEditor = "editor"
+	// 閲覧のみ
+	isuRoleViewer = "viewer"
+)
+
+var isuRoleRank = map[string]int{
+	isuRoleViewer: 1,
+	isuRoleEditor: 2,
+	isuRoleOwner:  3,
+}
+
+// isu_acl の行
+type IsuMember struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid" json:"-"`
+	JIAUserID  string    `db:"jia_user_id" json:"jia_user_id"`
+	Role       string    `db:"role" json:"role"`
+	CreatedAt  time.Time `db:"created_at" json:"-"`
+}
+
+type PutIsuMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// ISUの権限を求めるための列
+// 個別に共有された権限と、所属している組織での役割のうち強い方を使う
+type isuGrant struct {
+	ACLRole          *string `db:"acl_role"`
+	OrganizationID   *int64  `db:"organization_id"`
+	OrganizationRole *string `db:"organization_role"`
+}
+
+// isuGrant を得るための結合 (プレースホルダにはユーザIDを2つ渡す)
+var isuGrantJoin = isuGrantJoinFor("?")
+
+// jiaUserIDExpr のユーザについて isuGrant を得るための結合
+// ルールの所有者など、ユーザIDを列で指定する場合に使う
+func isuGrantJoinFor(jiaUserIDExpr string) string {
+	return " LEFT JOIN `isu_acl` ON `isu_acl`.`jia_isu_uuid` = `isu`.`jia_isu_uuid` AND `isu_acl`.`jia_user_id` = " + jiaUserIDExpr +
+		" LEFT JOIN `isu_organization` ON `isu_organization`.`jia_isu_uuid` = `isu`.`jia_isu_uuid`" +
+		" LEFT JOIN `organization_member` ON `organization_member`.`organization_id` = `isu_organization`.`organization_id`" +
+		" AND `organization_member`.`jia_user_id` = " + jiaUserIDExpr
+}
+
+const isuGrantColumns = "`isu_acl`.`role` AS `acl_role`, `isu_organization`.`organization_id`," +
+	" `organization_member`.`role` AS `organization_role`"
+
+// 権限がない場合は空文字列
+func (g isuGrant) role(ownerID string, jiaUserID string) string {
+	if ownerID == jiaUserID {
+		return isuRoleOwner
+	}
+	role := ""
+	if g.ACLRole != nil {
+		role = *g.ACLRole
+	}
+	if g.OrganizationRole != nil {
+		if orgRole := organizationIsuRole[*g.OrganizationRole]; isuRoleRank[orgRole] > isuRoleRank[role] {
+			role = orgRole
+		}
+	}
+	return role
+}
+
+// ユーザがISUに対して持っている権限
+type isuAccess struct {
+	isuGrant
+	Name    string `db:"name"`
+	OwnerID string `db:"jia_user_id"`
+	Role    string `db:"-"`
+}
+
+// ユーザがISUに対して required 以上の権限を持っているかを確認する
+// 権限が全くない場合はISUの存在を明かさないよう 404 を返す
+func authorizeIsu(q sqlx.Queryer, jiaUserID string, jiaIsuUUID string, required string) (isuAccess, int, error) {
+	var access isuAccess
+	err := sqlx.Get(q, &access,
+		"SELECT `isu`.`name`, `isu`.`jia_user_id`, "+isuGrantColumns+" FROM `isu`"+isuGrantJoin+
+			"	WHERE `isu`.`jia_isu_uuid` = ?",
+		jiaUserID, jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return isuAccess{}, http.StatusNotFound, fmt.Errorf("not found: isu")
+		}
+		return isuAccess{}, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+
+	access.Role = access.role(access.OwnerID, jiaUserID)
+	if access.Role == "" {
+		return isuAccess{}, http.StatusNotFound, fmt.Errorf("not found: isu")
+	}
+	if isuRoleRank[access.Role] < isuRoleRank[required] {
+		return isuAccess{}, http.StatusForbidden, fmt.Errorf("forbidden: %v role required", required)
+	}
+	return access, 0, nil
+}
+
+// GET /api/isu/:jia_isu_uuid/member
+// ISUを共有しているユーザの一覧を取得 (所有者を含む)
+func getIsuMembers(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	members := []IsuMember{}
+	err = db.Select(&members, "SELECT * FROM `isu_acl` WHERE `jia_isu_uuid` = ? ORDER BY `created_at` ASC", jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := append([]IsuMember{{JIAUserID: access.OwnerID, Role: isuRoleOwner}}, members...)
+	return c.JSON(http.StatusOK, res)
+}
+
+// PUT /api/isu/:jia_isu_uuid/member/:jia_user_id
+// ユーザをISUに招待する (既に招待済みであれば権限を変更する)
+func putIsuMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	memberUserID := c.Param("jia_user_id")
+
+	var req PutIsuMemberRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.Role != isuRoleEditor && req.Role != isuRoleViewer {
+		return c.String(http.StatusBadRequest, "bad format: role")
+	}
+
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleOwner)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+	if memberUserID == access.OwnerID {
+		return c.String(http.StatusBadRequest, "cannot change owner's role")
+	}
+
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?", memberUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "not found: user")
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `isu_acl` (`jia_isu_uuid`, `jia_user_id`, `role`) VALUES (?, ?, ?)"+
+			"	ON DUPLICATE KEY UPDATE `role` = VALUES(`role`)",
+		jiaIsuUUID, memberUserID, req.Role)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, IsuMember{JIAIsuUUID: jiaIsuUUID, JIAUserID: memberUserID, Role: req.Role})
+}
+
+// DELETE /api/isu/:jia_isu_uuid/member/:jia_user_id
+// ISUの共有を解除する (所有者か、共有されているユーザ自身が行える)
+func deleteIsuMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	memberUserID := c.Param("jia_user_id")
+
+	required := isuRoleOwner
+	if memberUserID == jiaUserID {
+		required = isuRoleViewer
+	}
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, required)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+	if memberUserID == access.OwnerID {
+		return c.String(http.StatusBadRequest, "cannot remove owner")
+	}
+
+	result, err := db.Exec("DELETE FROM `isu_acl` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?", jiaIsuUUID, memberUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: member")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
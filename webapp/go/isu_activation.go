@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon11-qualify/isucondition/jia"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// JIA でのアクティベートを待っている
+	isuActivationStatusPending = "pending"
+	// JIA でアクティベート済み
+	isuActivationStatusActive = "active"
+	// アクティベートをあきらめた (理由は failure_reason)
+	// POST /api/isu/:jia_isu_uuid/activation で pending に戻せる
+	isuActivationStatusFailed = "failed"
+
+	// アクティベート待ちを探す間隔
+	isuActivationPollInterval = time.Second
+	// 一度に並行してアクティベートする数
+	isuActivationBatchSize = 10
+	// 処理中のアクティベートを他のプロセスが拾わないようにしておく期間
+	isuActivationLease = time.Minute
+	// 1回のアクティベートのタイムアウト (クライアント内の再試行を含む)
+	isuActivationAttemptTimeout = 30 * time.Second
+	// この回数失敗したらあきらめる
+	isuActivationMaxAttempts = 8
+	// 次に試すまでの待ち時間 (1回ごとに倍にする)
+	isuActivationRetryBackoff    = 2 * time.Second
+	isuActivationMaxRetryBackoff = 5 * time.Minute
+	// isu_activation.failure_reason の長さ
+	isuActivationFailureReasonMaxLength = 255
+)
+
+// isu_activation の行
+// 行のないISUはアクティベート済みとみなす
+type IsuActivation struct {
+	JIAIsuUUID    string    `db:"jia_isu_uuid"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	FailureReason *string   `db:"failure_reason"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+var jiaClient = jia.NewClient(jia.DefaultConfig)
+
+// 登録直後のISUをすぐに処理するためにワーカーを起こす
+var isuActivationWake = make(chan struct{}, 1)
+
+func notifyIsuActivation() {
+	select {
+	case isuActivationWake <- struct{}{}:
+	default:
+	}
+}
+
+// JIA の呼び出しに失敗したときのレスポンス
+func jiaErrorResponse(c echo.Context, err error) error {
+	var statusErr *jia.StatusError
+	if errors.As(err, &statusErr) {
+		c.Logger().Errorf("JIAService returned error: status code %v, message: %v", statusErr.StatusCode, statusErr.Body)
+		return c.String(statusErr.StatusCode, "JIAService returned error")
+	}
+	if errors.Is(err, jia.ErrCircuitOpen) {
+		return c.String(http.StatusServiceUnavailable, "JIAService is unavailable")
+	}
+
+	c.Logger().Errorf("failed to request to JIAService: %v", err)
+	return c.NoContent(http.StatusInternalServerError)
+}
+
+// 指定したISUのアクティベートの状態を取得
+func getIsuActivations(q sqlx.Queryer, isuList []Isu) (map[string]IsuActivation, error) {
+	res := make(map[string]IsuActivation, len(isuList))
+	if len(isuList) == 0 {
+		return res, nil
+	}
+
+	jiaIsuUUIDs := make([]string, 0, len(isuList))
+	for _, isu := range isuList {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM `isu_activation` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	activations := []IsuActivation{}
+	err = sqlx.Select(q, &activations, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for _, a := range activations {
+		res[a.JIAIsuUUID] = a
+	}
+
+	for _, isu := range isuList {
+		if _, ok := res[isu.JIAIsuUUID]; !ok {
+			res[isu.JIAIsuUUID] = IsuActivation{JIAIsuUUID: isu.JIAIsuUUID, Status: isuActivationStatusActive}
+		}
+	}
+	return res, nil
+}
+
+// POST /api/isu/:jia_isu_uuid/activation
+// アクティベートをあきらめたISUを、もう一度アクティベート待ちに戻す
+func postIsuActivation(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	access, errStatusCode, err := authorizeIsu(tx, jiaUserID, jiaIsuUUID, isuRoleOwner)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	var isu Isu
+	err = tx.Get(&isu, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ? FOR UPDATE", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	isu.Role = access.Role
+	isu.OrganizationID = access.OrganizationID
+
+	// 失敗の回数も数え直す
+	now := time.Now()
+	result, err := tx.Exec(
+		"UPDATE `isu_activation` SET `status` = ?, `attempts` = 0, `failure_reason` = NULL, `next_attempt_at` = ?, `updated_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		isuActivationStatusPending, now, now, jiaIsuUUID, isuActivationStatusFailed)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusConflict, "activation is not failed")
+	}
+
+	err = fillIsuStatus(tx, &isu)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	notifyIsuActivation()
+
+	return c.JSON(http.StatusAccepted, isu)
+}
+
+// 期限の来たアクティベート待ちを処理し続ける
+// 状態はすべて isu_activation にあるので、プロセスが再起動しても続きから処理する
+func runIsuActivationWorker(ctx context.Context) {
+	ticker := time.NewTicker(isuActivationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-isuActivationWake:
+		}
+
+		err := processIsuActivations(ctx, time.Now())
+		if err != nil {
+			log.Errorf("failed to process isu activations: %v", err)
+		}
+	}
+}
+
+func processIsuActivations(ctx context.Context, now time.Time) error {
+	activations := []IsuActivation{}
+	err := db.Select(&activations,
+		"SELECT * FROM `isu_activation` WHERE `status` = ? AND `next_attempt_at` <= ? ORDER BY `next_attempt_at` LIMIT ?",
+		isuActivationStatusPending, now, isuActivationBatchSize)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if len(activations) == 0 {
+		return nil
+	}
+
+	jiaServiceURL := getJIAServiceURL(db)
+	var wg sync.WaitGroup
+	for _, a := range activations {
+		// 他のプロセスが処理中のものは飛ばす
+		result, err := db.Exec(
+			"UPDATE `isu_activation` SET `next_attempt_at` = ? WHERE `jia_isu_uuid` = ? AND `status` = ? AND `next_attempt_at` <= ?",
+			now.Add(isuActivationLease), a.JIAIsuUUID, isuActivationStatusPending, now)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if affected == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(a IsuActivation) {
+			defer wg.Done()
+			err := activateIsu(ctx, jiaServiceURL, a)
+			if err != nil {
+				log.Errorf("failed to activate isu %v: %v", a.JIAIsuUUID, err)
+			}
+		}(a)
+	}
+	wg.Wait()
+	return nil
+}
+
+func activateIsu(ctx context.Context, jiaServiceURL string, a IsuActivation) error {
+	var deviceSecret string
+	err := db.Get(&deviceSecret, "SELECT `secret` FROM `isu_device_credential` WHERE `jia_isu_uuid` = ?", a.JIAIsuUUID)
+	if err != nil {
+		// 処理を始める前に削除された
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, isuActivationAttemptTimeout)
+	defer cancel()
+	res, err := jiaClient.Activate(attemptCtx, jiaServiceURL, jia.ActivateRequest{
+		TargetBaseURL: postIsuConditionTargetBaseURL,
+		IsuUUID:       a.JIAIsuUUID,
+		DeviceSecret:  deviceSecret,
+	})
+	if err != nil {
+		// 停止するときは失敗に数えず、期限が切れてから再び処理する
+		if ctx.Err() != nil {
+			return nil
+		}
+		return failIsuActivation(jiaServiceURL, a, err)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE `isu_activation` SET `status` = ?, `attempts` = `attempts` + 1, `failure_reason` = NULL, `updated_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		isuActivationStatusActive, time.Now(), a.JIAIsuUUID, isuActivationStatusPending)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	// JIA の応答を待っている間に削除された
+	if affected == 0 {
+		return deactivateIsuInBackground(jiaServiceURL, a.JIAIsuUUID)
+	}
+
+	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE `jia_isu_uuid` = ?", res.Character, a.JIAIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// JIA に断られた場合と、失敗が上限に達した場合はあきらめる
+// それ以外は間隔を空けて再び試す
+func failIsuActivation(jiaServiceURL string, a IsuActivation, activateErr error) error {
+	attempts := a.Attempts + 1
+	reason := activateErr.Error()
+	if len(reason) > isuActivationFailureReasonMaxLength {
+		reason = reason[:isuActivationFailureReasonMaxLength]
+	}
+
+	var statusErr *jia.StatusError
+	rejected := errors.As(activateErr, &statusErr) && statusErr.StatusCode < http.StatusInternalServerError
+	if rejected || attempts >= isuActivationMaxAttempts {
+		_, err := db.Exec(
+			"UPDATE `isu_activation` SET `status` = ?, `attempts` = ?, `failure_reason` = ?, `updated_at` = ?"+
+				"	WHERE `jia_isu_uuid` = ? AND `status` = ?",
+			isuActivationStatusFailed, attempts, reason, time.Now(), a.JIAIsuUUID, isuActivationStatusPending)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		// JIA にはアクティベートが届いている可能性があるので停止させておく
+		return deactivateIsuInBackground(jiaServiceURL, a.JIAIsuUUID)
+	}
+
+	backoff := isuActivationRetryBackoff << uint(attempts-1)
+	if backoff > isuActivationMaxRetryBackoff {
+		backoff = isuActivationMaxRetryBackoff
+	}
+	now := time.Now()
+	_, err := db.Exec(
+		"UPDATE `isu_activation` SET `attempts` = ?, `failure_reason` = ?, `next_attempt_at` = ?, `updated_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		attempts, reason, now.Add(backoff), now, a.JIAIsuUUID, isuActivationStatusPending)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func deactivateIsuInBackground(jiaServiceURL string, jiaIsuUUID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), isuActivationAttemptTimeout)
+	defer cancel()
+	return jiaClient.Deactivate(ctx, jiaServiceURL, jiaIsuUUID)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// コンディションを isu_condition_archive に移してから削除する
+	isuDeleteModeArchive = "archive"
+	// コンディションを残さずに削除する
+	isuDeleteModePurge = "purge"
+)
+
+// DELETE /api/isu/:jia_isu_uuid
+// ISUをJIAから切り離して削除
+func deleteIsu(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	mode := c.QueryParam("mode")
+	switch mode {
+	case "":
+		mode = isuDeleteModeArchive
+	case isuDeleteModeArchive, isuDeleteModePurge:
+	default:
+		return c.String(http.StatusBadRequest, "bad format: mode")
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleOwner)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	// JIA の呼び出し中は行ロックを持たない
+	// 停止してから削除に失敗しても、再度削除すれば JIA 側は停止済みとして扱われる
+	err = jiaClient.Deactivate(c.Request().Context(), getJIAServiceURL(db), jiaIsuUUID)
+	if err != nil {
+		return jiaErrorResponse(c, err)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var isu Isu
+	err = tx.Get(&isu, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ? FOR UPDATE", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// アイコンの実体は確定した後に消すので、先にキーを控えておく
+	iconBlobKeys, err := getIsuIconBlobKeys(tx, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 削除中にキューのコンディションが書き込まれないようにする
+	// 削除した後にキューへ積まれたものは、書き込み時にISUがないことを確認して捨てられる
+	err = conditionIngest.DropWhile(jiaIsuUUID, func() error {
+		if mode == isuDeleteModeArchive {
+			_, err := tx.Exec(
+				"INSERT INTO `isu_condition_archive`"+
+					"	(`id`, `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `is_dirty`, `is_overweight`, `is_broken`,"+
+					"	`condition_level`, `message`, `created_at`)"+
+					"	SELECT `id`, `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `is_dirty`, `is_overweight`, `is_broken`,"+
+					"	`condition_level`, `message`, `created_at` FROM `isu_condition` WHERE `jia_isu_uuid` = ?",
+				jiaIsuUUID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := deleteIsuRows(tx, jiaIsuUUID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	isuLastSeen.Forget(jiaIsuUUID)
+	conditionStreams.CloseIsu(jiaIsuUUID)
+
+	err = removeUnreferencedIconBlobs(iconBlobKeys)
+	if err != nil {
+		c.Logger().Errorf("failed to clean up icons: %v", err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ISUに関する行をすべて削除する
+func deleteIsuRows(tx *sqlx.Tx, jiaIsuUUID string) error {
+	for _, query := range []string{
+		"DELETE FROM `isu_condition` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_graph_hourly` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_device_credential` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_icon` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_icon_variant` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_status` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_status_history` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `alert_state` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `webhook_delivery` WHERE `jia_isu_uuid` = ?",
+		"DELETE `alert_state` FROM `alert_state` JOIN `alert_rule` ON `alert_rule`.`id` = `alert_state`.`alert_rule_id`" +
+			"	WHERE `alert_rule`.`jia_isu_uuid` = ?",
+		"DELETE `webhook_delivery` FROM `webhook_delivery` JOIN `alert_rule` ON `alert_rule`.`id` = `webhook_delivery`.`alert_rule_id`" +
+			"	WHERE `alert_rule`.`jia_isu_uuid` = ?",
+		"DELETE FROM `alert_rule` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_acl` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_organization` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `api_token` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_activation` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu` WHERE `jia_isu_uuid` = ?",
+	} {
+		_, err := tx.Exec(query, jiaIsuUUID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// 一度に登録できるISUの数
+	isuImportMaxRows       = 1000
+	isuImportCSVMaxBytes   = 1 << 20
+	isuImportIconsMaxBytes = 256 << 20
+	// 登録 (DBへの書き込み) の並行数
+	// JIA へのアクティベートは登録後に isu_activation のワーカが isuActivationBatchSize 件ずつ行う
+	isuImportConcurrency   = 4
+	isuImportNameMaxLength = 255
+	isuImportUUIDMaxLength = 36
+
+	// 未処理の行が残っている
+	isuImportStatusRunning = "running"
+	// すべての行を処理した
+	isuImportStatusCompleted = "completed"
+
+	// 登録した (アクティベートの結果は activation_status)
+	isuImportResultCreated = "created"
+	// 既に登録されていた
+	isuImportResultDuplicate = "duplicate"
+	// 行かアイコンの形式が正しくない
+	isuImportResultInvalid = "invalid"
+	// 登録したが JIA でのアクティベートに失敗した (レポートでのみ使う)
+	isuImportResultJIAError = "jia_error"
+)
+
+// isu_import の行
+type IsuImport struct {
+	ID             int64     `db:"id"`
+	JIAUserID      string    `db:"jia_user_id"`
+	OrganizationID *int64    `db:"organization_id"`
+	Status         string    `db:"status"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+// isu_import_row の行
+// result が NULL の行は未処理
+type IsuImportRow struct {
+	ImportID    int64      `db:"import_id"`
+	RowIndex    int        `db:"row_index"`
+	JIAIsuUUID  string     `db:"jia_isu_uuid"`
+	IsuName     string     `db:"isu_name"`
+	IconBlobKey *string    `db:"icon_blob_key"`
+	Result      *string    `db:"result"`
+	Message     *string    `db:"message"`
+	ProcessedAt *time.Time `db:"processed_at"`
+}
+
+type IsuImportRowResponse struct {
+	Row              int     `json:"row"`
+	JIAIsuUUID       string  `json:"jia_isu_uuid"`
+	IsuName          string  `json:"isu_name"`
+	Result           *string `json:"result"`
+	Message          *string `json:"message"`
+	ActivationStatus *string `json:"activation_status"`
+}
+
+// status は行の登録が終わったかどうか
+// アクティベートは非同期に行うので、activation_pending が 0 になるまで status_url で結果を確認する
+type IsuImportResponse struct {
+	ID                int64                  `json:"id"`
+	Status            string                 `json:"status"`
+	OrganizationID    *int64                 `json:"organization_id"`
+	CreatedAt         int64                  `json:"created_at"`
+	ActivationPending int                    `json:"activation_pending"`
+	StatusURL         string                 `json:"status_url"`
+	Rows              []IsuImportRowResponse `json:"rows"`
+}
+
+// POST /api/isu/bulk
+// CSV (jia_isu_uuid,isu_name) からISUをまとめて登録
+// icons には <jia_isu_uuid>.<拡張子> の画像をまとめた zip を指定できる
+// 途中で中断した場合は import_id を指定して呼び直すと、未処理の行から続ける
+// 登録までを行って 202 を返し、アクティベートの結果は Location (GET /api/isu/bulk/:import_id) で確認する
+func postIsuBulk(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var imp IsuImport
+	importIDStr := c.FormValue("import_id")
+	resuming := importIDStr != ""
+	if resuming {
+		importID, err := strconv.ParseInt(importIDStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: import_id")
+		}
+		err = db.Get(&imp, "SELECT * FROM `isu_import` WHERE `id` = ? AND `jia_user_id` = ?", importID, jiaUserID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.String(http.StatusNotFound, "not found: import")
+			}
+
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else {
+		imp.JIAUserID = jiaUserID
+		imp.Status = isuImportStatusRunning
+		imp.OrganizationID, err = parseOrganizationID(c.FormValue("organization_id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	// 組織のISUとして登録できるのは編集者以上 (再開するまでに権限が変わっている場合もある)
+	if imp.OrganizationID != nil {
+		_, errStatusCode, err = authorizeOrganization(db, jiaUserID, *imp.OrganizationID, organizationRoleEditor)
+		if err != nil {
+			if errStatusCode == http.StatusInternalServerError {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.String(errStatusCode, err.Error())
+		}
+	}
+
+	if !resuming {
+		rows, errStatusCode, err := readIsuImportForm(c)
+		if err != nil {
+			if errStatusCode != http.StatusInternalServerError {
+				return c.String(errStatusCode, err.Error())
+			}
+
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		err = createIsuImport(&imp, rows)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = runIsuImport(c.Request().Context(), &imp)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	notifyIsuActivation()
+
+	res, err := getIsuImportReport(imp)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, res.StatusURL)
+	return c.JSON(http.StatusAccepted, res)
+}
+
+// GET /api/isu/bulk/:import_id
+// 一括登録の結果を取得
+// アクティベートは非同期に行うので、JIA でのエラーはこちらで確認する
+func getIsuBulk(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	importID, err := strconv.ParseInt(c.Param("import_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: import_id")
+	}
+
+	var imp IsuImport
+	err = db.Get(&imp, "SELECT * FROM `isu_import` WHERE `id` = ? AND `jia_user_id` = ?", importID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: import")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res, err := getIsuImportReport(imp)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// フォームの CSV とアイコンの zip を読み込む
+// 形式が正しくない行は result を invalid にして返す
+func readIsuImportForm(c echo.Context) ([]IsuImportRow, int, error) {
+	fh, err := c.FormFile("csv")
+	if err != nil {
+		if errors.Is(err, http.ErrMissingFile) {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing: csv")
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("bad format: csv")
+	}
+	if fh.Size > isuImportCSVMaxBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("too large: csv")
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer file.Close()
+
+	rows, err := parseIsuImportCSV(file)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	fh, err = c.FormFile("icons")
+	if err != nil {
+		if errors.Is(err, http.ErrMissingFile) {
+			return rows, 0, nil
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("bad format: icons")
+	}
+	if fh.Size > isuImportIconsMaxBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("too large: icons")
+	}
+	icons, err := fh.Open()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer icons.Close()
+
+	zr, err := zip.NewReader(icons, fh.Size)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("bad format: icons")
+	}
+	err = storeIsuImportIcons(zr, rows)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return rows, 0, nil
+}
+
+// 1行目が見出し (jia_isu_uuid,isu_name) であれば読み飛ばす
+func parseIsuImportCSV(r io.Reader) ([]IsuImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	rows := []IsuImportRow{}
+	for i := 0; ; i++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad format: csv")
+		}
+		if i == 0 && len(record) == 2 && record[0] == "jia_isu_uuid" && record[1] == "isu_name" {
+			continue
+		}
+		if len(rows) >= isuImportMaxRows {
+			return nil, fmt.Errorf("too many rows: csv")
+		}
+
+		row := IsuImportRow{RowIndex: len(rows) + 1, JIAIsuUUID: strings.TrimSpace(record[0])}
+		if len(record) != 2 {
+			row.invalid("bad format: row")
+		} else {
+			row.IsuName = record[1]
+			if row.JIAIsuUUID == "" || utf8.RuneCountInString(row.JIAIsuUUID) > isuImportUUIDMaxLength {
+				row.invalid("bad format: jia_isu_uuid")
+			} else if row.IsuName == "" || utf8.RuneCountInString(row.IsuName) > isuImportNameMaxLength {
+				row.invalid("bad format: isu_name")
+			}
+		}
+		// 形式が正しくない行も、結果を返すために長さを揃えて記録する
+		row.JIAIsuUUID = truncateString(row.JIAIsuUUID, isuImportUUIDMaxLength)
+		row.IsuName = truncateString(row.IsuName, isuImportNameMaxLength)
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("missing: rows")
+	}
+	return rows, nil
+}
+
+func (row *IsuImportRow) invalid(message string) {
+	result := isuImportResultInvalid
+	row.Result = &result
+	row.Message = &message
+}
+
+// zip の中の画像を iconStore に保存し、ファイル名の jia_isu_uuid が一致する行に紐付ける
+// 受け付けない画像が指定された行は invalid にする
+func storeIsuImportIcons(zr *zip.Reader, rows []IsuImportRow) error {
+	rowsByUUID := map[string][]*IsuImportRow{}
+	for i := range rows {
+		if rows[i].Result == nil {
+			rowsByUUID[rows[i].JIAIsuUUID] = append(rowsByUUID[rows[i].JIAIsuUUID], &rows[i])
+		}
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		base := path.Base(f.Name)
+		targets, ok := rowsByUUID[strings.TrimSuffix(base, path.Ext(base))]
+		if !ok {
+			continue
+		}
+
+		image, message, err := readIsuImportIcon(f)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			for _, row := range targets {
+				row.invalid(message)
+			}
+			continue
+		}
+
+		key := iconBlobKey(image)
+		err = iconStore.Put(key, image)
+		if err != nil {
+			return fmt.Errorf("failed to store icon: %v", err)
+		}
+		for _, row := range targets {
+			row.IconBlobKey = &key
+		}
+	}
+	return nil
+}
+
+// 画像として受け付けられない場合は理由を返す
+func readIsuImportIcon(f *zip.File) ([]byte, string, error) {
+	if f.UncompressedSize64 > iconMaxBytes {
+		return nil, "too large: icon", nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, "bad format: icon", nil
+	}
+	defer rc.Close()
+
+	image, err := ioutil.ReadAll(io.LimitReader(rc, iconMaxBytes+1))
+	if err != nil {
+		return nil, "bad format: icon", nil
+	}
+	if len(image) > iconMaxBytes {
+		return nil, "too large: icon", nil
+	}
+	_, err = sniffIconContentType(image)
+	if err != nil {
+		return nil, "bad format: icon", nil
+	}
+	err = validateIconImage(image)
+	if err != nil {
+		return nil, err.Error(), nil
+	}
+	return image, "", nil
+}
+
+func createIsuImport(imp *IsuImport, rows []IsuImportRow) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(
+		"INSERT INTO `isu_import` (`jia_user_id`, `organization_id`, `status`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?)",
+		imp.JIAUserID, imp.OrganizationID, imp.Status, now, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	imp.ID, err = result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	imp.CreatedAt = now
+	imp.UpdatedAt = now
+
+	for _, row := range rows {
+		var processedAt *time.Time
+		if row.Result != nil {
+			processedAt = &now
+		}
+		_, err = tx.Exec(
+			"INSERT INTO `isu_import_row`"+
+				"	(`import_id`, `row_index`, `jia_isu_uuid`, `isu_name`, `icon_blob_key`, `result`, `message`, `processed_at`)"+
+				"	VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			imp.ID, row.RowIndex, row.JIAIsuUUID, row.IsuName, row.IconBlobKey, row.Result, row.Message, processedAt)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 未処理の行を isuImportConcurrency 並列で登録する
+// 行の結果はISUの登録と同じトランザクションで記録するので、どこで中断しても続きから再開できる
+func runIsuImport(ctx context.Context, imp *IsuImport) error {
+	rowIndexes := []int{}
+	err := db.Select(&rowIndexes,
+		"SELECT `row_index` FROM `isu_import_row` WHERE `import_id` = ? AND `result` IS NULL ORDER BY `row_index`",
+		imp.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	defaultImage, err := ioutil.ReadFile(defaultIconFilePath)
+	if err != nil {
+		return err
+	}
+	defaultThumbnails, err := makeIconThumbnails(defaultImage)
+	if err != nil {
+		return err
+	}
+
+	queue := make(chan int)
+	errs := make(chan error, isuImportConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < isuImportConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rowIndex := range queue {
+				err := importIsuRow(imp, rowIndex, defaultImage, defaultThumbnails)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, rowIndex := range rowIndexes {
+		select {
+		case queue <- rowIndex:
+		case err = <-errs:
+			break dispatch
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-errs:
+		return err
+	default:
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	var remaining int
+	err = db.Get(&remaining, "SELECT COUNT(*) FROM `isu_import_row` WHERE `import_id` = ? AND `result` IS NULL", imp.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if remaining == 0 {
+		now := time.Now()
+		_, err = db.Exec("UPDATE `isu_import` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+			isuImportStatusCompleted, now, imp.ID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		imp.Status = isuImportStatusCompleted
+		imp.UpdatedAt = now
+	}
+	return nil
+}
+
+func importIsuRow(imp *IsuImport, rowIndex int, defaultImage []byte, defaultThumbnails []iconThumbnail) error {
+	var row IsuImportRow
+	err := db.Get(&row, "SELECT * FROM `isu_import_row` WHERE `import_id` = ? AND `row_index` = ?", imp.ID, rowIndex)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if row.Result != nil {
+		return nil
+	}
+
+	// サムネイルはトランザクションを始める前に作る
+	image, thumbnails := defaultImage, defaultThumbnails
+	if row.IconBlobKey != nil {
+		image, err = iconStore.Get(*row.IconBlobKey)
+		if err != nil {
+			return fmt.Errorf("failed to load icon: %v", err)
+		}
+		thumbnails, err = makeIconThumbnails(image)
+		if err != nil {
+			return fmt.Errorf("failed to make thumbnails: %v", err)
+		}
+	}
+
+	// アイコンの実体はトランザクションの外に保存されるので、確定しなかった場合は参照されていないものを消す
+	storedBlobKeys := []string{}
+	committed := false
+	defer func() {
+		if committed || len(storedBlobKeys) == 0 {
+			return
+		}
+		err := removeUnreferencedIconBlobs(storedBlobKeys)
+		if err != nil {
+			log.Errorf("failed to clean up icons: %v", err)
+		}
+	}()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	// 同じ取り込みを並行して再開された場合に二重に処理しない
+	err = tx.Get(&row, "SELECT * FROM `isu_import_row` WHERE `import_id` = ? AND `row_index` = ? FOR UPDATE",
+		imp.ID, rowIndex)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if row.Result != nil {
+		return nil
+	}
+
+	result := isuImportResultCreated
+	var message *string
+	storedBlobKeys, errStatusCode, err := registerIsu(tx, imp.JIAUserID, row.JIAIsuUUID, row.IsuName, imp.OrganizationID, image, thumbnails)
+	if err != nil {
+		if errStatusCode != http.StatusConflict {
+			return err
+		}
+		result = isuImportResultDuplicate
+		m := err.Error()
+		message = &m
+	}
+
+	_, err = tx.Exec(
+		"UPDATE `isu_import_row` SET `result` = ?, `message` = ?, `processed_at` = ? WHERE `import_id` = ? AND `row_index` = ?",
+		result, message, time.Now(), imp.ID, rowIndex)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	committed = true
+	return nil
+}
+
+func getIsuImportReport(imp IsuImport) (IsuImportResponse, error) {
+	type reportRow struct {
+		IsuImportRow
+		ActivationStatus        *string `db:"activation_status"`
+		ActivationFailureReason *string `db:"activation_failure_reason"`
+	}
+	rows := []reportRow{}
+	err := db.Select(&rows,
+		"SELECT `isu_import_row`.*,"+
+			"	`isu_activation`.`status` AS `activation_status`,"+
+			"	`isu_activation`.`failure_reason` AS `activation_failure_reason`"+
+			"	FROM `isu_import_row` LEFT JOIN `isu_activation`"+
+			"	ON `isu_activation`.`jia_isu_uuid` = `isu_import_row`.`jia_isu_uuid` AND `isu_import_row`.`result` = ?"+
+			"	WHERE `isu_import_row`.`import_id` = ? ORDER BY `isu_import_row`.`row_index`",
+		isuImportResultCreated, imp.ID)
+	if err != nil {
+		return IsuImportResponse{}, fmt.Errorf("db error: %v", err)
+	}
+
+	res := IsuImportResponse{
+		ID:             imp.ID,
+		Status:         imp.Status,
+		OrganizationID: imp.OrganizationID,
+		CreatedAt:      imp.CreatedAt.Unix(),
+		StatusURL:      fmt.Sprintf("/api/isu/bulk/%d", imp.ID),
+		Rows:           make([]IsuImportRowResponse, 0, len(rows)),
+	}
+	for _, row := range rows {
+		r := IsuImportRowResponse{
+			Row:              row.RowIndex,
+			JIAIsuUUID:       row.JIAIsuUUID,
+			IsuName:          row.IsuName,
+			Result:           row.Result,
+			Message:          row.Message,
+			ActivationStatus: row.ActivationStatus,
+		}
+		if row.ActivationStatus != nil && *row.ActivationStatus == isuActivationStatusPending {
+			res.ActivationPending++
+		}
+		if row.ActivationStatus != nil && *row.ActivationStatus == isuActivationStatusFailed {
+			result := isuImportResultJIAError
+			r.Result = &result
+			r.Message = row.ActivationFailureReason
+		}
+		res.Rows = append(res.Rows, r)
+	}
+	return res, nil
+}
+
+// 文字数で切り詰める
+func truncateString(s string, maxLength int) string {
+	runes := []rune(s)
+	if len(runes) > maxLength {
+		return string(runes[:maxLength])
+	}
+	return s
+}
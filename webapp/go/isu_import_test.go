@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseIsuImportCSV(t *testing.T) {
+	longUUID := strings.Repeat("u", isuImportUUIDMaxLength+1)
+	longName := strings.Repeat("な", isuImportNameMaxLength+1)
+	csvRows := func(header bool, n int) string {
+		var b strings.Builder
+		if header {
+			b.WriteString("jia_isu_uuid,isu_name\n")
+		}
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "uuid-%d,isu-%d\n", i, i)
+		}
+		return b.String()
+	}
+
+	type wantRow struct {
+		uuid string
+		name string
+		// 空であれば形式が正しい行
+		message string
+	}
+	tests := []struct {
+		name     string
+		csv      string
+		want     []wantRow
+		wantRows int
+		wantErr  string
+	}{
+		{
+			name: "header is skipped",
+			csv:  "jia_isu_uuid,isu_name\nuuid-1,いす1\nuuid-2,いす2\n",
+			want: []wantRow{{uuid: "uuid-1", name: "いす1"}, {uuid: "uuid-2", name: "いす2"}},
+		},
+		{
+			name: "without header",
+			csv:  "uuid-1,いす1\n",
+			want: []wantRow{{uuid: "uuid-1", name: "いす1"}},
+		},
+		{
+			// 先頭以外にある見出しと同じ行は、普通の行として扱う
+			name: "header only on first line",
+			csv:  "uuid-1,いす1\njia_isu_uuid,isu_name\n",
+			want: []wantRow{{uuid: "uuid-1", name: "いす1"}, {uuid: "jia_isu_uuid", name: "isu_name"}},
+		},
+		{
+			name: "spaces around uuid",
+			csv:  "  uuid-1  ,いす1\n",
+			want: []wantRow{{uuid: "uuid-1", name: "いす1"}},
+		},
+		{
+			name: "invalid rows are kept",
+			csv: "uuid-1,いす1,extra\n" +
+				"uuid-2\n" +
+				",いす3\n" +
+				longUUID + ",いす4\n" +
+				"uuid-5,\n" +
+				"uuid-6," + longName + "\n" +
+				"uuid-7,いす7\n",
+			want: []wantRow{
+				{uuid: "uuid-1", message: "bad format: row"},
+				{uuid: "uuid-2", message: "bad format: row"},
+				{uuid: "", name: "いす3", message: "bad format: jia_isu_uuid"},
+				{uuid: longUUID[:isuImportUUIDMaxLength], name: "いす4", message: "bad format: jia_isu_uuid"},
+				{uuid: "uuid-5", message: "bad format: isu_name"},
+				{uuid: "uuid-6", name: string([]rune(longName)[:isuImportNameMaxLength]), message: "bad format: isu_name"},
+				{uuid: "uuid-7", name: "いす7"},
+			},
+		},
+		{name: "row cap", csv: csvRows(false, isuImportMaxRows), wantRows: isuImportMaxRows},
+		{name: "row cap with header", csv: csvRows(true, isuImportMaxRows), wantRows: isuImportMaxRows},
+		{name: "too many rows", csv: csvRows(false, isuImportMaxRows+1), wantErr: "too many rows: csv"},
+		{name: "header only", csv: "jia_isu_uuid,isu_name\n", wantErr: "missing: rows"},
+		{name: "empty", csv: "", wantErr: "missing: rows"},
+		{name: "broken csv", csv: "uuid-1,\"いす1\n", wantErr: "bad format: csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseIsuImportCSV(strings.NewReader(tt.csv))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.want == nil {
+				if len(rows) != tt.wantRows {
+					t.Fatalf("rows = %v, want %v", len(rows), tt.wantRows)
+				}
+				for i, row := range rows {
+					if row.RowIndex != i+1 || row.Result != nil {
+						t.Fatalf("row %v: index = %v, result = %v", i+1, row.RowIndex, row.Result)
+					}
+				}
+				return
+			}
+
+			if len(rows) != len(tt.want) {
+				t.Fatalf("rows = %v, want %v", len(rows), len(tt.want))
+			}
+			for i, want := range tt.want {
+				row := rows[i]
+				if row.RowIndex != i+1 {
+					t.Errorf("row %v: index = %v", i+1, row.RowIndex)
+				}
+				if row.JIAIsuUUID != want.uuid || row.IsuName != want.name {
+					t.Errorf("row %v: (%q, %q), want (%q, %q)", i+1, row.JIAIsuUUID, row.IsuName, want.uuid, want.name)
+				}
+				if want.message == "" {
+					if row.Result != nil {
+						t.Errorf("row %v: result = %v, want valid", i+1, *row.Result)
+					}
+					continue
+				}
+				if row.Result == nil || *row.Result != isuImportResultInvalid || row.Message == nil || *row.Message != want.message {
+					t.Errorf("row %v: result = %v, message = %v, want invalid, %v", i+1, row.Result, row.Message, want.message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	isuStatusOnline  = "online"
+	isuStatusStale   = "stale"
+	isuStatusOffline = "offline"
+
+	isuStatusCheckInterval = 5 * time.Second
+	// 送信間隔がまだわからないISUに使う値 (ISUは3秒ごとにコンディションを送る)
+	isuStatusDefaultPostingInterval = 3 * time.Second
+	// 送信間隔の何回分届かなければ stale / offline とみなすか
+	isuStatusStaleFactor     = 5
+	isuStatusOfflineFactor   = 20
+	isuStatusMinStaleAfter   = 30 * time.Second
+	isuStatusMinOfflineAfter = 2 * time.Minute
+	// 送信間隔の推定値を新しい観測値にどれだけ寄せるか
+	isuStatusIntervalSmoothing = 0.2
+)
+
+// isu_status の行
+type IsuStatus struct {
+	JIAIsuUUID        string     `db:"jia_isu_uuid"`
+	Status            string     `db:"status"`
+	LastSeenAt        *time.Time `db:"last_seen_at"`
+	PostingIntervalMs int        `db:"posting_interval_ms"`
+	StatusChangedAt   time.Time  `db:"status_changed_at"`
+	UpdatedAt         time.Time  `db:"updated_at"`
+}
+
+// 最後にコンディションが届いた時刻と送信間隔から状態を決める
+func isuStatusAt(lastSeenAt time.Time, postingInterval time.Duration, now time.Time) string {
+	if postingInterval <= 0 {
+		postingInterval = isuStatusDefaultPostingInterval
+	}
+	staleAfter := postingInterval * isuStatusStaleFactor
+	if staleAfter < isuStatusMinStaleAfter {
+		staleAfter = isuStatusMinStaleAfter
+	}
+	offlineAfter := postingInterval * isuStatusOfflineFactor
+	if offlineAfter < isuStatusMinOfflineAfter {
+		offlineAfter = isuStatusMinOfflineAfter
+	}
+
+	elapsed := now.Sub(lastSeenAt)
+	switch {
+	case elapsed >= offlineAfter:
+		return isuStatusOffline
+	case elapsed >= staleAfter:
+		return isuStatusStale
+	default:
+		return isuStatusOnline
+	}
+}
+
+// ISUごとの最後にコンディションが届いた時刻と送信間隔の推定値をメモリ上で追跡する
+// DBへの反映は runIsuStatusChecker がまとめて行う
+type isuSeenTracker struct {
+	mu    sync.Mutex
+	seen  map[string]*isuSeen
+	dirty map[string]struct{}
+}
+
+type isuSeen struct {
+	LastSeenAt      time.Time
+	PostingInterval time.Duration
+}
+
+var isuLastSeen = &isuSeenTracker{seen: map[string]*isuSeen{}, dirty: map[string]struct{}{}}
+
+// ISUからコンディションが届いたことを記録する
+func (t *isuSeenTracker) Touch(jiaIsuUUID string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.seen[jiaIsuUUID]
+	if !ok {
+		t.seen[jiaIsuUUID] = &isuSeen{LastSeenAt: now}
+		t.dirty[jiaIsuUUID] = struct{}{}
+		return
+	}
+	gap := now.Sub(s.LastSeenAt)
+	if gap <= 0 {
+		return
+	}
+	if s.PostingInterval == 0 {
+		s.PostingInterval = gap
+	} else {
+		s.PostingInterval += time.Duration(float64(gap-s.PostingInterval) * isuStatusIntervalSmoothing)
+	}
+	s.LastSeenAt = now
+	t.dirty[jiaIsuUUID] = struct{}{}
+}
+
+// DBに保存されている値で初期化する (再起動時用)
+func (t *isuSeenTracker) Load(statuses []IsuStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range statuses {
+		if s.LastSeenAt == nil {
+			continue
+		}
+		if _, ok := t.seen[s.JIAIsuUUID]; ok {
+			continue
+		}
+		t.seen[s.JIAIsuUUID] = &isuSeen{
+			LastSeenAt:      *s.LastSeenAt,
+			PostingInterval: time.Duration(s.PostingIntervalMs) * time.Millisecond,
+		}
+	}
+}
+
+// 前回から変化があったISUの記録を取り出す
+func (t *isuSeenTracker) takeDirty() map[string]isuSeen {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dirty := make(map[string]isuSeen, len(t.dirty))
+	for jiaIsuUUID := range t.dirty {
+		dirty[jiaIsuUUID] = *t.seen[jiaIsuUUID]
+	}
+	t.dirty = map[string]struct{}{}
+	return dirty
+}
+
+// 書き込みに失敗した記録を次回に回す
+func (t *isuSeenTracker) markDirty(jiaIsuUUIDs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if _, ok := t.seen[jiaIsuUUID]; ok {
+			t.dirty[jiaIsuUUID] = struct{}{}
+		}
+	}
+}
+
+// ISUの削除用
+func (t *isuSeenTracker) Forget(jiaIsuUUID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.seen, jiaIsuUUID)
+	delete(t.dirty, jiaIsuUUID)
+}
+
+// POST /initialize 用
+func (t *isuSeenTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen = map[string]*isuSeen{}
+	t.dirty = map[string]struct{}{}
+}
+
+// 定期的に最終受信時刻を isu_status に書き込み、状態が変わったISUを isu_status_history に記録する
+func runIsuStatusChecker(ctx context.Context) {
+	statuses := []IsuStatus{}
+	err := db.Select(&statuses, "SELECT * FROM `isu_status`")
+	if err != nil {
+		log.Errorf("failed to load isu_status: %v", err)
+	}
+	isuLastSeen.Load(statuses)
+
+	ticker := time.NewTicker(isuStatusCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := saveIsuLastSeen()
+			if err != nil {
+				log.Errorf("failed to save isu last seen: %v", err)
+			}
+			err = updateIsuStatuses(time.Now())
+			if err != nil {
+				log.Errorf("failed to update isu_status: %v", err)
+			}
+		}
+	}
+}
+
+func saveIsuLastSeen() error {
+	dirty := isuLastSeen.takeDirty()
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	jiaIsuUUIDs := make([]string, 0, len(dirty))
+	placeholders := make([]string, 0, len(dirty))
+	args := make([]interface{}, 0, len(dirty)*4)
+	for jiaIsuUUID, s := range dirty {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, jiaIsuUUID)
+		placeholders = append(placeholders, "(?, ?, ?, ?)")
+		args = append(args, jiaIsuUUID, "", s.LastSeenAt, s.PostingInterval.Milliseconds())
+	}
+
+	// status は updateIsuStatuses で決めて履歴と一緒に書き込む
+	_, err := db.Exec(
+		"INSERT INTO `isu_status` (`jia_isu_uuid`, `status`, `last_seen_at`, `posting_interval_ms`)"+
+			"	VALUES "+strings.Join(placeholders, ",")+
+			"	ON DUPLICATE KEY UPDATE `last_seen_at` = VALUES(`last_seen_at`), `posting_interval_ms` = VALUES(`posting_interval_ms`)",
+		args...)
+	if err != nil {
+		isuLastSeen.markDirty(jiaIsuUUIDs)
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// isu_status の行がないISUも含めて状態を計算し直し、変わったものだけ書き込む
+func updateIsuStatuses(now time.Time) error {
+	type row struct {
+		JIAIsuUUID        string     `db:"jia_isu_uuid"`
+		CreatedAt         time.Time  `db:"created_at"`
+		Status            *string    `db:"status"`
+		LastSeenAt        *time.Time `db:"last_seen_at"`
+		PostingIntervalMs *int       `db:"posting_interval_ms"`
+	}
+	rows := []row{}
+	err := db.Select(&rows,
+		"SELECT `isu`.`jia_isu_uuid`, `isu`.`created_at`, `isu_status`.`status`,"+
+			"	`isu_status`.`last_seen_at`, `isu_status`.`posting_interval_ms`"+
+			"	FROM `isu` LEFT JOIN `isu_status` ON `isu_status`.`jia_isu_uuid` = `isu`.`jia_isu_uuid`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, r := range rows {
+		current := IsuStatus{JIAIsuUUID: r.JIAIsuUUID, LastSeenAt: r.LastSeenAt}
+		if r.PostingIntervalMs != nil {
+			current.PostingIntervalMs = *r.PostingIntervalMs
+		}
+		next := current.statusAt(r.CreatedAt, now)
+
+		from := ""
+		if r.Status != nil {
+			from = *r.Status
+		}
+		if from == next {
+			continue
+		}
+		err = recordIsuStatusTransition(r.JIAIsuUUID, from, next, r.LastSeenAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordIsuStatusTransition(jiaIsuUUID string, from string, to string, lastSeenAt *time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO `isu_status` (`jia_isu_uuid`, `status`, `status_changed_at`) VALUES (?, ?, NOW(6))"+
+			"	ON DUPLICATE KEY UPDATE `status` = VALUES(`status`), `status_changed_at` = VALUES(`status_changed_at`)",
+		jiaIsuUUID, to)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `isu_status_history` (`jia_isu_uuid`, `from_status`, `to_status`, `last_seen_at`) VALUES (?, ?, ?, ?)",
+		jiaIsuUUID, from, to, lastSeenAt)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 一度もコンディションが届いていないISUは登録時刻から数える
+func (s IsuStatus) statusAt(isuCreatedAt time.Time, now time.Time) string {
+	lastSeenAt := isuCreatedAt
+	if s.LastSeenAt != nil {
+		lastSeenAt = *s.LastSeenAt
+	}
+	return isuStatusAt(lastSeenAt, time.Duration(s.PostingIntervalMs)*time.Millisecond, now)
+}
+
+// 指定したISUの状態を取得 (チェッカーがまだ書き込んでいないISUはその場で計算する)
+func getIsuStatuses(q sqlx.Queryer, isuList []Isu) (map[string]IsuStatus, error) {
+	res := make(map[string]IsuStatus, len(isuList))
+	if len(isuList) == 0 {
+		return res, nil
+	}
+
+	jiaIsuUUIDs := make([]string, 0, len(isuList))
+	for _, isu := range isuList {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM `isu_status` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []IsuStatus{}
+	err = sqlx.Select(q, &statuses, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for _, s := range statuses {
+		res[s.JIAIsuUUID] = s
+	}
+
+	now := time.Now()
+	for _, isu := range isuList {
+		s, ok := res[isu.JIAIsuUUID]
+		if !ok || s.Status == "" {
+			s.JIAIsuUUID = isu.JIAIsuUUID
+			s.Status = s.statusAt(isu.CreatedAt, now)
+			res[isu.JIAIsuUUID] = s
+		}
+	}
+	return res, nil
+}
+
+// ISUに状態とアクティベートの状態を埋める
+func fillIsuStatus(q sqlx.Queryer, isu *Isu) error {
+	statuses, err := getIsuStatuses(q, []Isu{*isu})
+	if err != nil {
+		return err
+	}
+	s := statuses[isu.JIAIsuUUID]
+	isu.Status = s.Status
+	if s.LastSeenAt != nil {
+		lastSeenAt := s.LastSeenAt.Unix()
+		isu.LastSeenAt = &lastSeenAt
+	}
+
+	activations, err := getIsuActivations(q, []Isu{*isu})
+	if err != nil {
+		return err
+	}
+	a := activations[isu.JIAIsuUUID]
+	isu.ActivationStatus = a.Status
+	isu.ActivationFailureReason = a.FailureReason
+	return nil
+}
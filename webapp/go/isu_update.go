@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PATCH /api/isu/:jia_isu_uuid
+// ISUの名前とアイコンを更新 (送られた項目だけを更新する)
+func patchIsu(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	form, err := c.FormParams()
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	_, hasName := form["isu_name"]
+	isuName := c.FormValue("isu_name")
+	image, thumbnails, errStatusCode, err := readIsuImageForm(c)
+	if err != nil {
+		if errStatusCode != http.StatusInternalServerError {
+			return c.String(errStatusCode, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !hasName && image == nil {
+		return c.String(http.StatusBadRequest, "missing: isu_name or image")
+	}
+	if hasName && isuName == "" {
+		return c.String(http.StatusBadRequest, "bad format: isu_name")
+	}
+
+	// アイコンの実体はトランザクションの外に保存されるので、確定しなかった場合は参照されていないものを消す
+	storedBlobKeys := []string{}
+	committed := false
+	defer func() {
+		if committed || len(storedBlobKeys) == 0 {
+			return
+		}
+		err := removeUnreferencedIconBlobs(storedBlobKeys)
+		if err != nil {
+			c.Logger().Errorf("failed to clean up icons: %v", err)
+		}
+	}()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	access, errStatusCode, err := authorizeIsu(tx, jiaUserID, jiaIsuUUID, isuRoleEditor)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	var isu Isu
+	err = tx.Get(&isu, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ? FOR UPDATE", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if hasName {
+		isu.Name = isuName
+	}
+	_, err = tx.Exec("UPDATE `isu` SET `name` = ?, `updated_at` = NOW(6) WHERE `jia_isu_uuid` = ?",
+		isu.Name, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if image != nil {
+		contentType, err := sniffIconContentType(image)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		key, err := saveIsuIcon(tx, jiaIsuUUID, image, contentType)
+		if key != "" {
+			storedBlobKeys = append(storedBlobKeys, key)
+		}
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		keys, err := saveIsuIconVariants(tx, jiaIsuUUID, thumbnails)
+		storedBlobKeys = append(storedBlobKeys, keys...)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		// 移行前のアイコンが残っていれば消しておく
+		_, err = tx.Exec("UPDATE `isu` SET `image` = NULL WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = tx.Get(&isu, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	isu.Role = access.Role
+	isu.OrganizationID = access.OrganizationID
+	err = fillIsuStatus(tx, &isu)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, isu)
+}
@@ -0,0 +1,58 @@
+package jia
+
+import (
+	"sync"
+	"time"
+)
+
+// 失敗が続いたら一定期間呼び出しを止め、その後は1件だけ試して回復したかを確かめる
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu             sync.Mutex
+	failures       int
+	openedAt       time.Time
+	probing        bool
+	probeStartedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, openDuration: openDuration}
+}
+
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if now.Sub(b.openedAt) < b.openDuration {
+		return false
+	}
+	// 試している1件の結果が返ってこない場合は、openDuration 経ってから次を試す
+	if b.probing && now.Sub(b.probeStartedAt) < b.openDuration {
+		return false
+	}
+	b.probing = true
+	b.probeStartedAt = now
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openedAt = now
+	}
+}
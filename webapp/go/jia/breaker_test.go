@@ -0,0 +1,106 @@
+package jia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const threshold = 3
+	const openDuration = 10 * time.Second
+	start := time.Unix(1700000000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	type step struct {
+		name string
+		// "allow", "success", "failure"
+		op   string
+		at   time.Duration
+		want bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stays closed below threshold",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure"},
+				{name: "two failures", op: "allow", want: true},
+			},
+		},
+		{
+			name: "success resets failures",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure"},
+				{op: "success"},
+				{op: "failure"},
+				{name: "failures were reset", op: "allow", want: true},
+			},
+		},
+		{
+			name: "opens at threshold and allows one probe",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure"},
+				{op: "failure"},
+				{name: "open", op: "allow", want: false},
+				{name: "still open", op: "allow", at: openDuration - time.Second, want: false},
+				{name: "probe", op: "allow", at: openDuration, want: true},
+				{name: "only one probe", op: "allow", at: openDuration, want: false},
+			},
+		},
+		{
+			name: "successful probe closes",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure"},
+				{op: "failure"},
+				{name: "probe", op: "allow", at: openDuration, want: true},
+				{op: "success"},
+				{name: "closed", op: "allow", at: openDuration, want: true},
+				{name: "still closed", op: "allow", at: openDuration, want: true},
+			},
+		},
+		{
+			name: "failed probe opens again",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure"},
+				{op: "failure"},
+				{name: "probe", op: "allow", at: openDuration, want: true},
+				{op: "failure", at: openDuration},
+				{name: "reopened", op: "allow", at: openDuration + time.Second, want: false},
+				{name: "next probe", op: "allow", at: 2 * openDuration, want: true},
+			},
+		},
+		{
+			name: "lost probe is retried after openDuration",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure"},
+				{op: "failure"},
+				{name: "probe", op: "allow", at: openDuration, want: true},
+				{name: "waiting for probe", op: "allow", at: 2*openDuration - time.Second, want: false},
+				{name: "next probe", op: "allow", at: 2 * openDuration, want: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		b := newCircuitBreaker(threshold, openDuration)
+		for _, s := range tt.steps {
+			switch s.op {
+			case "allow":
+				if got := b.Allow(at(s.at)); got != s.want {
+					t.Errorf("%v: %v: Allow = %v, want %v", tt.name, s.name, got, s.want)
+				}
+			case "success":
+				b.Success()
+			case "failure":
+				b.Failure(at(s.at))
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package jia は JIA の ISU 管理サービスを呼び出すクライアント
+//
+// リクエストごとにタイムアウトを設け、通信エラーと 5xx は回数を限って再試行する。
+// 失敗が続いた場合はサーキットブレーカーが開き、しばらくの間は JIA を呼ばずに ErrCircuitOpen を返す。
+package jia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// サーキットブレーカーが開いているため呼び出さなかった
+var ErrCircuitOpen = errors.New("jia: circuit breaker is open")
+
+// JIA が 2xx 以外を返した
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("jia: status code %v, message: %v", e.StatusCode, e.Body)
+}
+
+type Config struct {
+	// 1回のリクエストのタイムアウト
+	Timeout time.Duration
+	// 再試行の回数 (最初の1回は含まない)
+	MaxRetries int
+	// 再試行までの待ち時間 (1回ごとに倍にする)
+	RetryBackoff time.Duration
+	// この回数続けて失敗したらサーキットブレーカーを開く
+	FailureThreshold int
+	// サーキットブレーカーを開いておく期間
+	OpenDuration time.Duration
+}
+
+var DefaultConfig = Config{
+	Timeout:          5 * time.Second,
+	MaxRetries:       2,
+	RetryBackoff:     100 * time.Millisecond,
+	FailureThreshold: 5,
+	OpenDuration:     10 * time.Second,
+}
+
+type Client struct {
+	config     Config
+	httpClient *http.Client
+	breaker    *circuitBreaker
+}
+
+func NewClient(config Config) *Client {
+	return &Client{
+		config:     config,
+		httpClient: &http.Client{Timeout: config.Timeout},
+		breaker:    newCircuitBreaker(config.FailureThreshold, config.OpenDuration),
+	}
+}
+
+type ActivateRequest struct {
+	TargetBaseURL string `json:"target_base_url"`
+	IsuUUID       string `json:"isu_uuid"`
+	DeviceSecret  string `json:"device_secret"`
+}
+
+type ActivateResponse struct {
+	Character string `json:"character"`
+}
+
+type deactivateRequest struct {
+	IsuUUID string `json:"isu_uuid"`
+}
+
+// POST /api/activate
+// アクティベートは同じ ISU に対して繰り返しても結果が変わらないので再試行してよい
+func (c *Client) Activate(ctx context.Context, baseURL string, req ActivateRequest) (*ActivateResponse, error) {
+	body, err := c.post(ctx, baseURL+"/api/activate", req, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+
+	var res ActivateResponse
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return nil, fmt.Errorf("jia: failed to decode activate response: %v", err)
+	}
+	return &res, nil
+}
+
+// POST /api/deactivate
+// JIA が既に ISU を把握していない (404) 場合は停止済みとみなす
+func (c *Client) Deactivate(ctx context.Context, baseURL string, isuUUID string) error {
+	_, err := c.post(ctx, baseURL+"/api/deactivate", deactivateRequest{isuUUID}, http.StatusNoContent)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) post(ctx context.Context, url string, payload interface{}, expectedStatus int) ([]byte, error) {
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := c.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if !c.breaker.Allow(time.Now()) {
+			return nil, ErrCircuitOpen
+		}
+
+		body, err := c.do(ctx, url, reqBody, expectedStatus)
+		retryable := isRetryable(err)
+		switch {
+		case ctx.Err() != nil:
+			// 呼び出し元の都合で打ち切ったものは JIA の失敗に数えない
+		case retryable:
+			c.breaker.Failure(time.Now())
+		default:
+			c.breaker.Success()
+		}
+		if !retryable || attempt >= c.config.MaxRetries || ctx.Err() != nil {
+			return body, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) do(ctx context.Context, url string, reqBody []byte, expectedStatus int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, &transportError{err}
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &transportError{err}
+	}
+	if res.StatusCode != expectedStatus {
+		return nil, &StatusError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
+
+// 通信に失敗した (JIA に届いたかどうか分からない)
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("jia: failed to request: %v", e.err)
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// 通信エラーと 5xx は JIA 側の障害として再試行し、サーキットブレーカーの失敗にも数える
+func isRetryable(err error) bool {
+	var transportErr *transportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	jwksPath = "/.well-known/jwks.json"
+	// 取得した鍵を使い回す期間
+	jwksCacheTTL = 5 * time.Minute
+	// 知らない kid が来たときに取得し直す最短の間隔
+	jwksRefreshInterval = 10 * time.Second
+	jwksFetchTimeout    = 5 * time.Second
+	// JIA とのサーバ間の時刻のずれの許容範囲
+	jwtClockSkew = 30 * time.Second
+)
+
+var (
+	jiaJWTIssuer   = getEnv("JIA_JWT_ISSUER", "isucon-jia")
+	jiaJWTAudience = getEnv("JIA_JWT_AUDIENCE", "isucondition")
+
+	// kid のない JWT を ../ec256-public.pem の鍵で受け付ける期限 (ゼロ値なら受け付けない)
+	// JIA_JWT_LEGACY_KEY_UNTIL で移行期間中のみ指定する
+	jiaJWTLegacyKeyUntil time.Time
+
+	jiaKeys = &jiaKeyProvider{client: &http.Client{Timeout: jwksFetchTimeout}}
+)
+
+// JIA_JWT_LEGACY_KEY_UNTIL は UNIX 時間か RFC 3339 の時刻
+func parseJIAJWTLegacyKeyUntil(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad format: JIA_JWT_LEGACY_KEY_UNTIL: %v", s)
+	}
+	return t, nil
+}
+
+// JWKS が取得できなかったことを表す (JWT が不正なわけではない)
+type jwksFetchError struct {
+	err error
+}
+
+func (e *jwksFetchError) Error() string {
+	return fmt.Sprintf("failed to fetch JWKS: %v", e.err)
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JIA が公開している JWKS を取得・キャッシュし、kid で検証用の鍵を選ぶ
+type jiaKeyProvider struct {
+	client *http.Client
+
+	mu          sync.Mutex
+	url         string
+	keys        map[string]*ecdsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// kid に対応する鍵を返す
+// キャッシュが古いか知らない kid であれば取得し直す
+func (p *jiaKeyProvider) Key(jiaServiceURL string, kid string, now time.Time) (*ecdsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.url != jiaServiceURL {
+		p.resetLocked()
+		p.url = jiaServiceURL
+	}
+
+	key, ok := p.keys[kid]
+	refresh := !ok || now.Sub(p.fetchedAt) >= jwksCacheTTL
+	if refresh && now.Sub(p.attemptedAt) >= jwksRefreshInterval {
+		p.attemptedAt = now
+		keys, err := p.fetch(jiaServiceURL + jwksPath)
+		if err != nil {
+			// 取得に失敗しても期限切れのキャッシュで検証を続ける
+			if !ok {
+				return nil, err
+			}
+			return key, nil
+		}
+		p.keys = keys
+		p.fetchedAt = now
+		key, ok = p.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %v", kid)
+	}
+	return key, nil
+}
+
+// JIA のURLが変わった場合などに、次の検証で取得し直させる
+func (p *jiaKeyProvider) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resetLocked()
+}
+
+func (p *jiaKeyProvider) resetLocked() {
+	p.url = ""
+	p.keys = nil
+	p.fetchedAt = time.Time{}
+	p.attemptedAt = time.Time{}
+}
+
+func (p *jiaKeyProvider) fetch(url string) (map[string]*ecdsa.PublicKey, error) {
+	res, err := p.client.Get(url)
+	if err != nil {
+		return nil, &jwksFetchError{err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &jwksFetchError{fmt.Errorf("status code %v", res.StatusCode)}
+	}
+
+	var set jwkSet
+	err = json.NewDecoder(res.Body).Decode(&set)
+	if err != nil {
+		return nil, &jwksFetchError{err}
+	}
+
+	keys := map[string]*ecdsa.PublicKey{}
+	for _, k := range set.Keys {
+		// ES256 の署名用の鍵以外は使わない
+		if k.Kty != "EC" || k.Crv != "P-256" || k.Kid == "" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "ES256") {
+			continue
+		}
+		key, err := k.ecdsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: jwk x: %v", k.Kid)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: jwk y: %v", k.Kid)
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("bad format: jwk is not on curve: %v", k.Kid)
+	}
+	return key, nil
+}
+
+// JIA が発行した JWT を検証して claims を返す
+// kid のない JWT は鍵のローテーション前に発行されたものとして、jiaJWTLegacyKeyUntil までに限り
+// ../ec256-public.pem の鍵で検証し、iss と aud は含まれている場合のみ確認する
+func parseJIAToken(tokenString string, jiaServiceURL string, now time.Time) (jwt.MapClaims, error) {
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodES256.Alg()}, SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			if !now.Before(jiaJWTLegacyKeyUntil) {
+				return nil, fmt.Errorf("missing: kid")
+			}
+			return jiaJWTSigningKey, nil
+		}
+		return jiaKeys.Key(jiaServiceURL, kid, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, jwt.NewValidationError("invalid JWT payload", jwt.ValidationErrorClaimsInvalid)
+	}
+	kid, _ := token.Header["kid"].(string)
+	err = validateJIAClaims(claims, kid != "", now)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func validateJIAClaims(claims jwt.MapClaims, strict bool, now time.Time) error {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok || now.Add(-jwtClockSkew).Unix() >= exp {
+		return jwt.NewValidationError("token is expired", jwt.ValidationErrorExpired)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(jwtClockSkew).Unix() < nbf {
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+	if iat, ok := numericClaim(claims, "iat"); ok && now.Add(jwtClockSkew).Unix() < iat {
+		return jwt.NewValidationError("token used before issued", jwt.ValidationErrorIssuedAt)
+	}
+
+	_, hasIss := claims["iss"]
+	if (strict || hasIss) && !claims.VerifyIssuer(jiaJWTIssuer, true) {
+		return jwt.NewValidationError("invalid issuer", jwt.ValidationErrorIssuer)
+	}
+	_, hasAud := claims["aud"]
+	if (strict || hasAud) && !verifyAudience(claims["aud"], jiaJWTAudience) {
+		return jwt.NewValidationError("invalid audience", jwt.ValidationErrorAudience)
+	}
+	return nil
+}
+
+func numericClaim(claims jwt.MapClaims, name string) (int64, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return int64(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// aud は文字列か文字列の配列
+func verifyAudience(aud interface{}, expected string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
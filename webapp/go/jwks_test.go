@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// テスト用の JWKS を返す JIA
+type testJWKSServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PrivateKey
+	fetches int
+}
+
+func newTestJWKSServer(t *testing.T) *testJWKSServer {
+	s := &testJWKSServer{keys: map[string]*ecdsa.PrivateKey{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		set := jwkSet{Keys: []jwk{}}
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, jwk{
+				Kty: "EC",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+				Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+				Kid: kid,
+				Alg: "ES256",
+				Use: "sig",
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testJWKSServer) setKeys(keys map[string]*ecdsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *testJWKSServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func newTestECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signTestJWT(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// jiaJWTSigningKey と jiaJWTLegacyKeyUntil を差し替え、テスト後に戻す
+func useTestLegacyKey(t *testing.T, key *ecdsa.PrivateKey, until time.Time) {
+	signingKey, legacyKeyUntil := jiaJWTSigningKey, jiaJWTLegacyKeyUntil
+	jiaJWTSigningKey, jiaJWTLegacyKeyUntil = &key.PublicKey, until
+	jiaKeys.Reset()
+	t.Cleanup(func() {
+		jiaJWTSigningKey, jiaJWTLegacyKeyUntil = signingKey, legacyKeyUntil
+		jiaKeys.Reset()
+	})
+}
+
+func TestParseJIAToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	legacyKey := newTestECDSAKey(t)
+	currentKey := newTestECDSAKey(t)
+	otherKey := newTestECDSAKey(t)
+
+	server := newTestJWKSServer(t)
+	server.setKeys(map[string]*ecdsa.PrivateKey{"current": currentKey})
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"jia_user_id": "isucon",
+			"iss":         jiaJWTIssuer,
+			"aud":         jiaJWTAudience,
+			"iat":         now.Unix(),
+			"exp":         now.Add(time.Hour).Unix(),
+		}
+	}
+	legacyClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"jia_user_id": "isucon",
+			"iat":         now.Unix(),
+			"exp":         now.Add(time.Hour).Unix(),
+		}
+	}
+	with := func(claims jwt.MapClaims, name string, value interface{}) jwt.MapClaims {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name           string
+		key            *ecdsa.PrivateKey
+		kid            string
+		claims         jwt.MapClaims
+		legacyKeyUntil time.Time
+		wantErr        uint32
+	}{
+		{name: "valid", key: currentKey, kid: "current", claims: validClaims()},
+		{name: "aud in array", key: currentKey, kid: "current", claims: with(validClaims(), "aud", []interface{}{"other", jiaJWTAudience})},
+		{name: "wrong aud", key: currentKey, kid: "current", claims: with(validClaims(), "aud", "other"), wantErr: jwt.ValidationErrorAudience},
+		{name: "missing aud", key: currentKey, kid: "current", claims: with(validClaims(), "aud", nil), wantErr: jwt.ValidationErrorAudience},
+		{name: "wrong iss", key: currentKey, kid: "current", claims: with(validClaims(), "iss", "other"), wantErr: jwt.ValidationErrorIssuer},
+		{name: "missing iss", key: currentKey, kid: "current", claims: with(validClaims(), "iss", nil), wantErr: jwt.ValidationErrorIssuer},
+		{name: "expired", key: currentKey, kid: "current", claims: with(validClaims(), "exp", now.Add(-time.Minute).Unix()), wantErr: jwt.ValidationErrorExpired},
+		{name: "expired within skew", key: currentKey, kid: "current", claims: with(validClaims(), "exp", now.Add(-jwtClockSkew/2).Unix())},
+		{name: "missing exp", key: currentKey, kid: "current", claims: with(validClaims(), "exp", nil), wantErr: jwt.ValidationErrorExpired},
+		{name: "not valid yet", key: currentKey, kid: "current", claims: with(validClaims(), "nbf", now.Add(time.Minute).Unix()), wantErr: jwt.ValidationErrorNotValidYet},
+		{name: "unknown kid", key: otherKey, kid: "unknown", claims: validClaims(), wantErr: jwt.ValidationErrorUnverifiable},
+		{name: "signed by other key", key: otherKey, kid: "current", claims: validClaims(), wantErr: jwt.ValidationErrorSignatureInvalid},
+		{name: "no kid without legacy window", key: legacyKey, claims: legacyClaims(), wantErr: jwt.ValidationErrorUnverifiable},
+		{name: "no kid after legacy window", key: legacyKey, claims: legacyClaims(), legacyKeyUntil: now, wantErr: jwt.ValidationErrorUnverifiable},
+		{name: "no kid and no iss within legacy window", key: legacyKey, claims: legacyClaims(), legacyKeyUntil: now.Add(time.Hour)},
+		{name: "no kid with wrong aud within legacy window", key: legacyKey, claims: with(legacyClaims(), "aud", "other"), legacyKeyUntil: now.Add(time.Hour), wantErr: jwt.ValidationErrorAudience},
+		{name: "no kid signed by other key", key: otherKey, claims: legacyClaims(), legacyKeyUntil: now.Add(time.Hour), wantErr: jwt.ValidationErrorSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestLegacyKey(t, legacyKey, tt.legacyKeyUntil)
+			token := signTestJWT(t, tt.key, tt.kid, tt.claims)
+
+			claims, err := parseJIAToken(token, server.URL, now)
+			if tt.wantErr == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if claims["jia_user_id"] != "isucon" {
+					t.Errorf("jia_user_id = %v", claims["jia_user_id"])
+				}
+				return
+			}
+			validationErr, ok := err.(*jwt.ValidationError)
+			if !ok {
+				t.Fatalf("want *jwt.ValidationError, got %#v", err)
+			}
+			if validationErr.Errors&tt.wantErr == 0 {
+				t.Errorf("errors = %b, want %b (%v)", validationErr.Errors, tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestJIAKeyProviderCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	oldKey := newTestECDSAKey(t)
+	newKey := newTestECDSAKey(t)
+
+	server := newTestJWKSServer(t)
+	server.setKeys(map[string]*ecdsa.PrivateKey{"old": oldKey})
+	p := &jiaKeyProvider{client: server.Client()}
+
+	if _, err := p.Key(server.URL, "old", now); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.fetchCount(); got != 1 {
+		t.Fatalf("fetches = %v, want 1", got)
+	}
+
+	// 期限内はキャッシュを使う
+	if _, err := p.Key(server.URL, "old", now.Add(jwksCacheTTL-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.fetchCount(); got != 1 {
+		t.Fatalf("fetches = %v, want 1", got)
+	}
+
+	// 知らない kid でも jwksRefreshInterval 以内には取得し直さない
+	server.setKeys(map[string]*ecdsa.PrivateKey{"new": newKey})
+	if _, err := p.Key(server.URL, "new", now.Add(jwksRefreshInterval-time.Second)); err == nil {
+		t.Fatal("want error for unknown kid")
+	}
+	if got := server.fetchCount(); got != 1 {
+		t.Fatalf("fetches = %v, want 1", got)
+	}
+
+	// キャッシュが期限切れになったら取得し直し、ローテーションで消えた鍵は使えなくなる
+	expired := now.Add(jwksCacheTTL)
+	key, err := p.Key(server.URL, "new", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.X.Cmp(newKey.X) != 0 {
+		t.Error("got a key other than the rotated one")
+	}
+	if got := server.fetchCount(); got != 2 {
+		t.Fatalf("fetches = %v, want 2", got)
+	}
+	if _, err := p.Key(server.URL, "old", expired.Add(jwksRefreshInterval)); err == nil {
+		t.Error("want error for a key removed by rotation")
+	}
+
+	// 期限切れ後に取得できなくても、キャッシュにある鍵で検証を続ける
+	server.Close()
+	if _, err := p.Key(server.URL, "new", expired.Add(2*jwksCacheTTL)); err != nil {
+		t.Errorf("want stale key while JWKS is unreachable, got %v", err)
+	}
+	if _, err := p.Key(server.URL, "unknown", expired.Add(3*jwksCacheTTL)); err == nil {
+		t.Error("want error for unknown kid while JWKS is unreachable")
+	} else if _, ok := err.(*jwksFetchError); !ok {
+		t.Errorf("want *jwksFetchError, got %#v", err)
+	}
+}
+
+func TestParseJIAJWTLegacyKeyUntil(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Time{}},
+		{in: "1700000000", want: time.Unix(1700000000, 0)},
+		{in: "2027-04-01T00:00:00+09:00", want: time.Date(2027, 3, 31, 15, 0, 0, 0, time.UTC)},
+		{in: "tomorrow", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseJIAJWTLegacyKeyUntil(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseJIAJWTLegacyKeyUntil(%q) error = %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseJIAJWTLegacyKeyUntil(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
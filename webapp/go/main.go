@@ -1,25 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-sql-driver/mysql"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -40,15 +42,17 @@ const (
 	scoreConditionLevelInfo     = 3
 	scoreConditionLevelWarning  = 2
 	scoreConditionLevelCritical = 1
+	shutdownTimeout             = 30 * time.Second
 )
 
 var (
 	db                  *sqlx.DB
-	sessionStore        sessions.Store
 	mySQLConnectionData *MySQLConnectionEnv
 
 	jiaJWTSigningKey *ecdsa.PublicKey
 
+	conditionIngest *conditionIngester
+
 	postIsuConditionTargetBaseURL string // JIAへのactivate時に登録する，ISUがconditionを送る先のURL
 )
 
@@ -58,36 +62,49 @@ type Config struct {
 }
 
 type Isu struct {
-	ID         int       `db:"id" json:"id"`
-	JIAIsuUUID string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
-	Name       string    `db:"name" json:"name"`
-	Image      []byte    `db:"image" json:"-"`
-	Character  string    `db:"character" json:"character"`
-	JIAUserID  string    `db:"jia_user_id" json:"-"`
-	CreatedAt  time.Time `db:"created_at" json:"-"`
-	UpdatedAt  time.Time `db:"updated_at" json:"-"`
-}
-
-type IsuFromJIA struct {
-	Character string `json:"character"`
+	ID             int       `db:"id" json:"id"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Name           string    `db:"name" json:"name"`
+	Image          []byte    `db:"image" json:"-"`
+	Character      string    `db:"character" json:"character"`
+	JIAUserID      string    `db:"jia_user_id" json:"-"`
+	CreatedAt      time.Time `db:"created_at" json:"-"`
+	UpdatedAt      time.Time `db:"updated_at" json:"-"`
+	Status         string    `db:"-" json:"status"`
+	LastSeenAt     *int64    `db:"-" json:"last_seen_at"`
+	Role           string    `db:"-" json:"role"`
+	OrganizationID *int64    `db:"-" json:"organization_id"`
+	// アクティベートの状態 (pending, active, failed)
+	ActivationStatus        string  `db:"-" json:"activation_status"`
+	ActivationFailureReason *string `db:"-" json:"activation_failure_reason"`
 }
 
 type GetIsuListResponse struct {
-	ID                 int                      `json:"id"`
-	JIAIsuUUID         string                   `json:"jia_isu_uuid"`
-	Name               string                   `json:"name"`
-	Character          string                   `json:"character"`
-	LatestIsuCondition *GetIsuConditionResponse `json:"latest_isu_condition"`
+	ID                      int                      `json:"id"`
+	JIAIsuUUID              string                   `json:"jia_isu_uuid"`
+	Name                    string                   `json:"name"`
+	Character               string                   `json:"character"`
+	LatestIsuCondition      *GetIsuConditionResponse `json:"latest_isu_condition"`
+	Status                  string                   `json:"status"`
+	LastSeenAt              *int64                   `json:"last_seen_at"`
+	Role                    string                   `json:"role"`
+	OrganizationID          *int64                   `json:"organization_id"`
+	ActivationStatus        string                   `json:"activation_status"`
+	ActivationFailureReason *string                  `json:"activation_failure_reason"`
 }
 
 type IsuCondition struct {
-	ID         int       `db:"id"`
-	JIAIsuUUID string    `db:"jia_isu_uuid"`
-	Timestamp  time.Time `db:"timestamp"`
-	IsSitting  bool      `db:"is_sitting"`
-	Condition  string    `db:"condition"`
-	Message    string    `db:"message"`
-	CreatedAt  time.Time `db:"created_at"`
+	ID             int       `db:"id"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid"`
+	Timestamp      time.Time `db:"timestamp"`
+	IsSitting      bool      `db:"is_sitting"`
+	Condition      string    `db:"condition"`
+	IsDirty        bool      `db:"is_dirty"`
+	IsOverweight   bool      `db:"is_overweight"`
+	IsBroken       bool      `db:"is_broken"`
+	ConditionLevel string    `db:"condition_level"`
+	Message        string    `db:"message"`
+	CreatedAt      time.Time `db:"created_at"`
 }
 
 type MySQLConnectionEnv struct {
@@ -108,6 +125,7 @@ type InitializeResponse struct {
 
 type GetMeResponse struct {
 	JIAUserID string `json:"jia_user_id"`
+	Timezone  string `json:"timezone"`
 }
 
 type GraphResponse struct {
@@ -122,28 +140,18 @@ type GraphDataPoint struct {
 	Percentage ConditionsPercentage `json:"percentage"`
 }
 
-type ConditionsPercentage struct {
-	Sitting      int `json:"sitting"`
-	IsBroken     int `json:"is_broken"`
-	IsDirty      int `json:"is_dirty"`
-	IsOverweight int `json:"is_overweight"`
-}
-
-type GraphDataPointWithInfo struct {
-	JIAIsuUUID          string
-	StartAt             time.Time
-	Data                GraphDataPoint
-	ConditionTimestamps []int64
-}
+// "sitting" と isu_condition_key に登録された各項目の割合
+type ConditionsPercentage map[string]int
 
 type GetIsuConditionResponse struct {
-	JIAIsuUUID     string `json:"jia_isu_uuid"`
-	IsuName        string `json:"isu_name"`
-	Timestamp      int64  `json:"timestamp"`
-	IsSitting      bool   `json:"is_sitting"`
-	Condition      string `json:"condition"`
-	ConditionLevel string `json:"condition_level"`
-	Message        string `json:"message"`
+	JIAIsuUUID     string      `json:"jia_isu_uuid"`
+	IsuName        string      `json:"isu_name"`
+	Timestamp      int64       `json:"timestamp"`
+	IsSitting      bool        `json:"is_sitting"`
+	Condition      interface{} `json:"condition"`
+	ConditionLevel string      `json:"condition_level"`
+	Message        string      `json:"message"`
+	LocalTime      string      `json:"local_time,omitempty"`
 }
 
 type TrendResponse struct {
@@ -159,15 +167,17 @@ type TrendCondition struct {
 }
 
 type PostIsuConditionRequest struct {
-	IsSitting bool   `json:"is_sitting"`
-	Condition string `json:"condition"`
-	Message   string `json:"message"`
-	Timestamp int64  `json:"timestamp"`
+	IsSitting bool            `json:"is_sitting"`
+	Condition ConditionValues `json:"condition"`
+	Message   string          `json:"message"`
+	Timestamp int64           `json:"timestamp"`
 }
 
-type JIAServiceRequest struct {
-	TargetBaseURL string `json:"target_base_url"`
-	IsuUUID       string `json:"isu_uuid"`
+// accepted は書き込み待ちのキューに積んだ件数
+// 同時に届いた再送などは書き込み時にも除かれるので、保存される件数はこれ以下になる
+type PostIsuConditionResponse struct {
+	Accepted   int `json:"accepted"`
+	Duplicated int `json:"duplicated"`
 }
 
 func getEnv(key string, defaultValue string) string {
@@ -194,8 +204,6 @@ func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
 }
 
 func init() {
-	sessionStore = sessions.NewCookieStore([]byte(getEnv("SESSION_KEY", "isucondition")))
-
 	key, err := ioutil.ReadFile(jiaJWTSigningKeyPath)
 	if err != nil {
 		log.Fatalf("failed to read file: %v", err)
@@ -204,9 +212,21 @@ func init() {
 	if err != nil {
 		log.Fatalf("failed to parse ECDSA public key: %v", err)
 	}
+	jiaJWTLegacyKeyUntil, err = parseJIAJWTLegacyKeyUntil(os.Getenv("JIA_JWT_LEGACY_KEY_UNTIL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookAllowedNetworks, err = parseWebhookAllowedNetworks(os.Getenv("WEBHOOK_ALLOWED_NETWORKS"))
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
@@ -219,16 +239,48 @@ func main() {
 	e.POST("/api/auth", postAuthentication)
 	e.POST("/api/signout", postSignout)
 	e.GET("/api/user/me", getMe)
+	e.PUT("/api/user/me/timezone", putTimezone)
+	e.GET("/api/user/me/session", getUserSessions)
+	e.DELETE("/api/user/me/session", deleteUserSessions)
+	e.DELETE("/api/user/me/session/:session_id", deleteUserSession)
+	e.GET("/api/user/me/token", getAPITokens)
+	e.POST("/api/user/me/token", postAPIToken)
+	e.DELETE("/api/user/me/token/:token_id", deleteAPIToken)
 	e.GET("/api/isu", getIsuList)
 	e.POST("/api/isu", postIsu)
+	e.POST("/api/isu/bulk", postIsuBulk)
+	e.GET("/api/isu/bulk/:import_id", getIsuBulk)
+	e.GET("/api/isu/conditions/export", getConditionsExport)
 	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
+	e.PATCH("/api/isu/:jia_isu_uuid", patchIsu)
+	e.DELETE("/api/isu/:jia_isu_uuid", deleteIsu)
+	e.POST("/api/isu/:jia_isu_uuid/activation", postIsuActivation)
+	e.GET("/api/isu/:jia_isu_uuid/member", getIsuMembers)
+	e.PUT("/api/isu/:jia_isu_uuid/member/:jia_user_id", putIsuMember)
+	e.DELETE("/api/isu/:jia_isu_uuid/member/:jia_user_id", deleteIsuMember)
+	e.POST("/api/organization", postOrganization)
+	e.GET("/api/organization", getOrganizations)
+	e.GET("/api/organization/:organization_id/member", getOrganizationMembers)
+	e.PUT("/api/organization/:organization_id/member/:jia_user_id", putOrganizationMember)
+	e.DELETE("/api/organization/:organization_id/member/:jia_user_id", deleteOrganizationMember)
 	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
 	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
+	e.GET("/api/isu/:jia_isu_uuid/conditions/export", getIsuConditionsExport)
+	e.GET("/api/isu/:jia_isu_uuid/stream", getIsuConditionStream)
+	e.GET("/api/isu/:jia_isu_uuid/stream/ws", getIsuConditionWebSocket)
 	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
 	e.GET("/api/trend", getTrend)
+	e.GET("/api/condition_key", getConditionKeys)
+	e.GET("/api/alert_rule", getAlertRules)
+	e.POST("/api/alert_rule", postAlertRule)
+	e.GET("/api/alert_rule/:alert_rule_id", getAlertRule)
+	e.DELETE("/api/alert_rule/:alert_rule_id", deleteAlertRule)
+	e.GET("/api/alert_rule/:alert_rule_id/delivery", getAlertRuleDeliveries)
 
 	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
 
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+
 	e.GET("/", getIndex)
 	e.GET("/isu/:jia_isu_uuid", getIndex)
 	e.GET("/isu/:jia_isu_uuid/condition", getIndex)
@@ -247,53 +299,78 @@ func main() {
 	db.SetMaxOpenConns(10)
 	defer db.Close()
 
+	err = conditionRegistry.Load(db)
+	if err != nil {
+		e.Logger.Fatalf("failed to load condition keys: %v", err)
+		return
+	}
+
+	err = initIconStore()
+	if err != nil {
+		e.Logger.Fatal(err)
+		return
+	}
+
 	postIsuConditionTargetBaseURL = os.Getenv("POST_ISUCONDITION_TARGET_BASE_URL")
 	if postIsuConditionTargetBaseURL == "" {
 		e.Logger.Fatalf("missing: POST_ISUCONDITION_TARGET_BASE_URL")
 		return
 	}
 
-	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
-	e.Logger.Fatal(e.Start(serverPort))
-}
+	conditionIngest = newConditionIngester(conditionQueueCapacity, insertIsuConditions, evaluateAlertRules)
+	expvar.Publish("condition_ingest", expvar.Func(func() interface{} { return conditionIngest.Metrics() }))
+	go conditionIngest.Run()
+
+	backgroundCtx, stopBackgroundWorkers := context.WithCancel(context.Background())
+	go runAlertWorker(backgroundCtx)
+	go runWebhookDeliveryWorker(backgroundCtx)
+	go runIsuStatusChecker(backgroundCtx)
+	go runIsuActivationWorker(backgroundCtx)
 
-func getSession(r *http.Request) (*sessions.Session, error) {
-	session, err := sessionStore.Get(r, sessionName)
+	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
+	go func() {
+		err := e.Start(serverPort)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	stopBackgroundWorkers()
+	// 配信中の接続は終わらないので、先に閉じておかないと Shutdown が待ち続ける
+	conditionStreams.Close()
+	err = e.Shutdown(ctx)
 	if err != nil {
-		return nil, err
+		e.Logger.Errorf("failed to shutdown server: %v", err)
+	}
+	// 受け付け済みのコンディションを書き切ってから終了する
+	err = conditionIngest.Close(ctx)
+	if err != nil {
+		e.Logger.Errorf("failed to flush isu_condition: %v", err)
 	}
-	return session, nil
 }
 
 func getUserIDFromSession(c echo.Context) (string, int, error) {
-	session, err := getSession(c.Request())
-	if err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("failed to get session: %v", err)
+	if token, ok := getBearerAPIToken(c); ok {
+		return authenticateAPIToken(c, token, time.Now())
 	}
-	_jiaUserID, ok := session.Values["jia_user_id"]
-	if !ok {
-		return "", http.StatusUnauthorized, fmt.Errorf("no session")
-	}
-
-	jiaUserID := _jiaUserID.(string)
-	var count int
 
-	err = db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?",
-		jiaUserID)
+	session, errStatusCode, err := getCurrentSession(c)
 	if err != nil {
-		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+		return "", errStatusCode, err
 	}
 
-	if count == 0 {
-		return "", http.StatusUnauthorized, fmt.Errorf("not found: user")
-	}
-
-	return jiaUserID, 0, nil
+	return session.JIAUserID, 0, nil
 }
 
-func getJIAServiceURL(tx *sqlx.Tx) string {
+func getJIAServiceURL(q sqlx.Queryer) string {
 	var config Config
-	err := tx.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
+	err := sqlx.Get(q, &config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			log.Print(err)
@@ -312,6 +389,11 @@ func postInitialize(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
+	conditionIngest.Discard()
+	isuLastSeen.Reset()
+	jiaKeys.Reset()
+	userSessions.Reset()
+
 	cmd := exec.Command("../sql/init.sh")
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stderr
@@ -331,6 +413,18 @@ func postInitialize(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	err = conditionRegistry.Load(db)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = rebuildGraphHourly(db, "")
+	if err != nil {
+		c.Logger().Errorf("failed to rebuild isu_graph_hourly: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
@@ -341,15 +435,14 @@ func postInitialize(c echo.Context) error {
 func postAuthentication(c echo.Context) error {
 	reqJwt := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
 
-	token, err := jwt.Parse(reqJwt, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
-			return nil, jwt.NewValidationError(fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), jwt.ValidationErrorSignatureInvalid)
-		}
-		return jiaJWTSigningKey, nil
-	})
+	claims, err := parseJIAToken(reqJwt, getJIAServiceURL(db), time.Now())
 	if err != nil {
-		switch err.(type) {
+		switch err := err.(type) {
 		case *jwt.ValidationError:
+			if fetchErr, ok := err.Inner.(*jwksFetchError); ok {
+				c.Logger().Error(fetchErr)
+				return c.NoContent(http.StatusInternalServerError)
+			}
 			return c.String(http.StatusForbidden, "forbidden")
 		default:
 			c.Logger().Error(err)
@@ -357,11 +450,6 @@ func postAuthentication(c echo.Context) error {
 		}
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		c.Logger().Errorf("invalid JWT payload")
-		return c.NoContent(http.StatusInternalServerError)
-	}
 	jiaUserIDVar, ok := claims["jia_user_id"]
 	if !ok {
 		return c.String(http.StatusBadRequest, "invalid JWT payload")
@@ -377,18 +465,20 @@ func postAuthentication(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	session, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	// セッション固定攻撃を防ぐため、ログインのたびにセッションを作り直す
+	if current, _, err := getCurrentSession(c); err == nil {
+		_, err = userSessions.Revoke(current.JIAUserID, current.ID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 	}
-
-	session.Values["jia_user_id"] = jiaUserID
-	err = session.Save(c.Request(), c.Response())
+	token, err := userSessions.Create(jiaUserID, c.Request().UserAgent(), c.RealIP(), time.Now())
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	setSessionCookie(c, token)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -396,7 +486,7 @@ func postAuthentication(c echo.Context) error {
 // POST /api/signout
 // サインアウト
 func postSignout(c echo.Context) error {
-	_, errStatusCode, err := getUserIDFromSession(c)
+	session, errStatusCode, err := getCurrentSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
@@ -406,18 +496,12 @@ func postSignout(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	session, err := getSession(c.Request())
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	session.Options = &sessions.Options{MaxAge: -1, Path: "/"}
-	err = session.Save(c.Request(), c.Response())
+	_, err = userSessions.Revoke(session.JIAUserID, session.ID)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	clearSessionCookie(c)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -430,12 +514,21 @@ func getMe(c echo.Context) error {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
+	timezone, err := getUserTimezone(jiaUserID)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	res := GetMeResponse{JIAUserID: jiaUserID}
+	res := GetMeResponse{JIAUserID: jiaUserID, Timezone: timezone}
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -447,11 +540,19 @@ func getIsuList(c echo.Context) error {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	organizationID, err := parseOrganizationID(c.QueryParam("organization_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
 	tx, err := db.Beginx()
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
@@ -459,15 +560,49 @@ func getIsuList(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	isuList := []Isu{}
-	err = tx.Select(
-		&isuList,
-		"SELECT * FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
-		jiaUserID)
+	// 組織を指定した場合はその組織のISUのみ
+	query := "SELECT `isu`.*, " + isuGrantColumns + " FROM `isu`" + isuGrantJoin +
+		"	WHERE (`isu`.`jia_user_id` = ? OR `isu_acl`.`role` IS NOT NULL OR `organization_member`.`role` IS NOT NULL)"
+	args := []interface{}{jiaUserID, jiaUserID, jiaUserID}
+	if organizationID != nil {
+		_, errStatusCode, err = authorizeOrganization(tx, jiaUserID, *organizationID, organizationRoleViewer)
+		if err != nil {
+			if errStatusCode == http.StatusInternalServerError {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.String(errStatusCode, err.Error())
+		}
+		query += " AND `isu_organization`.`organization_id` = ?"
+		args = append(args, *organizationID)
+	}
+	rows := []struct {
+		Isu
+		isuGrant
+	}{}
+	err = tx.Select(&rows, query+" ORDER BY `isu`.`id` DESC", args...)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	isuList := make([]Isu, 0, len(rows))
+	for _, row := range rows {
+		isu := row.Isu
+		isu.Role = row.role(isu.JIAUserID, jiaUserID)
+		isu.OrganizationID = row.isuGrant.OrganizationID
+		isuList = append(isuList, isu)
+	}
+
+	statuses, err := getIsuStatuses(tx, isuList)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	activations, err := getIsuActivations(tx, isuList)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	responseList := []GetIsuListResponse{}
 	for _, isu := range isuList {
@@ -486,29 +621,32 @@ func getIsuList(c echo.Context) error {
 
 		var formattedCondition *GetIsuConditionResponse
 		if foundLastCondition {
-			conditionLevel, err := calculateConditionLevel(lastCondition.Condition)
-			if err != nil {
-				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-
 			formattedCondition = &GetIsuConditionResponse{
 				JIAIsuUUID:     lastCondition.JIAIsuUUID,
 				IsuName:        isu.Name,
 				Timestamp:      lastCondition.Timestamp.Unix(),
 				IsSitting:      lastCondition.IsSitting,
 				Condition:      lastCondition.Condition,
-				ConditionLevel: conditionLevel,
+				ConditionLevel: lastCondition.ConditionLevel,
 				Message:        lastCondition.Message,
 			}
 		}
 
 		res := GetIsuListResponse{
-			ID:                 isu.ID,
-			JIAIsuUUID:         isu.JIAIsuUUID,
-			Name:               isu.Name,
-			Character:          isu.Character,
-			LatestIsuCondition: formattedCondition}
+			ID:                      isu.ID,
+			JIAIsuUUID:              isu.JIAIsuUUID,
+			Name:                    isu.Name,
+			Character:               isu.Character,
+			LatestIsuCondition:      formattedCondition,
+			Status:                  statuses[isu.JIAIsuUUID].Status,
+			Role:                    isu.Role,
+			OrganizationID:          isu.OrganizationID,
+			ActivationStatus:        activations[isu.JIAIsuUUID].Status,
+			ActivationFailureReason: activations[isu.JIAIsuUUID].FailureReason}
+		if lastSeenAt := statuses[isu.JIAIsuUUID].LastSeenAt; lastSeenAt != nil {
+			unix := lastSeenAt.Unix()
+			res.LastSeenAt = &unix
+		}
 		responseList = append(responseList, res)
 	}
 
@@ -523,51 +661,62 @@ func getIsuList(c echo.Context) error {
 
 // POST /api/isu
 // ISUを登録
+// JIA でのアクティベートはワーカーが非同期に行うので、activation_status が pending のまま 202 を返す
 func postIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	useDefaultImage := false
-
 	jiaIsuUUID := c.FormValue("jia_isu_uuid")
 	isuName := c.FormValue("isu_name")
-	fh, err := c.FormFile("image")
+	organizationID, err := parseOrganizationID(c.FormValue("organization_id"))
 	if err != nil {
-		if !errors.Is(err, http.ErrMissingFile) {
-			return c.String(http.StatusBadRequest, "bad format: icon")
-		}
-		useDefaultImage = true
+		return c.String(http.StatusBadRequest, err.Error())
 	}
+	image, thumbnails, errStatusCode, err := readIsuImageForm(c)
+	if err != nil {
+		if errStatusCode != http.StatusInternalServerError {
+			return c.String(errStatusCode, err.Error())
+		}
 
-	var image []byte
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-	if useDefaultImage {
+	if image == nil {
 		image, err = ioutil.ReadFile(defaultIconFilePath)
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-	} else {
-		file, err := fh.Open()
+		thumbnails, err = makeIconThumbnails(image)
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-		defer file.Close()
+	}
 
-		image, err = ioutil.ReadAll(file)
+	// アイコンの実体はトランザクションの外に保存されるので、確定しなかった場合は参照されていないものを消す
+	storedBlobKeys := []string{}
+	committed := false
+	defer func() {
+		if committed || len(storedBlobKeys) == 0 {
+			return
+		}
+		err := removeUnreferencedIconBlobs(storedBlobKeys)
 		if err != nil {
-			c.Logger().Error(err)
-			return c.NoContent(http.StatusInternalServerError)
+			c.Logger().Errorf("failed to clean up icons: %v", err)
 		}
-	}
+	}()
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -576,83 +725,168 @@ func postIsu(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec("INSERT INTO `isu`"+
-		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
-		jiaIsuUUID, isuName, image, jiaUserID)
-	if err != nil {
-		mysqlErr, ok := err.(*mysql.MySQLError)
+	// 組織のISUとして登録できるのは編集者以上
+	if organizationID != nil {
+		_, errStatusCode, err = authorizeOrganization(tx, jiaUserID, *organizationID, organizationRoleEditor)
+		if err != nil {
+			if errStatusCode == http.StatusInternalServerError {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.String(errStatusCode, err.Error())
+		}
+	}
 
-		if ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
-			return c.String(http.StatusConflict, "duplicated: isu")
+	storedBlobKeys, errStatusCode, err = registerIsu(tx, jiaUserID, jiaIsuUUID, isuName, organizationID, image, thumbnails)
+	if err != nil {
+		if errStatusCode == http.StatusConflict {
+			return c.String(http.StatusConflict, err.Error())
 		}
 
-		c.Logger().Errorf("db error: %v", err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	targetURL := getJIAServiceURL(tx) + "/api/activate"
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
-	bodyJSON, err := json.Marshal(body)
+	var isu Isu
+	err = tx.Get(
+		&isu,
+		"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
 	if err != nil {
-		c.Logger().Error(err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	isu.Role = isuRoleOwner
+	isu.OrganizationID = organizationID
 
-	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodyJSON))
+	err = fillIsuStatus(tx, &isu)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	reqJIA.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(reqJIA)
+	err = tx.Commit()
 	if err != nil {
-		c.Logger().Errorf("failed to request to JIAService: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	defer res.Body.Close()
+	committed = true
+	notifyIsuActivation()
+
+	return c.JSON(http.StatusAccepted, isu)
+}
 
-	resBody, err := ioutil.ReadAll(res.Body)
+// ISUと付随する行を登録し、アクティベート待ちにする
+// サムネイルはトランザクションを始める前に makeIconThumbnails で作っておく
+// iconStore に保存したアイコンのキーを返す (トランザクションが確定しなかった場合は呼び出し側で removeUnreferencedIconBlobs に渡す)
+// 既に登録されているISUの場合は 409 を返す
+func registerIsu(tx *sqlx.Tx, jiaUserID string, jiaIsuUUID string, isuName string, organizationID *int64, image []byte, thumbnails []iconThumbnail) ([]string, int, error) {
+	storedBlobKeys := []string{}
+
+	// character はアクティベートが済むまで空文字にしておく
+	_, err := tx.Exec("INSERT INTO `isu`"+
+		"	(`jia_isu_uuid`, `name`, `character`, `jia_user_id`) VALUES (?, ?, '', ?)",
+		jiaIsuUUID, isuName, jiaUserID)
 	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		mysqlErr, ok := err.(*mysql.MySQLError)
+
+		if ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return storedBlobKeys, http.StatusConflict, fmt.Errorf("duplicated: isu")
+		}
+
+		return storedBlobKeys, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
 	}
 
-	if res.StatusCode != http.StatusAccepted {
-		c.Logger().Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
-		return c.String(res.StatusCode, "JIAService returned error")
+	if organizationID != nil {
+		_, err = tx.Exec(
+			"INSERT INTO `isu_organization` (`jia_isu_uuid`, `organization_id`, `registered_by`) VALUES (?, ?, ?)",
+			jiaIsuUUID, *organizationID, jiaUserID)
+		if err != nil {
+			return storedBlobKeys, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+		}
 	}
 
-	var isuFromJIA IsuFromJIA
-	err = json.Unmarshal(resBody, &isuFromJIA)
+	contentType, err := sniffIconContentType(image)
 	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return storedBlobKeys, http.StatusInternalServerError, err
+	}
+	key, err := saveIsuIcon(tx, jiaIsuUUID, image, contentType)
+	if key != "" {
+		storedBlobKeys = append(storedBlobKeys, key)
+	}
+	if err != nil {
+		return storedBlobKeys, http.StatusInternalServerError, err
+	}
+	keys, err := saveIsuIconVariants(tx, jiaIsuUUID, thumbnails)
+	storedBlobKeys = append(storedBlobKeys, keys...)
+	if err != nil {
+		return storedBlobKeys, http.StatusInternalServerError, err
 	}
 
-	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
+	deviceSecret, err := generateDeviceSecret()
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return storedBlobKeys, http.StatusInternalServerError, err
+	}
+	_, err = tx.Exec("INSERT INTO `isu_device_credential` (`jia_isu_uuid`, `secret`) VALUES (?, ?)"+
+		" ON DUPLICATE KEY UPDATE `secret` = VALUES(`secret`)",
+		jiaIsuUUID, deviceSecret)
+	if err != nil {
+		return storedBlobKeys, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
 	}
 
-	var isu Isu
-	err = tx.Get(
-		&isu,
-		"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	// アクティベートはワーカーが行う
+	now := time.Now()
+	_, err = tx.Exec(
+		"INSERT INTO `isu_activation` (`jia_isu_uuid`, `status`, `next_attempt_at`, `created_at`, `updated_at`)"+
+			"	VALUES (?, ?, ?, ?, ?)",
+		jiaIsuUUID, isuActivationStatusPending, now, now, now)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return storedBlobKeys, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
 	}
+	return storedBlobKeys, 0, nil
+}
 
-	err = tx.Commit()
+// ISUの登録・更新フォームからアイコン画像を読み込み、サムネイルを作る
+// 画像が送られていない場合は nil を返す
+// JPEG, PNG, WebP 以外の画像、最後まで読めない画像、iconMaxBytes または iconMaxDimension を超える画像は受け付けない
+func readIsuImageForm(c echo.Context) ([]byte, []iconThumbnail, int, error) {
+	fh, err := c.FormFile("image")
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		if errors.Is(err, http.ErrMissingFile) {
+			return nil, nil, 0, nil
+		}
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("bad format: icon")
+	}
+	if fh.Size > iconMaxBytes {
+		return nil, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("too large: icon")
 	}
 
-	return c.JSON(http.StatusCreated, isu)
+	file, err := fh.Open()
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	defer file.Close()
+
+	image, err := ioutil.ReadAll(io.LimitReader(file, iconMaxBytes+1))
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	if len(image) > iconMaxBytes {
+		return nil, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("too large: icon")
+	}
+	_, err = sniffIconContentType(image)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("bad format: icon")
+	}
+	img, format, err := decodeIconImage(image)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	thumbnails, err := makeIconThumbnailsFromImage(image, img, format)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	return image, thumbnails, 0, nil
 }
 
 // GET /api/isu/:jia_isu_uuid
@@ -663,6 +897,9 @@ func getIsuID(c echo.Context) error {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -670,9 +907,17 @@ func getIsuID(c echo.Context) error {
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
 	var res Isu
-	err = db.Get(&res, "SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	err = db.Get(&res, "SELECT * FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
@@ -681,6 +926,14 @@ func getIsuID(c echo.Context) error {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	res.Role = access.Role
+	res.OrganizationID = access.OrganizationID
+
+	err = fillIsuStatus(db, &res)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	return c.JSON(http.StatusOK, res)
 }
@@ -693,6 +946,9 @@ func getIsuIcon(c echo.Context) error {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -700,9 +956,37 @@ func getIsuIcon(c echo.Context) error {
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
-	var image []byte
-	err = db.Get(&image, "SELECT `image` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	size := 0
+	if sizeStr := c.QueryParam("size"); sizeStr != "" {
+		size, err = strconv.Atoi(sizeStr)
+		if err != nil || !isIconThumbnailSize(size) {
+			return c.String(http.StatusBadRequest, "bad format: size")
+		}
+	}
+
+	_, errStatusCode, err = authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	var icon struct {
+		Image              []byte  `db:"image"`
+		BlobKey            *string `db:"blob_key"`
+		ContentType        *string `db:"content_type"`
+		VariantBlobKey     *string `db:"variant_blob_key"`
+		VariantContentType *string `db:"variant_content_type"`
+	}
+	err = db.Get(&icon,
+		"SELECT `isu`.`image`, `isu_icon`.`blob_key`, `isu_icon`.`content_type`,"+
+			"	`isu_icon_variant`.`blob_key` AS `variant_blob_key`, `isu_icon_variant`.`content_type` AS `variant_content_type`"+
+			"	FROM `isu` LEFT JOIN `isu_icon` ON `isu_icon`.`jia_isu_uuid` = `isu`.`jia_isu_uuid`"+
+			"	LEFT JOIN `isu_icon_variant` ON `isu_icon_variant`.`jia_isu_uuid` = `isu`.`jia_isu_uuid` AND `isu_icon_variant`.`size` = ?"+
+			"	WHERE `isu`.`jia_isu_uuid` = ?",
+		size, jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
@@ -712,7 +996,38 @@ func getIsuIcon(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.Blob(http.StatusOK, "", image)
+	// サムネイルがまだ作られていなければ元の画像を返す
+	// migrate-icons で移行されていないアイコンは isu.image から返す
+	image := icon.Image
+	var key, contentType string
+	fromStore := true
+	switch {
+	case icon.VariantBlobKey != nil:
+		key, contentType = *icon.VariantBlobKey, *icon.VariantContentType
+	case icon.BlobKey != nil:
+		key, contentType = *icon.BlobKey, *icon.ContentType
+	default:
+		key, contentType = iconBlobKey(image), http.DetectContentType(image)
+		fromStore = false
+	}
+
+	// キーは内容のハッシュなので、アイコンが変わると ETag も変わる
+	etag := fmt.Sprintf("\"%s\"", key)
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if fromStore {
+		image, err = iconStore.Get(key)
+		if err != nil {
+			c.Logger().Errorf("failed to get icon: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return c.Blob(http.StatusOK, contentType, image)
 }
 
 // GET /api/isu/:jia_isu_uuid/graph
@@ -723,21 +1038,30 @@ func getIsuGraph(c echo.Context) error {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	jiaIsuUUID := c.Param("jia_isu_uuid")
-	datetimeStr := c.QueryParam("datetime")
-	if datetimeStr == "" {
-		return c.String(http.StatusBadRequest, "missing: datetime")
+	loc, _, errStatusCode, err := resolveLocation(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusBadRequest {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
-	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	period, err := parseGraphRange(c.QueryParam("datetime"), c.QueryParam("range"),
+		c.QueryParam("interval"), c.QueryParam("end_datetime"), loc)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad format: datetime")
+		return c.String(http.StatusBadRequest, err.Error())
 	}
-	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -746,18 +1070,20 @@ func getIsuGraph(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	access, errStatusCode, err := authorizeIsu(tx, jiaUserID, jiaIsuUUID, isuRoleViewer)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
 	}
-	if count == 0 {
-		return c.String(http.StatusNotFound, "not found: isu")
+	errStatusCode, err = checkOrganizationScope(c, access)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
 	}
 
-	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, date)
+	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, period)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -772,170 +1098,83 @@ func getIsuGraph(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
-// グラフのデータ点を一日分生成
-func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
-	dataPoints := []GraphDataPointWithInfo{}
-	conditionsInThisHour := []IsuCondition{}
-	timestampsInThisHour := []int64{}
-	var startTimeInThisHour time.Time
-	var condition IsuCondition
-
-	rows, err := tx.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` ASC", jiaIsuUUID)
-	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
-	}
-
-	for rows.Next() {
-		err = rows.StructScan(&condition)
+// グラフのデータ点を指定した期間分生成
+func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, period graphRange) ([]GraphResponse, error) {
+	// 区切りが正時 (UTC) に揃っている場合は1時間ごとの集計値を、揃っていない場合は生データを使う
+	var hourlyList []*graphAggregate
+	var hourlyStartAt []time.Time
+	if period.alignedToHour() {
+		rows, err := getGraphHourly(tx, jiaIsuUUID, period.StartAt, period.EndAt)
 		if err != nil {
 			return nil, err
 		}
-
-		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
-		if truncatedConditionTime != startTimeInThisHour {
-			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
-				if err != nil {
-					return nil, err
-				}
-
-				dataPoints = append(dataPoints,
-					GraphDataPointWithInfo{
-						JIAIsuUUID:          jiaIsuUUID,
-						StartAt:             startTimeInThisHour,
-						Data:                data,
-						ConditionTimestamps: timestampsInThisHour})
+		for _, row := range rows {
+			agg, err := row.aggregate()
+			if err != nil {
+				return nil, err
 			}
-
-			startTimeInThisHour = truncatedConditionTime
-			conditionsInThisHour = []IsuCondition{}
-			timestampsInThisHour = []int64{}
+			hourlyList = append(hourlyList, agg)
+			hourlyStartAt = append(hourlyStartAt, row.StartAt)
 		}
-		conditionsInThisHour = append(conditionsInThisHour, condition)
-		timestampsInThisHour = append(timestampsInThisHour, condition.Timestamp.Unix())
-	}
-
-	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
+	} else {
+		conditions := []IsuCondition{}
+		err := tx.Select(&conditions,
+			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
+				"	AND ? <= `timestamp` AND `timestamp` < ?"+
+				"	ORDER BY `timestamp` ASC",
+			jiaIsuUUID, period.StartAt, period.EndAt)
 		if err != nil {
-			return nil, err
-		}
-
-		dataPoints = append(dataPoints,
-			GraphDataPointWithInfo{
-				JIAIsuUUID:          jiaIsuUUID,
-				StartAt:             startTimeInThisHour,
-				Data:                data,
-				ConditionTimestamps: timestampsInThisHour})
-	}
-
-	endTime := graphDate.Add(time.Hour * 24)
-	startIndex := len(dataPoints)
-	endNextIndex := len(dataPoints)
-	for i, graph := range dataPoints {
-		if startIndex == len(dataPoints) && !graph.StartAt.Before(graphDate) {
-			startIndex = i
+			return nil, fmt.Errorf("db error: %v", err)
 		}
-		if endNextIndex == len(dataPoints) && graph.StartAt.After(endTime) {
-			endNextIndex = i
+		for _, cond := range conditions {
+			agg := newGraphAggregate()
+			err = agg.add(cond)
+			if err != nil {
+				return nil, err
+			}
+			hourlyList = append(hourlyList, agg)
+			hourlyStartAt = append(hourlyStartAt, cond.Timestamp)
 		}
 	}
 
-	filteredDataPoints := []GraphDataPointWithInfo{}
-	if startIndex < endNextIndex {
-		filteredDataPoints = dataPoints[startIndex:endNextIndex]
-	}
-
 	responseList := []GraphResponse{}
 	index := 0
-	thisTime := graphDate
+	thisTime := period.StartAt
+
+	for thisTime.Before(period.EndAt) {
+		nextTime := period.next(thisTime)
+		if nextTime.After(period.EndAt) {
+			nextTime = period.EndAt
+		}
 
-	for thisTime.Before(graphDate.Add(time.Hour * 24)) {
 		var data *GraphDataPoint
 		timestamps := []int64{}
 
-		if index < len(filteredDataPoints) {
-			dataWithInfo := filteredDataPoints[index]
-
-			if dataWithInfo.StartAt.Equal(thisTime) {
-				data = &dataWithInfo.Data
-				timestamps = dataWithInfo.ConditionTimestamps
-				index++
-			}
+		agg := newGraphAggregate()
+		for index < len(hourlyList) && hourlyStartAt[index].Before(nextTime) {
+			agg.merge(hourlyList[index])
+			index++
+		}
+		if agg.ConditionCount > 0 {
+			dataPoint := agg.dataPoint()
+			data = &dataPoint
+			timestamps = agg.ConditionTimestamps
 		}
 
 		resp := GraphResponse{
 			StartAt:             thisTime.Unix(),
-			EndAt:               thisTime.Add(time.Hour).Unix(),
+			EndAt:               nextTime.Unix(),
 			Data:                data,
 			ConditionTimestamps: timestamps,
 		}
 		responseList = append(responseList, resp)
 
-		thisTime = thisTime.Add(time.Hour)
+		thisTime = nextTime
 	}
 
 	return responseList, nil
 }
 
-// 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
-	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
-	rawScore := 0
-	for _, condition := range isuConditions {
-		badConditionsCount := 0
-
-		if !isValidConditionFormat(condition.Condition) {
-			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
-		}
-
-		for _, condStr := range strings.Split(condition.Condition, ",") {
-			keyValue := strings.Split(condStr, "=")
-
-			conditionName := keyValue[0]
-			if keyValue[1] == "true" {
-				conditionsCount[conditionName] += 1
-				badConditionsCount++
-			}
-		}
-
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
-	}
-
-	sittingCount := 0
-	for _, condition := range isuConditions {
-		if condition.IsSitting {
-			sittingCount++
-		}
-	}
-
-	isuConditionsLength := len(isuConditions)
-
-	score := rawScore * 100 / 3 / isuConditionsLength
-
-	sittingPercentage := sittingCount * 100 / isuConditionsLength
-	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
-	isOverweightPercentage := conditionsCount["is_overweight"] * 100 / isuConditionsLength
-	isDirtyPercentage := conditionsCount["is_dirty"] * 100 / isuConditionsLength
-
-	dataPoint := GraphDataPoint{
-		Score: score,
-		Percentage: ConditionsPercentage{
-			Sitting:      sittingPercentage,
-			IsBroken:     isBrokenPercentage,
-			IsOverweight: isOverweightPercentage,
-			IsDirty:      isDirtyPercentage,
-		},
-	}
-	return dataPoint, nil
-}
-
 // GET /api/condition/:jia_isu_uuid
 // ISUのコンディションを取得
 func getIsuConditions(c echo.Context) error {
@@ -944,6 +1183,9 @@ func getIsuConditions(c echo.Context) error {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -954,18 +1196,60 @@ func getIsuConditions(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
 
-	endTimeInt64, err := strconv.ParseInt(c.QueryParam("end_time"), 10, 64)
-	if err != nil {
-		return c.String(http.StatusBadRequest, "bad format: end_time")
+	var cursor *conditionCursor
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		cursor, err = decodeConditionCursor(cursorStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: cursor")
+		}
+	}
+
+	var endTime time.Time
+	endTimeStr := c.QueryParam("end_time")
+	if endTimeStr != "" || cursor == nil {
+		endTimeInt64, err := strconv.ParseInt(endTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: end_time")
+		}
+		endTime = time.Unix(endTimeInt64, 0)
 	}
-	endTime := time.Unix(endTimeInt64, 0)
 	conditionLevelCSV := c.QueryParam("condition_level")
 	if conditionLevelCSV == "" {
 		return c.String(http.StatusBadRequest, "missing: condition_level")
 	}
-	conditionLevel := map[string]interface{}{}
-	for _, level := range strings.Split(conditionLevelCSV, ",") {
-		conditionLevel[level] = struct{}{}
+	conditionLevels := strings.Split(conditionLevelCSV, ",")
+
+	limit := conditionLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+		if limit > conditionMaxLimit {
+			limit = conditionMaxLimit
+		}
+	}
+
+	conditionAsObject := false
+	switch c.QueryParam("condition_format") {
+	case "", "string":
+	case "object":
+		conditionAsObject = true
+	default:
+		return c.String(http.StatusBadRequest, "bad format: condition_format")
+	}
+
+	loc, locSpecified, errStatusCode, err := resolveLocation(c, jiaUserID)
+	if err != nil {
+		if errStatusCode == http.StatusBadRequest {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !locSpecified {
+		loc = nil
 	}
 
 	startTimeStr := c.QueryParam("start_time")
@@ -978,107 +1262,43 @@ func getIsuConditions(c echo.Context) error {
 		startTime = time.Unix(startTimeInt64, 0)
 	}
 
-	var isuName string
-	err = db.Get(&isuName,
-		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
-		jiaIsuUUID, jiaUserID,
-	)
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.String(http.StatusNotFound, "not found: isu")
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
 		}
-
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.String(errStatusCode, err.Error())
 	}
-
-	conditionsResponse, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, conditionLimit, isuName)
+	errStatusCode, err = checkOrganizationScope(c, access)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.String(errStatusCode, err.Error())
 	}
-	return c.JSON(http.StatusOK, conditionsResponse)
-}
-
-// ISUのコンディションをDBから取得
-func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time,
-	limit int, isuName string) ([]*GetIsuConditionResponse, error) {
-
-	conditions := []IsuCondition{}
-	var err error
 
-	if startTime.IsZero() {
-		err = db.Select(&conditions,
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	ORDER BY `timestamp` DESC",
-			jiaIsuUUID, endTime,
-		)
-	} else {
-		err = db.Select(&conditions,
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND ? <= `timestamp`"+
-				"	ORDER BY `timestamp` DESC",
-			jiaIsuUUID, endTime, startTime,
-		)
-	}
+	page, err := getIsuConditionsFromDB(db, conditionQuery{
+		JIAIsuUUID:      jiaIsuUUID,
+		EndTime:         endTime,
+		StartTime:       startTime,
+		ConditionLevels: conditionLevels,
+		Limit:           limit,
+		Cursor:          cursor,
+	}, access.Name, conditionAsObject, loc)
 	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
-	}
-
-	conditionsResponse := []*GetIsuConditionResponse{}
-	for _, c := range conditions {
-		cLevel, err := calculateConditionLevel(c.Condition)
-		if err != nil {
-			continue
-		}
-
-		if _, ok := conditionLevel[cLevel]; ok {
-			data := GetIsuConditionResponse{
-				JIAIsuUUID:     c.JIAIsuUUID,
-				IsuName:        isuName,
-				Timestamp:      c.Timestamp.Unix(),
-				IsSitting:      c.IsSitting,
-				Condition:      c.Condition,
-				ConditionLevel: cLevel,
-				Message:        c.Message,
-			}
-			conditionsResponse = append(conditionsResponse, &data)
-		}
-	}
-
-	if len(conditionsResponse) > limit {
-		conditionsResponse = conditionsResponse[:limit]
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return conditionsResponse, nil
-}
-
-// ISUのコンディションの文字列からコンディションレベルを計算
-func calculateConditionLevel(condition string) (string, error) {
-	var conditionLevel string
-
-	warnCount := strings.Count(condition, "=true")
-	switch warnCount {
-	case 0:
-		conditionLevel = conditionLevelInfo
-	case 1, 2:
-		conditionLevel = conditionLevelWarning
-	case 3:
-		conditionLevel = conditionLevelCritical
-	default:
-		return "", fmt.Errorf("unexpected warn count")
+	if link := page.linkHeader(c.Request().URL); link != "" {
+		c.Response().Header().Set("Link", link)
 	}
-
-	return conditionLevel, nil
+	return c.JSON(http.StatusOK, page.Conditions)
 }
 
 // GET /api/trend
 // ISUの性格毎の最新のコンディション情報
 func getTrend(c echo.Context) error {
 	characterList := []Isu{}
-	err := db.Select(&characterList, "SELECT `character` FROM `isu` GROUP BY `character`")
+	err := db.Select(&characterList, "SELECT `character` FROM `isu` WHERE `character` != '' GROUP BY `character`")
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1113,16 +1333,11 @@ func getTrend(c echo.Context) error {
 
 			if len(conditions) > 0 {
 				isuLastCondition := conditions[0]
-				conditionLevel, err := calculateConditionLevel(isuLastCondition.Condition)
-				if err != nil {
-					c.Logger().Error(err)
-					return c.NoContent(http.StatusInternalServerError)
-				}
 				trendCondition := TrendCondition{
 					ID:        isu.ID,
 					Timestamp: isuLastCondition.Timestamp.Unix(),
 				}
-				switch conditionLevel {
+				switch isuLastCondition.ConditionLevel {
 				case "info":
 					characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
 				case "warning":
@@ -1158,103 +1373,144 @@ func getTrend(c echo.Context) error {
 // POST /api/condition/:jia_isu_uuid
 // ISUからのコンディションを受け取る
 func postIsuCondition(c echo.Context) error {
-	// TODO: 一定割合リクエストを落としてしのぐようにしたが、本来は全量さばけるようにすべき
-	dropProbability := 0.9
-	if rand.Float64() <= dropProbability {
-		c.Logger().Warnf("drop post isu condition request")
-		return c.NoContent(http.StatusAccepted)
-	}
-
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 	if jiaIsuUUID == "" {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
 
-	req := []PostIsuConditionRequest{}
-	err := c.Bind(&req)
+	var deviceSecret sql.NullString
+	err := db.Get(&deviceSecret,
+		"SELECT `c`.`secret` FROM `isu` AS `i`"+
+			"	LEFT JOIN `isu_device_credential` AS `c` ON `c`.`jia_isu_uuid` = `i`.`jia_isu_uuid`"+
+			"	WHERE `i`.`jia_isu_uuid` = ?",
+		jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !deviceSecret.Valid {
+		return c.String(http.StatusUnauthorized, "unauthorized: no device credential")
+	}
+
+	body, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request body")
-	} else if len(req) == 0 {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	tx, err := db.Beginx()
+	now := time.Now()
+	signature := c.Request().Header.Get(conditionSignatureHeader)
+	signedAt, err := verifyConditionSignature(deviceSecret.String,
+		c.Request().Header.Get(conditionTimestampHeader), signature, body, now)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.String(http.StatusUnauthorized, fmt.Sprintf("unauthorized: %v", err))
+	}
+	// 受け付けなかったリクエストは再送できるよう、署名の記録を取り消す
+	signatureKey := jiaIsuUUID + ":" + signature
+	if !conditionSignatures.reserve(signatureKey, signedAt, now) {
+		return c.String(http.StatusUnauthorized, "unauthorized: replayed request")
+	}
+	requestAccepted := false
+	defer func() {
+		if !requestAccepted {
+			conditionSignatures.release(signatureKey)
+		}
+	}()
+	isuLastSeen.Touch(jiaIsuUUID, time.Now())
+
+	req := []PostIsuConditionRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	} else if len(req) == 0 {
+		return c.String(http.StatusBadRequest, "bad request body")
 	}
-	defer tx.Rollback()
 
-	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	existing, err := getExistingConditionTimestamps(jiaIsuUUID, req)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if count == 0 {
-		return c.String(http.StatusNotFound, "not found: isu")
-	}
 
+	conditions := make([]IsuCondition, 0, len(req))
 	for _, cond := range req {
-		timestamp := time.Unix(cond.Timestamp, 0)
-
-		if !isValidConditionFormat(cond.Condition) {
+		if len(cond.Condition) == 0 {
 			return c.String(http.StatusBadRequest, "bad request body")
 		}
-
-		_, err = tx.Exec(
-			"INSERT INTO `isu_condition`"+
-				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
-				"	VALUES (?, ?, ?, ?, ?)",
-			jiaIsuUUID, timestamp, cond.IsSitting, cond.Condition, cond.Message)
-		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+		if _, ok := existing[cond.Timestamp]; ok {
+			continue
 		}
 
+		conditions = append(conditions, IsuCondition{
+			JIAIsuUUID:     jiaIsuUUID,
+			Timestamp:      time.Unix(cond.Timestamp, 0),
+			IsSitting:      cond.IsSitting,
+			Condition:      cond.Condition.String(),
+			IsDirty:        cond.Condition["is_dirty"],
+			IsOverweight:   cond.Condition["is_overweight"],
+			IsBroken:       cond.Condition["is_broken"],
+			ConditionLevel: cond.Condition.Level(),
+			Message:        cond.Message,
+		})
 	}
 
-	err = tx.Commit()
+	accepted, err := conditionIngest.Enqueue(conditions)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return conditionEnqueueError(c, err)
 	}
+	requestAccepted = true
 
-	return c.NoContent(http.StatusAccepted)
+	return c.JSON(http.StatusAccepted, PostIsuConditionResponse{
+		Accepted:   accepted,
+		Duplicated: len(req) - accepted,
+	})
 }
 
-// ISUのコンディションの文字列がcsv形式になっているか検証
-func isValidConditionFormat(conditionStr string) bool {
+// キューに積めなかった場合のレスポンス
+// キューが溢れているか停止中であれば、時間をおいて再送してもらう
+func conditionEnqueueError(c echo.Context, err error) error {
+	if errors.Is(err, errConditionQueueFull) || errors.Is(err, errConditionQueueClosed) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(conditionQueueRetryAfterSecs))
+		return c.String(http.StatusServiceUnavailable, "service unavailable")
+	}
 
-	keys := []string{"is_dirty=", "is_overweight=", "is_broken="}
-	const valueTrue = "true"
-	const valueFalse = "false"
+	c.Logger().Error(err)
+	return c.NoContent(http.StatusInternalServerError)
+}
 
-	idxCondStr := 0
+// リクエストに含まれる時刻のうち、既に保存済みのコンディションの時刻を取得
+func getExistingConditionTimestamps(jiaIsuUUID string, req []PostIsuConditionRequest) (map[int64]struct{}, error) {
+	timestamps := make([]time.Time, 0, len(req))
+	for _, cond := range req {
+		timestamps = append(timestamps, time.Unix(cond.Timestamp, 0))
+	}
 
-	for idxKeys, key := range keys {
-		if !strings.HasPrefix(conditionStr[idxCondStr:], key) {
-			return false
-		}
-		idxCondStr += len(key)
-
-		if strings.HasPrefix(conditionStr[idxCondStr:], valueTrue) {
-			idxCondStr += len(valueTrue)
-		} else if strings.HasPrefix(conditionStr[idxCondStr:], valueFalse) {
-			idxCondStr += len(valueFalse)
-		} else {
-			return false
-		}
+	query, args, err := sqlx.In(
+		"SELECT `timestamp` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` IN (?)",
+		jiaIsuUUID, timestamps)
+	if err != nil {
+		return nil, err
+	}
+	existingTimes := []time.Time{}
+	err = db.Select(&existingTimes, query, args...)
+	if err != nil {
+		return nil, err
+	}
 
-		if idxKeys < (len(keys) - 1) {
-			if conditionStr[idxCondStr] != ',' {
-				return false
-			}
-			idxCondStr++
-		}
+	existing := make(map[int64]struct{}, len(existingTimes))
+	for _, t := range existingTimes {
+		existing[t.Unix()] = struct{}{}
 	}
+	return existing, nil
+}
 
-	return (idxCondStr == len(conditionStr))
+// GET /api/condition_key
+// コンディションの項目一覧を取得
+func getConditionKeys(c echo.Context) error {
+	return c.JSON(http.StatusOK, conditionRegistry.Keys())
 }
 
 func getIndex(c echo.Context) error {
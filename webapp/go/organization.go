@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// メンバーの管理ができ、組織のISUに対しては所有者と同じ権限を持つ
+	organizationRoleAdmin = "admin"
+	// 組織にISUを登録でき、組織のISUの名前やアイコンを変更できる
+	organizationRoleEditor = "editor"
+	// 組織のISUの閲覧のみ
+	organizationRoleViewer = "viewer"
+)
+
+// 組織での役割が組織のISUに対して持つ権限
+var organizationIsuRole = map[string]string{
+	organizationRoleAdmin:  isuRoleOwner,
+	organizationRoleEditor: isuRoleEditor,
+	organizationRoleViewer: isuRoleViewer,
+}
+
+type Organization struct {
+	ID        int64     `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Role      string    `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+}
+
+type OrganizationMember struct {
+	OrganizationID int64     `db:"organization_id" json:"-"`
+	JIAUserID      string    `db:"jia_user_id" json:"jia_user_id"`
+	Role           string    `db:"role" json:"role"`
+	CreatedAt      time.Time `db:"created_at" json:"-"`
+}
+
+type PostOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type PutOrganizationMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// ユーザの組織での役割を取得し、required 以上であるかを確認する
+// 組織に所属していない場合は組織の存在を明かさないよう 404 を返す
+func authorizeOrganization(q sqlx.Queryer, jiaUserID string, organizationID int64, required string) (string, int, error) {
+	var role string
+	err := sqlx.Get(q, &role,
+		"SELECT `role` FROM `organization_member` WHERE `organization_id` = ? AND `jia_user_id` = ?",
+		organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", http.StatusNotFound, fmt.Errorf("not found: organization")
+		}
+		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+
+	if isuRoleRank[organizationIsuRole[role]] < isuRoleRank[organizationIsuRole[required]] {
+		return "", http.StatusForbidden, fmt.Errorf("forbidden: %v role required", required)
+	}
+	return role, 0, nil
+}
+
+// organization_id パラメータを読み取る (指定がなければ nil)
+func parseOrganizationID(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	organizationID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: organization_id")
+	}
+	return &organizationID, nil
+}
+
+// organization_id が指定されていれば、ISUがその組織に所属していることを確認する
+func checkOrganizationScope(c echo.Context, access isuAccess) (int, error) {
+	organizationID, err := parseOrganizationID(c.QueryParam("organization_id"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if organizationID == nil {
+		return 0, nil
+	}
+	if access.OrganizationID == nil || *access.OrganizationID != *organizationID {
+		return http.StatusNotFound, fmt.Errorf("not found: isu")
+	}
+	return 0, nil
+}
+
+func isValidOrganizationRole(role string) bool {
+	_, ok := organizationIsuRole[role]
+	return ok
+}
+
+// POST /api/organization
+// 組織を作成 (作成したユーザが管理者になる)
+func postOrganization(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req PostOrganizationRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.Name == "" {
+		return c.String(http.StatusBadRequest, "missing: name")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO `organization` (`name`) VALUES (?)", req.Name)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	organizationID, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	_, err = tx.Exec("INSERT INTO `organization_member` (`organization_id`, `jia_user_id`, `role`) VALUES (?, ?, ?)",
+		organizationID, jiaUserID, organizationRoleAdmin)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var organization Organization
+	err = tx.Get(&organization, "SELECT *, ? AS `role` FROM `organization` WHERE `id` = ?",
+		organizationRoleAdmin, organizationID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, organization)
+}
+
+// GET /api/organization
+// 所属している組織の一覧を取得
+func getOrganizations(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	organizations := []Organization{}
+	err = db.Select(&organizations,
+		"SELECT `organization`.*, `organization_member`.`role` FROM `organization`"+
+			"	JOIN `organization_member` ON `organization_member`.`organization_id` = `organization`.`id`"+
+			"	WHERE `organization_member`.`jia_user_id` = ? ORDER BY `organization`.`id` ASC",
+		jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, organizations)
+}
+
+// GET /api/organization/:organization_id/member
+// 組織のメンバーの一覧を取得
+func getOrganizationMembers(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: organization_id")
+	}
+
+	_, errStatusCode, err = authorizeOrganization(db, jiaUserID, organizationID, organizationRoleViewer)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	members := []OrganizationMember{}
+	err = db.Select(&members,
+		"SELECT * FROM `organization_member` WHERE `organization_id` = ? ORDER BY `created_at` ASC",
+		organizationID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, members)
+}
+
+// PUT /api/organization/:organization_id/member/:jia_user_id
+// ユーザを組織に追加する (既にメンバーであれば役割を変更する)
+func putOrganizationMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: organization_id")
+	}
+	memberUserID := c.Param("jia_user_id")
+
+	var req PutOrganizationMemberRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if !isValidOrganizationRole(req.Role) {
+		return c.String(http.StatusBadRequest, "bad format: role")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	_, errStatusCode, err = authorizeOrganization(tx, jiaUserID, organizationID, organizationRoleAdmin)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	var count int
+	err = tx.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?", memberUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "not found: user")
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO `organization_member` (`organization_id`, `jia_user_id`, `role`) VALUES (?, ?, ?)"+
+			"	ON DUPLICATE KEY UPDATE `role` = VALUES(`role`)",
+		organizationID, memberUserID, req.Role)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	errStatusCode, err = ensureOrganizationAdmin(tx, organizationID)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, OrganizationMember{OrganizationID: organizationID, JIAUserID: memberUserID, Role: req.Role})
+}
+
+// DELETE /api/organization/:organization_id/member/:jia_user_id
+// ユーザを組織から外す (管理者か、メンバー自身が行える)
+func deleteOrganizationMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: organization_id")
+	}
+	memberUserID := c.Param("jia_user_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	required := organizationRoleAdmin
+	if memberUserID == jiaUserID {
+		required = organizationRoleViewer
+	}
+	_, errStatusCode, err = authorizeOrganization(tx, jiaUserID, organizationID, required)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	result, err := tx.Exec("DELETE FROM `organization_member` WHERE `organization_id` = ? AND `jia_user_id` = ?",
+		organizationID, memberUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: member")
+	}
+
+	errStatusCode, err = ensureOrganizationAdmin(tx, organizationID)
+	if err != nil {
+		if errStatusCode == http.StatusInternalServerError {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(errStatusCode, err.Error())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 管理者が一人もいない組織ができないようにする
+func ensureOrganizationAdmin(tx *sqlx.Tx, organizationID int64) (int, error) {
+	var count int
+	err := tx.Get(&count,
+		"SELECT COUNT(*) FROM `organization_member` WHERE `organization_id` = ? AND `role` = ? FOR UPDATE",
+		organizationID, organizationRoleAdmin)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+	if count == 0 {
+		return http.StatusBadRequest, fmt.Errorf("organization must have at least one admin")
+	}
+	return 0, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sessionTokenBytes = 32
+	// 最後にアクセスしてからこの期間が過ぎたセッションは無効
+	sessionIdleTimeout = 24 * time.Hour
+	// ログインしてからこの期間が過ぎたセッションは無効
+	sessionAbsoluteTimeout = 7 * 24 * time.Hour
+	// last_accessed_at を書き込む最短の間隔
+	sessionTouchInterval = time.Minute
+	// 他のプロセスで失効させたセッションが使えてしまう最長の期間
+	sessionCacheTTL        = 10 * time.Second
+	sessionCacheMaxEntries = 10000
+	// user_session.user_agent の長さ
+	sessionUserAgentMaxLength = 512
+)
+
+// MySQL に保存するセッション
+// Cookie にはトークンを、DB にはそのハッシュを保存する
+type UserSession struct {
+	ID             int64     `db:"id"`
+	TokenHash      string    `db:"token_hash"`
+	JIAUserID      string    `db:"jia_user_id"`
+	UserAgent      string    `db:"user_agent"`
+	IPAddress      string    `db:"ip_address"`
+	CreatedAt      time.Time `db:"created_at"`
+	LastAccessedAt time.Time `db:"last_accessed_at"`
+	ExpiresAt      time.Time `db:"expires_at"`
+}
+
+type GetUserSessionResponse struct {
+	ID             int64  `json:"id"`
+	UserAgent      string `json:"user_agent"`
+	IPAddress      string `json:"ip_address"`
+	CreatedAt      int64  `json:"created_at"`
+	LastAccessedAt int64  `json:"last_accessed_at"`
+	ExpiresAt      int64  `json:"expires_at"`
+	Current        bool   `json:"current"`
+}
+
+func (s *UserSession) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || now.Sub(s.LastAccessedAt) >= sessionIdleTimeout
+}
+
+type sessionCacheEntry struct {
+	session  UserSession
+	cachedAt time.Time
+}
+
+// セッションの読み書きと、プロセス内のキャッシュ
+type sessionManager struct {
+	mu    sync.Mutex
+	cache map[string]sessionCacheEntry
+}
+
+var userSessions = &sessionManager{cache: map[string]sessionCacheEntry{}}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 新しいセッションを作り、Cookie に入れるトークンを返す
+func (m *sessionManager) Create(jiaUserID string, userAgent string, ipAddress string, now time.Time) (string, error) {
+	b := make([]byte, sessionTokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if len(userAgent) > sessionUserAgentMaxLength {
+		userAgent = userAgent[:sessionUserAgentMaxLength]
+	}
+
+	session := UserSession{
+		TokenHash:      hashToken(token),
+		JIAUserID:      jiaUserID,
+		UserAgent:      userAgent,
+		IPAddress:      ipAddress,
+		CreatedAt:      now,
+		LastAccessedAt: now,
+		ExpiresAt:      now.Add(sessionAbsoluteTimeout),
+	}
+	result, err := db.Exec(
+		"INSERT INTO `user_session`"+
+			"	(`token_hash`, `jia_user_id`, `user_agent`, `ip_address`, `created_at`, `last_accessed_at`, `expires_at`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?)",
+		session.TokenHash, session.JIAUserID, session.UserAgent, session.IPAddress,
+		session.CreatedAt, session.LastAccessedAt, session.ExpiresAt)
+	if err != nil {
+		return "", fmt.Errorf("db error: %v", err)
+	}
+	session.ID, err = result.LastInsertId()
+	if err != nil {
+		return "", fmt.Errorf("db error: %v", err)
+	}
+
+	// 失効したセッションはログインのたびに片付ける
+	_, err = db.Exec(
+		"DELETE FROM `user_session` WHERE `jia_user_id` = ? AND (`expires_at` <= ? OR `last_accessed_at` <= ?)",
+		jiaUserID, now, now.Add(-sessionIdleTimeout))
+	if err != nil {
+		return "", fmt.Errorf("db error: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.cache) >= sessionCacheMaxEntries {
+		for hash, entry := range m.cache {
+			if now.Sub(entry.cachedAt) >= sessionCacheTTL {
+				delete(m.cache, hash)
+			}
+		}
+	}
+	m.cache[session.TokenHash] = sessionCacheEntry{session: session, cachedAt: now}
+	return token, nil
+}
+
+// トークンに対応する有効なセッションを返す (なければ nil)
+func (m *sessionManager) Lookup(token string, now time.Time) (*UserSession, error) {
+	hash := hashToken(token)
+
+	m.mu.Lock()
+	entry, ok := m.cache[hash]
+	m.mu.Unlock()
+
+	if !ok || now.Sub(entry.cachedAt) >= sessionCacheTTL {
+		err := db.Get(&entry.session, "SELECT * FROM `user_session` WHERE `token_hash` = ?", hash)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				m.forget(func(s UserSession) bool { return s.TokenHash == hash })
+				return nil, nil
+			}
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+		entry.cachedAt = now
+	}
+	session := entry.session
+
+	if session.expired(now) {
+		_, err := m.revoke("DELETE FROM `user_session` WHERE `id` = ?", session.ID)
+		if err != nil {
+			return nil, err
+		}
+		m.forget(func(s UserSession) bool { return s.ID == session.ID })
+		return nil, nil
+	}
+
+	if now.Sub(session.LastAccessedAt) >= sessionTouchInterval {
+		_, err := db.Exec("UPDATE `user_session` SET `last_accessed_at` = ? WHERE `id` = ?", now, session.ID)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+		session.LastAccessedAt = now
+		entry.session = session
+	}
+
+	m.mu.Lock()
+	m.cache[hash] = entry
+	m.mu.Unlock()
+	return &session, nil
+}
+
+// ユーザのセッションを一つ失効させる
+func (m *sessionManager) Revoke(jiaUserID string, sessionID int64) (bool, error) {
+	affected, err := m.revoke("DELETE FROM `user_session` WHERE `id` = ? AND `jia_user_id` = ?", sessionID, jiaUserID)
+	if err != nil {
+		return false, err
+	}
+	m.forget(func(s UserSession) bool { return s.ID == sessionID })
+	return affected > 0, nil
+}
+
+// ユーザのすべてのセッションを失効させる
+func (m *sessionManager) RevokeAll(jiaUserID string) error {
+	_, err := m.revoke("DELETE FROM `user_session` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		return err
+	}
+	m.forget(func(s UserSession) bool { return s.JIAUserID == jiaUserID })
+	return nil
+}
+
+func (m *sessionManager) revoke(query string, args ...interface{}) (int64, error) {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	return affected, nil
+}
+
+func (m *sessionManager) forget(match func(UserSession) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, entry := range m.cache {
+		if match(entry.session) {
+			delete(m.cache, hash)
+		}
+	}
+}
+
+// DB を初期化したときにキャッシュを捨てる
+func (m *sessionManager) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache = map[string]sessionCacheEntry{}
+}
+
+func setSessionCookie(c echo.Context, token string) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionAbsoluteTimeout / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// リクエストの Cookie に対応する有効なセッションを取得
+func getCurrentSession(c echo.Context) (*UserSession, int, error) {
+	cookie, err := c.Cookie(sessionName)
+	if err != nil || cookie.Value == "" {
+		return nil, http.StatusUnauthorized, fmt.Errorf("no session")
+	}
+	session, err := userSessions.Lookup(cookie.Value, time.Now())
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if session == nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("no session")
+	}
+	return session, 0, nil
+}
+
+// GET /api/user/me/session
+// 有効なセッションの一覧を取得
+func getUserSessions(c echo.Context) error {
+	current, errStatusCode, err := getCurrentSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	sessions := []UserSession{}
+	err = db.Select(&sessions,
+		"SELECT * FROM `user_session` WHERE `jia_user_id` = ? AND `expires_at` > ? AND `last_accessed_at` > ?"+
+			"	ORDER BY `last_accessed_at` DESC",
+		current.JIAUserID, now, now.Add(-sessionIdleTimeout))
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []GetUserSessionResponse{}
+	for _, s := range sessions {
+		res = append(res, GetUserSessionResponse{
+			ID:             s.ID,
+			UserAgent:      s.UserAgent,
+			IPAddress:      s.IPAddress,
+			CreatedAt:      s.CreatedAt.Unix(),
+			LastAccessedAt: s.LastAccessedAt.Unix(),
+			ExpiresAt:      s.ExpiresAt.Unix(),
+			Current:        s.ID == current.ID,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// DELETE /api/user/me/session/:session_id
+// セッションを一つ失効させる
+func deleteUserSession(c echo.Context) error {
+	current, errStatusCode, err := getCurrentSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: session_id")
+	}
+
+	found, err := userSessions.Revoke(current.JIAUserID, sessionID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !found {
+		return c.String(http.StatusNotFound, "not found: session")
+	}
+	if sessionID == current.ID {
+		clearSessionCookie(c)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DELETE /api/user/me/session
+// すべての端末からサインアウト
+func deleteUserSessions(c echo.Context) error {
+	current, errStatusCode, err := getCurrentSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = userSessions.RevokeAll(current.JIAUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	clearSessionCookie(c)
+
+	return c.NoContent(http.StatusNoContent)
+}
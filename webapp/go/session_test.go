@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserSessionExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name           string
+		lastAccessedAt time.Time
+		expiresAt      time.Time
+		want           bool
+	}{
+		{name: "active", lastAccessedAt: now.Add(-time.Minute), expiresAt: now.Add(time.Hour), want: false},
+		{name: "just before idle timeout", lastAccessedAt: now.Add(-sessionIdleTimeout + time.Second), expiresAt: now.Add(time.Hour), want: false},
+		{name: "idle timeout", lastAccessedAt: now.Add(-sessionIdleTimeout), expiresAt: now.Add(time.Hour), want: true},
+		{name: "just before absolute timeout", lastAccessedAt: now, expiresAt: now.Add(time.Second), want: false},
+		{name: "absolute timeout", lastAccessedAt: now, expiresAt: now, want: true},
+		{name: "absolute timeout while active", lastAccessedAt: now.Add(-time.Second), expiresAt: now.Add(-time.Second), want: true},
+	}
+	for _, tt := range tests {
+		s := UserSession{CreatedAt: now.Add(-time.Hour), LastAccessedAt: tt.lastAccessedAt, ExpiresAt: tt.expiresAt}
+		if got := s.expired(now); got != tt.want {
+			t.Errorf("%v: expired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSessionManagerLookupCached(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	token := "test-token"
+	session := UserSession{
+		ID:             1,
+		TokenHash:      hashToken(token),
+		JIAUserID:      "isucon",
+		CreatedAt:      now.Add(-time.Hour),
+		LastAccessedAt: now.Add(-sessionTouchInterval / 2),
+		ExpiresAt:      now.Add(-time.Hour).Add(sessionAbsoluteTimeout),
+	}
+	m := &sessionManager{cache: map[string]sessionCacheEntry{
+		session.TokenHash: {session: session, cachedAt: now.Add(-sessionCacheTTL / 2)},
+	}}
+
+	// キャッシュが有効な間は DB を読まずに返す
+	got, err := m.Lookup(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.ID != session.ID || got.JIAUserID != session.JIAUserID {
+		t.Fatalf("Lookup = %+v, want session %v", got, session.ID)
+	}
+
+	m.forget(func(s UserSession) bool { return s.JIAUserID == "isucon" })
+	if len(m.cache) != 0 {
+		t.Errorf("cache has %v entries after forget", len(m.cache))
+	}
+}
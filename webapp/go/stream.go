@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamSubscriberBufferSize = 256
+	streamHeartbeatInterval    = 15 * time.Second
+	streamWriteTimeout         = 10 * time.Second
+	streamReplayLimit          = 1000
+	streamRetryMs              = 3000
+	// 共有の解除や組織からの脱退に追従するため、閲覧権限を確認し直す間隔
+	streamAuthorizeInterval = 30 * time.Second
+)
+
+var errConditionStreamClosed = errors.New("condition stream is closed")
+
+// 書き込みが終わったコンディションを、そのISUを購読している接続に配る
+type conditionStreamHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*conditionSubscriber]struct{}
+	closed      bool
+}
+
+// 一つの接続ぶんの購読
+// 受け取りが追いつかずにバッファが溢れた場合は ch が閉じられるので、クライアントは Last-Event-ID を付けて再接続する
+type conditionSubscriber struct {
+	jiaIsuUUID string
+	ch         chan IsuCondition
+}
+
+var conditionStreams = newConditionStreamHub()
+
+func newConditionStreamHub() *conditionStreamHub {
+	return &conditionStreamHub{subscribers: map[string]map[*conditionSubscriber]struct{}{}}
+}
+
+func (h *conditionStreamHub) Subscribe(jiaIsuUUID string) (*conditionSubscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errConditionStreamClosed
+	}
+
+	sub := &conditionSubscriber{
+		jiaIsuUUID: jiaIsuUUID,
+		ch:         make(chan IsuCondition, streamSubscriberBufferSize),
+	}
+	subs, ok := h.subscribers[jiaIsuUUID]
+	if !ok {
+		subs = map[*conditionSubscriber]struct{}{}
+		h.subscribers[jiaIsuUUID] = subs
+	}
+	subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (h *conditionStreamHub) Unsubscribe(sub *conditionSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(sub)
+}
+
+func (h *conditionStreamHub) removeLocked(sub *conditionSubscriber) {
+	subs, ok := h.subscribers[sub.jiaIsuUUID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.jiaIsuUUID)
+	}
+	close(sub.ch)
+}
+
+// 購読者に配る (ブロックしない)
+func (h *conditionStreamHub) Publish(conditions []IsuCondition) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, cond := range conditions {
+		for sub := range h.subscribers[cond.JIAIsuUUID] {
+			select {
+			case sub.ch <- cond:
+			default:
+				h.removeLocked(sub)
+			}
+		}
+	}
+}
+
+// 指定したISUの購読をすべて終わらせる (ISUの削除用)
+func (h *conditionStreamHub) CloseIsu(jiaIsuUUID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[jiaIsuUUID] {
+		h.removeLocked(sub)
+	}
+}
+
+// すべての購読を終わらせ、以降の購読を受け付けない
+func (h *conditionStreamHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.removeLocked(sub)
+		}
+	}
+}
+
+// 認証済みの一つの配信
+// イベントIDは isu_condition の id
+type conditionStream struct {
+	sub        *conditionSubscriber
+	jiaUserID  string
+	jiaIsuUUID string
+	isuName    string
+	replay     []IsuCondition
+}
+
+// 認証とISUの閲覧権限の確認をしてから購読を始め、再接続であれば取りこぼした分を取得する
+func openConditionStream(c echo.Context) (*conditionStream, int, error) {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return nil, http.StatusUnauthorized, fmt.Errorf("you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return nil, http.StatusForbidden, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("missing: jia_isu_uuid")
+	}
+
+	// WebSocket ではヘッダを付けられないのでクエリパラメータでも受け付ける
+	lastEventIDStr := c.Request().Header.Get("Last-Event-ID")
+	if lastEventIDStr == "" {
+		lastEventIDStr = c.QueryParam("last_event_id")
+	}
+	var lastEventID int64
+	if lastEventIDStr != "" {
+		lastEventID, err = strconv.ParseInt(lastEventIDStr, 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("bad format: Last-Event-ID")
+		}
+	}
+
+	access, errStatusCode, err := authorizeIsu(db, jiaUserID, jiaIsuUUID, isuRoleViewer)
+	if err != nil {
+		return nil, errStatusCode, err
+	}
+
+	// 再送分の取得中に書き込まれたものを取りこぼさないよう、先に購読しておく
+	sub, err := conditionStreams.Subscribe(jiaIsuUUID)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+
+	// 再送分の最初のページはヘッダを送る前に取得し、DBのエラーを 500 で返せるようにする
+	replay := []IsuCondition{}
+	if lastEventIDStr != "" {
+		replay, err = selectConditionReplay(jiaIsuUUID, lastEventID)
+		if err != nil {
+			conditionStreams.Unsubscribe(sub)
+			return nil, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	return &conditionStream{
+		sub:        sub,
+		jiaUserID:  jiaUserID,
+		jiaIsuUUID: jiaIsuUUID,
+		isuName:    access.Name,
+		replay:     replay,
+	}, 0, nil
+}
+
+// afterID より後に書き込まれたコンディションを streamReplayLimit 件まで取得する
+// 遅れて届いた過去の時刻のコンディションも取りこぼさないよう、書き込まれた順に並べる
+func selectConditionReplay(jiaIsuUUID string, afterID int64) ([]IsuCondition, error) {
+	replay := []IsuCondition{}
+	err := db.Select(&replay,
+		"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `id` > ?"+
+			"	ORDER BY `id` ASC LIMIT ?",
+		jiaIsuUUID, afterID, streamReplayLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+func (s *conditionStream) Close() {
+	conditionStreams.Unsubscribe(s.sub)
+}
+
+// 再送分を送ってから、ctx が終わるか購読が打ち切られるまで新しいコンディションを送り続ける
+// 閲覧権限がなくなった場合も配信を打ち切る
+func (s *conditionStream) Run(ctx context.Context, send func(id int, data *GetIsuConditionResponse) error, heartbeat func() error) error {
+	// 購読後に書き込まれたものは再送分と重なることがあるので、送った id より新しいものだけ送る
+	lastID := 0
+	replay := s.replay
+	for {
+		for _, cond := range replay {
+			err := s.send(cond, send)
+			if err != nil {
+				return err
+			}
+			lastID = cond.ID
+		}
+		// 1ページに収まらなかった場合は、購読を始めた時点に追いつくまで続きを取得する
+		// 追いつくまでに購読のバッファが溢れた場合は、打ち切られた購読から再接続してもらう
+		if len(replay) < streamReplayLimit || ctx.Err() != nil {
+			break
+		}
+		var err error
+		replay, err = selectConditionReplay(s.jiaIsuUUID, int64(lastID))
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	heartbeatTicker := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+	authorizeTicker := time.NewTicker(streamAuthorizeInterval)
+	defer authorizeTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeatTicker.C:
+			err := heartbeat()
+			if err != nil {
+				return err
+			}
+		case <-authorizeTicker.C:
+			_, _, err := authorizeIsu(db, s.jiaUserID, s.jiaIsuUUID, isuRoleViewer)
+			if err != nil {
+				return err
+			}
+		case cond, ok := <-s.sub.ch:
+			if !ok {
+				return nil
+			}
+			if cond.ID <= lastID {
+				continue
+			}
+			err := s.send(cond, send)
+			if err != nil {
+				return err
+			}
+			lastID = cond.ID
+		}
+	}
+}
+
+func (s *conditionStream) send(cond IsuCondition, send func(id int, data *GetIsuConditionResponse) error) error {
+	data, err := newGetIsuConditionResponse(cond, s.isuName, false, nil)
+	if err != nil {
+		return err
+	}
+	return send(cond.ID, data)
+}
+
+func conditionStreamError(c echo.Context, errStatusCode int, err error) error {
+	if errStatusCode == http.StatusInternalServerError {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.String(errStatusCode, err.Error())
+}
+
+// GET /api/isu/:jia_isu_uuid/stream
+// ISUのコンディションを Server-Sent Events で配信
+// イベントIDは isu_condition の id
+func getIsuConditionStream(c echo.Context) error {
+	stream, errStatusCode, err := openConditionStream(c)
+	if err != nil {
+		return conditionStreamError(c, errStatusCode, err)
+	}
+	defer stream.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "retry: %d\n\n", streamRetryMs)
+	res.Flush()
+
+	err = stream.Run(c.Request().Context(),
+		func(id int, data *GetIsuConditionResponse) error {
+			b, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(res, "id: %d\nevent: condition\ndata: %s\n\n", id, b)
+			if err != nil {
+				return err
+			}
+			res.Flush()
+			return nil
+		},
+		func() error {
+			_, err := fmt.Fprint(res, ": heartbeat\n\n")
+			if err != nil {
+				return err
+			}
+			res.Flush()
+			return nil
+		},
+	)
+	if err != nil {
+		c.Logger().Debugf("condition stream closed: %v", err)
+	}
+	return nil
+}
+
+var conditionStreamUpgrader = websocket.Upgrader{}
+
+// WebSocket で送るメッセージ
+type ConditionStreamMessage struct {
+	ID        string                   `json:"id"`
+	Condition *GetIsuConditionResponse `json:"condition"`
+}
+
+// GET /api/isu/:jia_isu_uuid/stream/ws
+// ISUのコンディションを WebSocket で配信
+// 再接続時は最後に受け取ったメッセージの id を last_event_id に指定する
+func getIsuConditionWebSocket(c echo.Context) error {
+	stream, errStatusCode, err := openConditionStream(c)
+	if err != nil {
+		return conditionStreamError(c, errStatusCode, err)
+	}
+	defer stream.Close()
+
+	// Upgrade に失敗した場合はエラーレスポンスが書き込み済み
+	conn, err := conditionStreamUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		c.Logger().Debugf("failed to upgrade to websocket: %v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	// クライアントからのメッセージは読み捨て、切断を検知したら配信を止める
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = stream.Run(ctx,
+		func(id int, data *GetIsuConditionResponse) error {
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			return conn.WriteJSON(ConditionStreamMessage{
+				ID:        strconv.Itoa(id),
+				Condition: data,
+			})
+		},
+		func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+		},
+	)
+	if err != nil {
+		c.Logger().Debugf("condition stream closed: %v", err)
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(streamWriteTimeout))
+	return nil
+}
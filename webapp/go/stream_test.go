@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// バッファに入っている分を受け取り、受け取った件数と購読が打ち切られたかを返す
+func drainSubscriber(sub *conditionSubscriber) (int, bool) {
+	n := 0
+	for {
+		select {
+		case _, ok := <-sub.ch:
+			if !ok {
+				return n, true
+			}
+			n++
+		default:
+			return n, false
+		}
+	}
+}
+
+func TestConditionStreamHub(t *testing.T) {
+	tests := []struct {
+		name string
+		// "a" と "b" のISUを一つずつ購読した後に行う操作
+		op          func(h *conditionStreamHub)
+		wantA       int
+		wantB       int
+		wantClosedA bool
+		wantClosedB bool
+	}{
+		{
+			name:        "publish",
+			op:          func(h *conditionStreamHub) { h.Publish(testConditions("a", 3)) },
+			wantA:       3,
+			wantB:       0,
+			wantClosedA: false,
+			wantClosedB: false,
+		},
+		{
+			// 受け取りが追いつかない購読は打ち切り、バッファに入っていた分までは受け取れる
+			name:        "drop on overflow",
+			op:          func(h *conditionStreamHub) { h.Publish(testConditions("a", streamSubscriberBufferSize+1)) },
+			wantA:       streamSubscriberBufferSize,
+			wantB:       0,
+			wantClosedA: true,
+			wantClosedB: false,
+		},
+		{
+			name:        "buffer just fits",
+			op:          func(h *conditionStreamHub) { h.Publish(testConditions("a", streamSubscriberBufferSize)) },
+			wantA:       streamSubscriberBufferSize,
+			wantB:       0,
+			wantClosedA: false,
+			wantClosedB: false,
+		},
+		{
+			name: "close isu",
+			op: func(h *conditionStreamHub) {
+				h.Publish(testConditions("a", 2))
+				h.CloseIsu("a")
+				// 打ち切られた後に届いたものは配らない
+				h.Publish(testConditions("a", 3))
+			},
+			wantA:       2,
+			wantB:       0,
+			wantClosedA: true,
+			wantClosedB: false,
+		},
+		{
+			name:        "close all",
+			op:          func(h *conditionStreamHub) { h.Close() },
+			wantA:       0,
+			wantB:       0,
+			wantClosedA: true,
+			wantClosedB: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newConditionStreamHub()
+			subA, err := h.Subscribe("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			subB, err := h.Subscribe("b")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.op(h)
+
+			for _, s := range []struct {
+				sub        *conditionSubscriber
+				want       int
+				wantClosed bool
+			}{
+				{sub: subA, want: tt.wantA, wantClosed: tt.wantClosedA},
+				{sub: subB, want: tt.wantB, wantClosed: tt.wantClosedB},
+			} {
+				got, closed := drainSubscriber(s.sub)
+				if got != s.want || closed != s.wantClosed {
+					t.Errorf("%v: received = %v, closed = %v, want %v, %v", s.sub.jiaIsuUUID, got, closed, s.want, s.wantClosed)
+				}
+				// 打ち切った購読は一覧からも外す
+				if _, ok := h.subscribers[s.sub.jiaIsuUUID][s.sub]; ok == closed {
+					t.Errorf("%v: subscribed = %v, closed = %v", s.sub.jiaIsuUUID, ok, closed)
+				}
+			}
+
+			// 打ち切られた購読の解除で二重に閉じない
+			h.Unsubscribe(subA)
+			h.Unsubscribe(subB)
+			if len(h.subscribers) != 0 {
+				t.Errorf("subscribers remain after Unsubscribe: %v", h.subscribers)
+			}
+		})
+	}
+}
+
+func TestConditionStreamHubClosed(t *testing.T) {
+	h := newConditionStreamHub()
+	h.Close()
+	if _, err := h.Subscribe("a"); !errors.Is(err, errConditionStreamClosed) {
+		t.Errorf("Subscribe after Close: error = %v, want %v", err, errConditionStreamClosed)
+	}
+}
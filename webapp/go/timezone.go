@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type PutTimezoneRequest struct {
+	Timezone string `json:"timezone"`
+}
+
+// ユーザが設定したタイムゾーンを取得 (未設定の場合は空文字列)
+func getUserTimezone(jiaUserID string) (string, error) {
+	var timezone string
+	err := db.Get(&timezone, "SELECT `timezone` FROM `user_preference` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("db error: %v", err)
+	}
+	return timezone, nil
+}
+
+// グラフやコンディションの時刻を扱うタイムゾーンを決める
+// tz クエリパラメータ、ユーザの設定、サーバのタイムゾーンの順に優先する
+// 二つ目の戻り値はタイムゾーンがリクエストまたはユーザ設定で指定されていたかどうか
+func resolveLocation(c echo.Context, jiaUserID string) (*time.Location, bool, int, error) {
+	if tz := c.QueryParam("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, false, http.StatusBadRequest, fmt.Errorf("bad format: tz")
+		}
+		return loc, true, 0, nil
+	}
+
+	timezone, err := getUserTimezone(jiaUserID)
+	if err != nil {
+		return nil, false, http.StatusInternalServerError, err
+	}
+	if timezone == "" {
+		return time.Local, false, 0, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, false, http.StatusInternalServerError, fmt.Errorf("failed to load timezone %v: %v", timezone, err)
+	}
+	return loc, true, 0, nil
+}
+
+// PUT /api/user/me/timezone
+// サインインしている自分自身のタイムゾーンを設定
+func putTimezone(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+		if errStatusCode == http.StatusForbidden {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req PutTimezoneRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.Timezone != "" {
+		_, err = time.LoadLocation(req.Timezone)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: timezone")
+		}
+	}
+
+	_, err = db.Exec("INSERT INTO `user_preference` (`jia_user_id`, `timezone`) VALUES (?, ?)"+
+		" ON DUPLICATE KEY UPDATE `timezone` = VALUES(`timezone`)",
+		jiaUserID, req.Timezone)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliverySucceeded = "succeeded"
+	webhookDeliveryFailed    = "failed"
+
+	webhookDeliveryInterval    = time.Second
+	webhookDeliveryBatchSize   = 100
+	webhookDeliveryTimeout     = 5 * time.Second
+	webhookDeliveryMaxAttempts = 6
+	webhookDeliveryBackoff     = 5 * time.Second
+	webhookDeliveryLogLimit    = 100
+	webhookDeliveryErrorMaxLen = 1024
+	webhookMaxRedirects        = 3
+	// 配信全体と、送信先ホストごとの並行数
+	webhookDeliveryConcurrency = 16
+	webhookDeliveryPerHost     = 2
+	// 送信するものを選ぶために一度に読む未送信の配信の数
+	webhookDeliveryScanSize = 1000
+)
+
+// Webhook の送信先として許可しないアドレス
+// 内部のサービスやメタデータサーバへ送らせないため、私用・ループバック・リンクローカルなどを弾く
+var webhookBlockedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// webhookBlockedNetworks のうち、送信先として明示的に許可するアドレス
+// 開発環境やCIでローカルの受け口に配信するため、WEBHOOK_ALLOWED_NETWORKS にカンマ区切りの CIDR または IP アドレスで指定する
+var webhookAllowedNetworks []*net.IPNet
+
+// WEBHOOK_ALLOWED_NETWORKS を解釈する
+func parseWebhookAllowedNetworks(s string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: WEBHOOK_ALLOWED_NETWORKS: %v", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isWebhookAddressAllowed(ip net.IP) bool {
+	for _, network := range webhookAllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range webhookBlockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// 名前解決した後の接続先アドレスを確認する
+// 登録後に DNS の向き先を変えられた場合や、リダイレクト先も同じく弾かれる
+func webhookDialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isWebhookAddressAllowed(ip) {
+		return fmt.Errorf("webhook to %v is not allowed", host)
+	}
+	return nil
+}
+
+// Webhook の配信記録
+// 配信に失敗した場合は next_attempt_at まで待って再送する
+type WebhookDelivery struct {
+	ID             int       `db:"id"`
+	AlertRuleID    int       `db:"alert_rule_id"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid"`
+	Event          string    `db:"event"`
+	WebhookURL     string    `db:"webhook_url"`
+	Payload        string    `db:"payload"`
+	Status         string    `db:"status"`
+	Attempts       int       `db:"attempts"`
+	NextAttemptAt  time.Time `db:"next_attempt_at"`
+	LastStatusCode int       `db:"last_status_code"`
+	LastError      string    `db:"last_error"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+type GetWebhookDeliveryResponse struct {
+	ID             int             `json:"id"`
+	JIAIsuUUID     string          `json:"jia_isu_uuid"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      int64           `json:"created_at"`
+	UpdatedAt      int64           `json:"updated_at"`
+}
+
+func (d WebhookDelivery) response() GetWebhookDeliveryResponse {
+	return GetWebhookDeliveryResponse{
+		ID:             d.ID,
+		JIAIsuUUID:     d.JIAIsuUUID,
+		Event:          d.Event,
+		Payload:        json.RawMessage(d.Payload),
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt.Unix(),
+		UpdatedAt:      d.UpdatedAt.Unix(),
+	}
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookDeliveryTimeout,
+	// 環境変数のプロキシは使わず、webhookDialControl を通して直接接続する
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookDeliveryTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		MaxConnsPerHost:     webhookDeliveryPerHost,
+		MaxIdleConnsPerHost: webhookDeliveryPerHost,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= webhookMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", webhookMaxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %v is not allowed", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+func enqueueWebhookDelivery(tx *sqlx.Tx, rule AlertRule, jiaIsuUUID string, payload AlertWebhookPayload, now time.Time) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `webhook_delivery`"+
+			"	(`alert_rule_id`, `jia_isu_uuid`, `event`, `webhook_url`, `payload`, `status`, `next_attempt_at`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?)",
+		rule.ID, jiaIsuUUID, payload.Event, rule.WebhookURL, string(b), webhookDeliveryPending, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 送信時刻を過ぎた配信をまとめて送る
+// 全体で webhookDeliveryConcurrency 件、同じホストへは webhookDeliveryPerHost 件まで並行して送る
+// 同じルールとISUの配信は古いものから1件ずつ送り、発火・解消の順序を保つ
+func deliverWebhooks(ctx context.Context, now time.Time) error {
+	pending := []WebhookDelivery{}
+	err := db.Select(&pending,
+		"SELECT * FROM `webhook_delivery` WHERE `status` = ? ORDER BY `id` ASC LIMIT ?",
+		webhookDeliveryPending, webhookDeliveryScanSize)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	deliveries := nextWebhookDeliveries(pending, now, webhookDeliveryBatchSize)
+
+	lanes := map[string][]WebhookDelivery{}
+	for _, d := range deliveries {
+		key := webhookDeliveryLane(d)
+		lanes[key] = append(lanes[key], d)
+	}
+
+	sem := make(chan struct{}, webhookDeliveryConcurrency)
+	var wg sync.WaitGroup
+	for _, lane := range lanes {
+		wg.Add(1)
+		go func(lane []WebhookDelivery) {
+			defer wg.Done()
+			for _, d := range lane {
+				select {
+				case <-ctx.Done():
+					return
+				case sem <- struct{}{}:
+				}
+				err := deliverWebhook(ctx, d)
+				<-sem
+				if err != nil {
+					log.Errorf("failed to deliver webhook %d: %v", d.ID, err)
+				}
+			}
+		}(lane)
+	}
+	wg.Wait()
+	return nil
+}
+
+// 未送信の配信 (id の昇順) から、ルールとISUの組ごとに最も古いものを選び、送信時刻を過ぎていれば送る
+// 古いものが再送を待っている間は、新しいものの送信時刻が過ぎていても送らない
+func nextWebhookDeliveries(pending []WebhookDelivery, now time.Time, limit int) []WebhookDelivery {
+	deliveries := []WebhookDelivery{}
+	seen := map[string]bool{}
+	for _, d := range pending {
+		key := fmt.Sprintf("%d:%s", d.AlertRuleID, d.JIAIsuUUID)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if d.NextAttemptAt.After(now) {
+			continue
+		}
+		deliveries = append(deliveries, d)
+		if len(deliveries) >= limit {
+			break
+		}
+	}
+	return deliveries
+}
+
+// 送信先のホストごとに webhookDeliveryPerHost 本のレーンに振り分ける
+func webhookDeliveryLane(d WebhookDelivery) string {
+	host := d.WebhookURL
+	if u, err := url.Parse(d.WebhookURL); err == nil {
+		host = strings.ToLower(u.Host)
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%s", d.AlertRuleID, d.JIAIsuUUID)
+	return fmt.Sprintf("%s#%d", host, h.Sum32()%webhookDeliveryPerHost)
+}
+
+// 1件送信し、結果を記録する
+func deliverWebhook(ctx context.Context, d WebhookDelivery) error {
+	statusCode, sendErr := sendWebhook(ctx, d)
+	if ctx.Err() != nil {
+		// 停止による失敗は試行に数えない
+		return nil
+	}
+	d.Attempts++
+	d.LastStatusCode = statusCode
+	d.LastError = ""
+	switch {
+	case sendErr == nil:
+		d.Status = webhookDeliverySucceeded
+	case d.Attempts >= webhookDeliveryMaxAttempts:
+		d.Status = webhookDeliveryFailed
+		d.LastError = sendErr.Error()
+	default:
+		// 5秒, 10秒, 20秒, ... と間隔を空けて再送する
+		d.NextAttemptAt = time.Now().Add(webhookDeliveryBackoff << (d.Attempts - 1))
+		d.LastError = sendErr.Error()
+	}
+	if len(d.LastError) > webhookDeliveryErrorMaxLen {
+		d.LastError = d.LastError[:webhookDeliveryErrorMaxLen]
+	}
+
+	_, err := db.Exec(
+		"UPDATE `webhook_delivery` SET `status` = ?, `attempts` = ?, `next_attempt_at` = ?,"+
+			"	`last_status_code` = ?, `last_error` = ? WHERE `id` = ?",
+		d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError, d.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 配信を定期的に行う
+// 送信先が遅くてもアラートの評価を止めないよう、評価とは別の goroutine で動かす
+func runWebhookDeliveryWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookDeliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := deliverWebhooks(ctx, time.Now())
+			if err != nil {
+				log.Errorf("failed to deliver webhooks: %v", err)
+			}
+		}
+	}
+}
+
+// 2xx 以外のレスポンスは失敗として扱う
+func sendWebhook(ctx context.Context, d WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.WebhookURL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isucondition-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Isucondition-Event", d.Event)
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		return res.StatusCode, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsWebhookAddressAllowed(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "93.184.216.34", want: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", want: true},
+		{ip: "127.0.0.1", want: false},
+		{ip: "127.1.2.3", want: false},
+		{ip: "10.1.2.3", want: false},
+		{ip: "172.16.0.1", want: false},
+		{ip: "172.31.255.255", want: false},
+		{ip: "172.32.0.1", want: true},
+		{ip: "192.168.1.1", want: false},
+		{ip: "169.254.169.254", want: false},
+		{ip: "100.64.0.1", want: false},
+		{ip: "0.0.0.0", want: false},
+		{ip: "224.0.0.1", want: false},
+		{ip: "::1", want: false},
+		{ip: "::", want: false},
+		{ip: "fe80::1", want: false},
+		{ip: "fd00::1", want: false},
+		{ip: "::ffff:127.0.0.1", want: false},
+		{ip: "::ffff:169.254.169.254", want: false},
+	}
+	for _, tt := range tests {
+		if got := isWebhookAddressAllowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isWebhookAddressAllowed(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestPostAlertRuleRequestWebhookURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://example.com/hook"},
+		{url: "http://93.184.216.34:8080/hook"},
+		{url: "ftp://example.com/hook", wantErr: true},
+		{url: "https:///hook", wantErr: true},
+		{url: "http://127.0.0.1/hook", wantErr: true},
+		{url: "http://localhost:8080/hook", wantErr: true},
+		{url: "http://169.254.169.254/latest/meta-data/", wantErr: true},
+		{url: "http://[::1]/hook", wantErr: true},
+		{url: "http://10.0.0.1/hook", wantErr: true},
+	}
+	for _, tt := range tests {
+		req := PostAlertRuleRequest{Character: new(string), Kind: alertKindNoCondition, Threshold: 60, WebhookURL: tt.url}
+		*req.Character = "いじっぱり"
+		if err := req.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%v) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSendWebhookRejectsPrivateAddress(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	// 登録時には公開アドレスだったホストが、配信時に 127.0.0.1 を指している場合と同じ
+	_, err := sendWebhook(context.Background(), WebhookDelivery{ID: 1, WebhookURL: server.URL, Payload: "{}"})
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("want blocked address error, got %v", err)
+	}
+	if called {
+		t.Error("webhook was delivered to a loopback address")
+	}
+}
+
+func TestWebhookDeliveryLane(t *testing.T) {
+	lanesByHost := map[string]map[string]bool{}
+	for rule := 1; rule <= 50; rule++ {
+		for _, webhookURL := range []string{"https://a.example.com/hook", "https://A.example.com/other", "https://b.example.com/hook"} {
+			d := WebhookDelivery{AlertRuleID: rule, JIAIsuUUID: "isu", WebhookURL: webhookURL}
+			lane := webhookDeliveryLane(d)
+			host := lane[:strings.Index(lane, "#")]
+			if lanesByHost[host] == nil {
+				lanesByHost[host] = map[string]bool{}
+			}
+			lanesByHost[host][lane] = true
+
+			// 同じルールとISUの配信は常に同じレーンに入る
+			if again := webhookDeliveryLane(d); again != lane {
+				t.Errorf("lane changed: %v, %v", lane, again)
+			}
+		}
+	}
+
+	if len(lanesByHost) != 2 {
+		t.Errorf("hosts = %v, want 2 (host is case-insensitive)", len(lanesByHost))
+	}
+	for host, lanes := range lanesByHost {
+		if len(lanes) > webhookDeliveryPerHost {
+			t.Errorf("%v has %v lanes, want at most %v", host, len(lanes), webhookDeliveryPerHost)
+		}
+	}
+}
+
+// webhookAllowedNetworks を差し替え、テスト後に戻す
+func useTestWebhookAllowedNetworks(t *testing.T, s string) {
+	networks, err := parseWebhookAllowedNetworks(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := webhookAllowedNetworks
+	webhookAllowedNetworks = networks
+	t.Cleanup(func() { webhookAllowedNetworks = allowed })
+}
+
+func TestParseWebhookAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		in        string
+		allowed   []string
+		blocked   []string
+		wantErr   bool
+		wantCount int
+	}{
+		{in: "", wantCount: 0},
+		{in: "127.0.0.0/8, ::1", allowed: []string{"127.0.0.1", "127.9.9.9", "::1"}, blocked: []string{"10.0.0.1"}, wantCount: 2},
+		{in: "172.18.0.5", allowed: []string{"172.18.0.5"}, blocked: []string{"172.18.0.6"}, wantCount: 1},
+		{in: "172.16.0.0/12,", allowed: []string{"172.20.1.1"}, wantCount: 1},
+		{in: "jiaapi-mock", wantErr: true},
+		{in: "10.0.0.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		networks, err := parseWebhookAllowedNetworks(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseWebhookAllowedNetworks(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(networks) != tt.wantCount {
+			t.Errorf("parseWebhookAllowedNetworks(%q) = %v networks, want %v", tt.in, len(networks), tt.wantCount)
+		}
+		useTestWebhookAllowedNetworks(t, tt.in)
+		for _, ip := range tt.allowed {
+			if !isWebhookAddressAllowed(net.ParseIP(ip)) {
+				t.Errorf("%q: %v is blocked", tt.in, ip)
+			}
+		}
+		for _, ip := range tt.blocked {
+			if isWebhookAddressAllowed(net.ParseIP(ip)) {
+				t.Errorf("%q: %v is allowed", tt.in, ip)
+			}
+		}
+	}
+}
+
+func TestPostAlertRuleRequestWebhookURLAllowed(t *testing.T) {
+	useTestWebhookAllowedNetworks(t, "127.0.0.0/8")
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "http://127.0.0.1:5000/webhook"},
+		{url: "http://localhost:5000/webhook"},
+		{url: "http://10.0.0.1/hook", wantErr: true},
+		{url: "http://169.254.169.254/latest/meta-data/", wantErr: true},
+	}
+	for _, tt := range tests {
+		req := PostAlertRuleRequest{Character: new(string), Kind: alertKindNoCondition, Threshold: 60, WebhookURL: tt.url}
+		*req.Character = "いじっぱり"
+		if err := req.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%v) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSendWebhookToAllowedLoopback(t *testing.T) {
+	useTestWebhookAllowedNetworks(t, "127.0.0.0/8,::1")
+
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	statusCode, err := sendWebhook(context.Background(), WebhookDelivery{ID: 1, Event: "firing", WebhookURL: server.URL, Payload: "{}"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if statusCode != http.StatusNoContent {
+		t.Errorf("status code = %v, want %v", statusCode, http.StatusNoContent)
+	}
+	if got == nil || got.Header.Get("X-Isucondition-Event") != "firing" {
+		t.Errorf("webhook was not delivered to the allowed loopback address")
+	}
+}
+
+func TestNextWebhookDeliveries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	due := now.Add(-time.Second)
+	backoff := now.Add(10 * time.Second)
+	delivery := func(id int, rule int, isu string, event string, nextAttemptAt time.Time) WebhookDelivery {
+		return WebhookDelivery{ID: id, AlertRuleID: rule, JIAIsuUUID: isu, Event: event, NextAttemptAt: nextAttemptAt}
+	}
+
+	tests := []struct {
+		name    string
+		pending []WebhookDelivery
+		limit   int
+		want    []int
+	}{
+		{
+			name:    "one per rule and isu",
+			pending: []WebhookDelivery{delivery(1, 1, "a", "firing", due), delivery(2, 1, "a", "resolved", due), delivery(3, 1, "b", "firing", due)},
+			limit:   10,
+			want:    []int{1, 3},
+		},
+		{
+			// 発火の再送待ちの間に解消を先に送らない
+			name:    "newer waits for older in backoff",
+			pending: []WebhookDelivery{delivery(1, 1, "a", "firing", backoff), delivery(2, 1, "a", "resolved", due), delivery(3, 2, "a", "firing", due)},
+			limit:   10,
+			want:    []int{3},
+		},
+		{
+			name:    "limit",
+			pending: []WebhookDelivery{delivery(1, 1, "a", "firing", due), delivery(2, 2, "a", "firing", due), delivery(3, 3, "a", "firing", due)},
+			limit:   2,
+			want:    []int{1, 2},
+		},
+		{
+			name:    "empty",
+			pending: []WebhookDelivery{},
+			limit:   10,
+			want:    []int{},
+		},
+	}
+	for _, tt := range tests {
+		got := []int{}
+		for _, d := range nextWebhookDeliveries(tt.pending, now, tt.limit) {
+			got = append(got, d.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -1,7 +1,28 @@
 DROP TABLE IF EXISTS `isu_association_config`;
+DROP TABLE IF EXISTS `isu_device_credential`;
+DROP TABLE IF EXISTS `isu_icon`;
+DROP TABLE IF EXISTS `isu_icon_variant`;
+DROP TABLE IF EXISTS `isu_condition_key`;
+DROP TABLE IF EXISTS `isu_graph_hourly`;
 DROP TABLE IF EXISTS `isu_condition`;
+DROP TABLE IF EXISTS `isu_condition_archive`;
 DROP TABLE IF EXISTS `isu`;
 DROP TABLE IF EXISTS `user`;
+DROP TABLE IF EXISTS `user_preference`;
+DROP TABLE IF EXISTS `alert_rule`;
+DROP TABLE IF EXISTS `alert_state`;
+DROP TABLE IF EXISTS `webhook_delivery`;
+DROP TABLE IF EXISTS `isu_status`;
+DROP TABLE IF EXISTS `isu_status_history`;
+DROP TABLE IF EXISTS `isu_acl`;
+DROP TABLE IF EXISTS `organization`;
+DROP TABLE IF EXISTS `organization_member`;
+DROP TABLE IF EXISTS `isu_organization`;
+DROP TABLE IF EXISTS `user_session`;
+DROP TABLE IF EXISTS `api_token`;
+DROP TABLE IF EXISTS `isu_activation`;
+DROP TABLE IF EXISTS `isu_import`;
+DROP TABLE IF EXISTS `isu_import_row`;
 
 CREATE TABLE `isu` (
   `id` bigint AUTO_INCREMENT,
@@ -21,9 +42,83 @@ CREATE TABLE `isu_condition` (
   `timestamp` DATETIME NOT NULL,
   `is_sitting` TINYINT(1) NOT NULL,
   `condition` VARCHAR(255) NOT NULL,
+  `is_dirty` TINYINT(1) NOT NULL DEFAULT 0,
+  `is_overweight` TINYINT(1) NOT NULL DEFAULT 0,
+  `is_broken` TINYINT(1) NOT NULL DEFAULT 0,
+  `condition_level` VARCHAR(16) NOT NULL DEFAULT 'info',
   `message` VARCHAR(255) NOT NULL,
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
-  PRIMARY KEY(`id`)
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `uniq_jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`),
+  KEY `idx_jia_isu_uuid_level_timestamp_id` (`jia_isu_uuid`, `condition_level`, `timestamp`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_condition_archive` (
+  `id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `is_dirty` TINYINT(1) NOT NULL DEFAULT 0,
+  `is_overweight` TINYINT(1) NOT NULL DEFAULT 0,
+  `is_broken` TINYINT(1) NOT NULL DEFAULT 0,
+  `condition_level` VARCHAR(16) NOT NULL DEFAULT 'info',
+  `message` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6),
+  `archived_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  KEY `idx_jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_device_credential` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `secret` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_icon` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `blob_key` VARCHAR(128) NOT NULL,
+  `content_type` VARCHAR(64) NOT NULL,
+  `size` INT NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_icon_variant` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `size` INT NOT NULL,
+  `blob_key` VARCHAR(128) NOT NULL,
+  `content_type` VARCHAR(64) NOT NULL,
+  `byte_size` INT NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`jia_isu_uuid`, `size`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_condition_key` (
+  `name` VARCHAR(255) PRIMARY KEY,
+  `display_name` VARCHAR(255) NOT NULL,
+  `severity_weight` INT NOT NULL DEFAULT 1,
+  `sort_order` INT NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+INSERT INTO `isu_condition_key` (`name`, `display_name`, `severity_weight`, `sort_order`) VALUES
+  ('is_dirty', '汚れ', 1, 1),
+  ('is_overweight', '重量オーバー', 1, 2),
+  ('is_broken', '故障', 1, 3);
+
+CREATE TABLE `isu_graph_hourly` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `condition_count` INT NOT NULL,
+  `score_sum` INT NOT NULL,
+  `sitting_count` INT NOT NULL,
+  `is_broken_count` INT NOT NULL,
+  `is_dirty_count` INT NOT NULL,
+  `is_overweight_count` INT NOT NULL,
+  `extra_condition_counts` TEXT NOT NULL,
+  `condition_timestamps` MEDIUMTEXT NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`jia_isu_uuid`, `start_at`)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
 CREATE TABLE `user` (
@@ -31,7 +126,176 @@ CREATE TABLE `user` (
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
+CREATE TABLE `user_preference` (
+  `jia_user_id` VARCHAR(255) PRIMARY KEY,
+  `timezone` VARCHAR(64) NOT NULL DEFAULT '',
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
 CREATE TABLE `isu_association_config` (
   `name` VARCHAR(255) PRIMARY KEY,
   `url` VARCHAR(255) NOT NULL UNIQUE
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `alert_rule` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `jia_isu_uuid` CHAR(36),
+  `character` VARCHAR(255),
+  `kind` VARCHAR(32) NOT NULL,
+  `condition_level` VARCHAR(16) NOT NULL DEFAULT '',
+  `condition_name` VARCHAR(255) NOT NULL DEFAULT '',
+  `threshold` INT NOT NULL,
+  `webhook_url` VARCHAR(2048) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  KEY `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `alert_state` (
+  `alert_rule_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `firing` TINYINT(1) NOT NULL DEFAULT 0,
+  `streak` INT NOT NULL DEFAULT 0,
+  `active_since` DATETIME,
+  `last_timestamp` DATETIME,
+  `last_received_at` DATETIME(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`alert_rule_id`, `jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `webhook_delivery` (
+  `id` bigint AUTO_INCREMENT,
+  `alert_rule_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `event` VARCHAR(16) NOT NULL,
+  `webhook_url` VARCHAR(2048) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL DEFAULT 'pending',
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` DATETIME(6) NOT NULL,
+  `last_status_code` INT NOT NULL DEFAULT 0,
+  `last_error` VARCHAR(1024) NOT NULL DEFAULT '',
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  KEY `idx_alert_rule_id` (`alert_rule_id`, `id`),
+  KEY `idx_status_id` (`status`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_status` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(16) NOT NULL DEFAULT '',
+  `last_seen_at` DATETIME(6),
+  `posting_interval_ms` INT NOT NULL DEFAULT 0,
+  `status_changed_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_status_history` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `from_status` VARCHAR(16) NOT NULL,
+  `to_status` VARCHAR(16) NOT NULL,
+  `last_seen_at` DATETIME(6),
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  KEY `idx_jia_isu_uuid` (`jia_isu_uuid`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_acl` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`jia_isu_uuid`, `jia_user_id`),
+  KEY `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `organization` (
+  `id` bigint AUTO_INCREMENT,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `organization_member` (
+  `organization_id` bigint NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`organization_id`, `jia_user_id`),
+  KEY `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_organization` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `organization_id` bigint NOT NULL,
+  `registered_by` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  KEY `idx_organization_id` (`organization_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `user_session` (
+  `id` bigint AUTO_INCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `user_agent` VARCHAR(512) NOT NULL DEFAULT '',
+  `ip_address` VARCHAR(64) NOT NULL DEFAULT '',
+  `created_at` DATETIME(6) NOT NULL,
+  `last_accessed_at` DATETIME(6) NOT NULL,
+  `expires_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `idx_token_hash` (`token_hash`),
+  KEY `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `api_token` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `token_prefix` VARCHAR(16) NOT NULL,
+  `scope` VARCHAR(16) NOT NULL,
+  `jia_isu_uuid` CHAR(36),
+  `created_at` DATETIME(6) NOT NULL,
+  `last_used_at` DATETIME(6),
+  `expires_at` DATETIME(6),
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `idx_token_hash` (`token_hash`),
+  KEY `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_activation` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` DATETIME(6) NOT NULL,
+  `failure_reason` VARCHAR(255),
+  `created_at` DATETIME(6) NOT NULL,
+  `updated_at` DATETIME(6) NOT NULL,
+  KEY `idx_status_next_attempt_at` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_import` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `organization_id` bigint,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) NOT NULL,
+  `updated_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY(`id`),
+  KEY `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_import_row` (
+  `import_id` bigint NOT NULL,
+  `row_index` INT NOT NULL,
+  `jia_isu_uuid` VARCHAR(36) NOT NULL,
+  `isu_name` VARCHAR(255) NOT NULL,
+  `icon_blob_key` CHAR(64),
+  `result` VARCHAR(16),
+  `message` VARCHAR(255),
+  `processed_at` DATETIME(6),
+  PRIMARY KEY(`import_id`, `row_index`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;